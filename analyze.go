@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Runs the analyze command: go run . analyze [-errorLog=FILE] PATH
+// It rebuilds the cipher counts, the fingerprint clusters and the HTML report of a scan from its saved results,
+// without opening any connection. PATH is the output directory of the scan, its cipher scan file or its JSON result file.
+// The reports are written next to the results, replacing the ones of the scan.
+func runAnalyze(args []string) {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	errorLog := flags.String("errorLog", "", "Error log of the scan (default: errorLog.txt next to the results)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: go run . analyze [-errorLog=FILE] DIR|CIPHERSCAN.csv|RESULTS.json[l]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return
+	}
+
+	dir, prefix, jsonResults, err := locateResults(flags.Arg(0))
+	if err != nil {
+		fmt.Printf("Error reading %s: %v\n", flags.Arg(0), err)
+		return
+	}
+
+	logFileName := *errorLog
+	if logFileName == "" {
+		logFileName = filepath.Join(dir, "errorLog.txt")
+	} else if logFileName, err = filepath.Abs(logFileName); err != nil {
+		fmt.Println("Invalid -errorLog:", err)
+		return
+	}
+	errorCounts := ErrorCounter{OtherErrors: make(map[string]int)}
+	if !fileExists(logFileName) {
+		if *errorLog != "" {
+			fmt.Printf("Error reading the error log: %s does not exist\n", logFileName)
+			return
+		}
+		fmt.Printf("\033[38;5;208mNo error log found at %s, the error report is empty\033[0m\n", logFileName)
+	} else if err := errorCounts.loadErrorLog(logFileName); err != nil {
+		fmt.Println("Error reading the error log:", err)
+		return
+	}
+
+	// The reports take the name prefix of the results, like those of a CSV scan
+	var csvFilePath string
+	if prefix != "" {
+		csvFilePath = strings.TrimSuffix(prefix, "_") + ".csv"
+	}
+	analyzer := newResultAnalyzer(dir, csvFilePath, errorCounts)
+	analyzer.jsonResults = jsonResults
+
+	source := jsonResults
+	if source == "" {
+		source = analyzer.resultPath("cipherScan.csv")
+	}
+	fmt.Printf("\033[38;5;208mAnalyzing %s\033[0m\n", source)
+	analyzer.run()
+	fmt.Printf("\033[38;5;208mReports saved to %s\033[0m\n", dir)
+}
+
+// Finds the results of a scan from the path given to the analyze command.
+// It returns the absolute directory of the results, the prefix of their file names
+// and the JSON result file to read, or an empty string to read the cipher scan file.
+func locateResults(path string) (dir, prefix, jsonResults string, err error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", "", err
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", "", "", err
+	}
+	if info.IsDir() {
+		results, err := loadResultDir(abs)
+		if err != nil {
+			return "", "", "", err
+		}
+		return results.path, results.prefix, "", nil
+	}
+
+	dir, name := filepath.Split(abs)
+	dir = filepath.Clean(dir)
+	switch {
+	case strings.HasSuffix(name, "cipherScan.csv"):
+		return dir, strings.TrimSuffix(name, "cipherScan.csv"), "", nil
+	case strings.HasSuffix(name, jsonResultName(jsonLines)):
+		return dir, strings.TrimSuffix(name, jsonResultName(jsonLines)), abs, nil
+	case strings.HasSuffix(name, jsonResultName(jsonArray)):
+		return dir, strings.TrimSuffix(name, jsonResultName(jsonArray)), abs, nil
+	}
+	return "", "", "", fmt.Errorf("expected a result directory, a cipher scan file or a JSON result file")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLocateResults(t *testing.T) {
+	plain := t.TempDir()
+	writeTestFile(t, plain, "cipherScan.csv", "example.com,TLS_AES_128_GCM_SHA256\n")
+	writeTestFile(t, plain, "results.jsonl", "")
+	prefixed := t.TempDir()
+	writeTestFile(t, prefixed, "top-1m_cipherScan.csv", "example.com,TLS_AES_128_GCM_SHA256\n")
+	writeTestFile(t, prefixed, "top-1m_results.json", "[]\n")
+
+	tests := []struct {
+		name        string
+		path        string
+		dir, prefix string
+		jsonResults string
+	}{
+		{"directory", plain, plain, "", ""},
+		{"cipher scan file", filepath.Join(plain, "cipherScan.csv"), plain, "", ""},
+		{"JSON Lines file", filepath.Join(plain, "results.jsonl"), plain, "", filepath.Join(plain, "results.jsonl")},
+		{"directory of a CSV scan", prefixed, prefixed, "top-1m_", ""},
+		{"cipher scan file of a CSV scan", filepath.Join(prefixed, "top-1m_cipherScan.csv"), prefixed, "top-1m_", ""},
+		{"JSON file of a CSV scan", filepath.Join(prefixed, "top-1m_results.json"), prefixed, "top-1m_", filepath.Join(prefixed, "top-1m_results.json")},
+	}
+	for _, test := range tests {
+		dir, prefix, jsonResults, err := locateResults(test.path)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if dir != test.dir || prefix != test.prefix || jsonResults != test.jsonResults {
+			t.Errorf("%s: located %q, prefix %q, JSON %q; want %q, %q, %q",
+				test.name, dir, prefix, jsonResults, test.dir, test.prefix, test.jsonResults)
+		}
+	}
+
+	// Relative paths are made absolute
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative, err := filepath.Rel(wd, filepath.Join(prefixed, "top-1m_cipherScan.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir, _, _, err := locateResults(relative); err != nil || dir != prefixed {
+		t.Errorf("relative path located %q, %v; want %q", dir, err, prefixed)
+	}
+
+	several := t.TempDir()
+	writeTestFile(t, several, "a_cipherScan.csv", "")
+	writeTestFile(t, several, "b_cipherScan.csv", "")
+	errorTests := []struct {
+		name, path string
+	}{
+		{"missing path", filepath.Join(plain, "missing")},
+		{"directory without results", t.TempDir()},
+		{"directory with several scans", several},
+		{"other file", writeTestFile(t, t.TempDir(), "domains.csv", "example.com\n")},
+	}
+	for _, test := range errorTests {
+		if _, _, _, err := locateResults(test.path); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestRunAnalyzePrefixedScan(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "top-1m_cipherScan.csv", "example.com,TLS_AES_128_GCM_SHA256;TLS_AES_256_GCM_SHA384\n"+
+		"example.org,TLS_AES_128_GCM_SHA256\n")
+	writeTestFile(t, dir, "errorLog.txt", "")
+
+	runAnalyze([]string{filepath.Join(dir, "top-1m_cipherScan.csv")})
+
+	// The reports take the prefix of the results and no unprefixed ones are written
+	counts := readTestFile(t, filepath.Join(dir, "top-1m_cipherCounts.csv"))
+	if want := "TLS_AES_128_GCM_SHA256,2"; !slices.Contains(strings.Split(counts, "\n"), want) {
+		t.Errorf("cipher counts %q lack %q", counts, want)
+	}
+	if !fileExists(filepath.Join(dir, "top-1m_plot.html")) {
+		t.Error("no prefixed plot written")
+	}
+	for _, name := range []string{"cipherCounts.csv", "plot.html"} {
+		if fileExists(filepath.Join(dir, name)) {
+			t.Errorf("unprefixed %s written", name)
+		}
+	}
+}
@@ -10,92 +10,160 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/TeoLj/TLSscanner_FP.git/schema"
 	"github.com/go-echarts/go-echarts/v2/charts"
 	"github.com/go-echarts/go-echarts/v2/components"
 	"github.com/go-echarts/go-echarts/v2/opts"
 )
 
 type Analyzer struct {
-	ScannedCiphers       []string
 	CSVFilePath          string
 	ScanAndSaveDirectory string
 	DomainsList          string
 	cipherCount          map[string]int
 	Mutex                *sync.Mutex // fine grained locking
 	ErrorCounts          ErrorCounter
+	fingerprintClusters  []FingerprintCluster
+	store                *resultStore // database of the scan, nil unless -db is set
+	jsonResults          string       // JSON result file to read the results from instead of the CSV files, see the analyze command
 }
 
 func newAnalyzer(scanner Scanner) *Analyzer {
+	a := newResultAnalyzer(scanner.opts.SaveDir, scanner.opts.CSVFilePath, scanner.ErrorCounts)
+	a.DomainsList = scanner.opts.DomainsList
+	a.store = scanner.store
+	return a
+}
+
+// Creates an analyzer for the results saved in a directory, named after the input CSV file if csvFilePath is set
+func newResultAnalyzer(saveDir, csvFilePath string, errorCounts ErrorCounter) *Analyzer {
 	return &Analyzer{
-		ScannedCiphers:       scanner.ScannedCiphers,
-		ScanAndSaveDirectory: scanner.opts.SaveDir,
-		CSVFilePath:          scanner.opts.CSVFilePath,
-		DomainsList:          scanner.opts.DomainsList,
+		ScanAndSaveDirectory: saveDir,
+		CSVFilePath:          csvFilePath,
 		cipherCount:          make(map[string]int),
 		Mutex:                &sync.Mutex{},
-		ErrorCounts:          scanner.ErrorCounts,
+		ErrorCounts:          errorCounts,
 	}
 }
 
-// Executes the TLS scanning and analysis process.
-// It counts the ciphers used in the TLS connections and saves the results to a CSV file.
+// Executes the analysis of the saved scan results.
+// It reads the result files written during the scan, counts the ciphers and saves the counts to a CSV file.
 // If a ScanAndSaveDirectory is provided, it changes the current working directory to that directory.
-// If a CSVFilePath is provided, it saves the cipher counts to a CSV file with a filename based on the CSVFilePath,
-// plots the cipher counts from the CSV file, and combines the charts into an HTML file.
+// The cipher counts are plotted and combined with the other charts into an HTML file.
+// Files of a CSV scan take the name of the input file as prefix.
+// With a database, the counts and the per-domain results are read from the current run in the database instead,
+// and with a JSON result file from that file.
 func (a *Analyzer) run() {
 
-	a.countCiphers()
-	fileName := strings.TrimSuffix(strings.TrimPrefix(a.CSVFilePath, "./"), ".csv")
-	outputDir := "./output"
+	switch {
+	case a.store != nil:
+		a.loadFromStore()
+	case a.jsonResults != "":
+		a.countCiphersFromJSON(a.jsonResults)
+	default:
+		a.countCiphers(a.resultPath("cipherScan.csv"))
+	}
+	if fingerprints, ok := a.records("fingerprints.csv"); ok {
+		a.fingerprintClusters = a.clusterFingerprints(fingerprints)
+	}
 
 	if a.ScanAndSaveDirectory != "" {
 		os.Chdir(a.ScanAndSaveDirectory)
-		outputDir = a.ScanAndSaveDirectory
 	}
 
-	if a.DomainsList != "" {
-		a.saveCiphersCount(outputDir + "/cipherCounts.csv")
-		a.plotCipherCountsFromCSV(outputDir + "/cipherCounts.csv")
-		a.combineCharts(outputDir+"/cipherCounts.csv", outputDir+"/plot.html", a.ErrorCounts)
-	}
-
-	if a.CSVFilePath != "" {
-		a.saveCiphersCount(outputDir + "/" + fileName + "_cipherCounts.csv")
-		a.plotCipherCountsFromCSV(outputDir + "/" + fileName + "_cipherCounts.csv")
-		a.combineCharts(outputDir+"/"+fileName+"_cipherCounts.csv", outputDir+"/"+fileName+"_plot.html", a.ErrorCounts)
+	a.saveCiphersCount(a.resultPath("cipherCounts.csv"))
+	a.combineCharts(a.resultPath("cipherCounts.csv"), a.resultPath("plot.html"), a.ErrorCounts)
+	if a.fingerprintClusters != nil {
+		a.saveFingerprintClusters(a.resultPath("fingerprintClusters.csv"), a.fingerprintClusters)
 	}
+}
 
+// Returns the path of a result file in the output directory
+func (a *Analyzer) resultPath(name string) string {
+	return resultFilePath(a.ScanAndSaveDirectory, a.CSVFilePath, name)
 }
 
-// Iterates over the scanned ciphers and counts the occurrence of each cipher.
-// The function splits the string into domain and ciphers parts, and then counts each cipher occurrence.
+// Reads the cipher scan file and counts the occurrence of each cipher.
+// Each row of the file contains a domain followed by its ciphers separated by ";".
+// The file is read row by row, so only the counts are kept in memory.
 // The result is a map[string]int where the keys are the cipher names and the values are the counts.
-func (a *Analyzer) countCiphers() map[string]int {
-
-	// Iterate over the scanned ciphers, assuming each entry is a domain followed by a list of ciphers
-	for _, scanned := range a.ScannedCiphers {
-		// Split the string into domain and ciphers part
-		parts := strings.Split(scanned, ": ")
-		if len(parts) != 2 {
-			fmt.Println("Unexpected format in ScannedCiphers, skipping:", scanned)
+func (a *Analyzer) countCiphers(filename string) map[string]int {
+
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Println("Error opening CSV file:", err)
+		return a.cipherCount
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println("Error reading CSV file:", err)
+			break
+		}
+		if len(record) != 2 {
+			fmt.Println("Unexpected format in cipher scan file, skipping:", strings.Join(record, ","))
 			continue
 		}
 
-		ciphers := strings.Split(parts[1], ";")
-
 		// Count each cipher occurrence
-		for _, cipher := range ciphers {
+		for _, cipher := range strings.Split(record[1], ";") {
+			cipher = strings.TrimSpace(cipher)
 			if cipher != "" {
 				a.cipherCount[cipher]++
 			}
 		}
 	}
-	// Now print the count of each cipher suite
+	a.printCipherCounts()
+	return a.cipherCount
+}
+
+// Counts the supported cipher suites of the completed domains in a JSON result file
+func (a *Analyzer) countCiphersFromJSON(filename string) map[string]int {
+	err := forEachJSONResult(filename, func(r *schema.Result) {
+		if r.Status != schema.StatusCompleted {
+			return
+		}
+		for _, cipher := range r.Ciphers {
+			a.cipherCount[cipher]++
+		}
+	})
+	if err != nil {
+		fmt.Println("Error reading JSON file:", err)
+	}
+	a.printCipherCounts()
+	return a.cipherCount
+}
+
+// Takes the cipher counts and the error counts from the current run in the database
+func (a *Analyzer) loadFromStore() {
+	counts, err := a.store.cipherCounts()
+	if err != nil {
+		fmt.Println("Error reading the cipher counts from the database:", err)
+	} else {
+		a.cipherCount = counts
+	}
+	errorCounts, err := a.store.errorCounts()
+	if err != nil {
+		fmt.Println("Error reading the error counts from the database:", err)
+	} else {
+		a.ErrorCounts = errorCounts
+	}
+	a.printCipherCounts()
+}
+
+// Prints the count of each cipher suite
+func (a *Analyzer) printCipherCounts() {
 	fmt.Println("\n\033[1;33mCipher suite occurrences:\033[0m")
 	for cipher, count := range a.cipherCount {
 		fmt.Printf("%s: \033[1;34m%d\033[0m\n", cipher, count)
 	}
-	return a.cipherCount
 }
 
 // Saves the cipher count to a CSV file.
@@ -352,6 +420,16 @@ func (a *Analyzer) combineCharts(filenameIn, filenameOut string, errorCounts Err
 
 	page.AddCharts(bar, pie)
 
+	if httpResults, ok := a.records("http.csv"); ok {
+		page.AddCharts(a.plotHSTSAdoption(httpResults))
+	}
+	if dnsResults, ok := a.records("dns.csv"); ok {
+		page.AddCharts(a.plotDNSResults(dnsResults))
+	}
+	if len(a.fingerprintClusters) > 0 {
+		page.AddCharts(a.plotFingerprintClusters(a.fingerprintClusters))
+	}
+
 	// Render the page to the specified output file
 	f, err := os.Create(filenameOut)
 	if err != nil {
@@ -364,3 +442,77 @@ func (a *Analyzer) combineCharts(filenameIn, filenameOut string, errorCounts Err
 		fmt.Println("Failed to render page:", err)
 	}
 }
+
+// Produces the rows of a result file, passing the values of each row keyed by their column name to fn
+type recordSource func(fn func(row map[string]string)) error
+
+// Returns the rows of a result file, read from the database or the JSON result file if there is one
+// and from the file otherwise, and reports whether there are any results of that kind
+func (a *Analyzer) records(name string) (recordSource, bool) {
+	if a.store != nil {
+		return a.store.records(name)
+	}
+	if a.jsonResults != "" {
+		return jsonRecords(a.jsonResults, name)
+	}
+	filename := a.resultPath(name)
+	if !fileExists(filename) {
+		return nil, false
+	}
+	return func(fn func(row map[string]string)) error {
+		return forEachResultRecord(filename, fn)
+	}, true
+}
+
+// Returns the rows of a result file built from the results of a JSON result file,
+// and reports whether any result has such a row
+func jsonRecords(filename, name string) (recordSource, bool) {
+	source := func(fn func(row map[string]string)) error {
+		return forEachJSONResult(filename, func(r *schema.Result) {
+			if row := schemaRecord(name, r); row != nil {
+				fn(row)
+			}
+		})
+	}
+	found := false
+	source(func(row map[string]string) { found = true })
+	return source, found
+}
+
+// Reads a result file with a header row and calls fn for every row,
+// passing the values keyed by their column name.
+func forEachResultRecord(filename string, fn func(row map[string]string)) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row := make(map[string]string, len(header))
+		for i, column := range header {
+			if i < len(record) {
+				row[column] = record[i]
+			}
+		}
+		fn(row)
+	}
+}
+
+// Reports whether a file exists
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"math/big"
+	"time"
+)
+
+// A certificate presented by the server, reduced to the fields kept in the results
+type CertificateInfo struct {
+	Subject            string
+	Issuer             string
+	Serial             string // hexadecimal
+	NotBefore          time.Time
+	NotAfter           time.Time
+	DNSNames           []string
+	KeyAlgorithm       string
+	SignatureAlgorithm string
+	SHA256             string // hexadecimal fingerprint of the DER encoding
+}
+
+// Describes the certificate chain of a handshake, leaf first, in the order the server sent it
+func certificateChain(certificates []*x509.Certificate) []CertificateInfo {
+	chain := make([]CertificateInfo, 0, len(certificates))
+	for _, cert := range certificates {
+		fingerprint := sha256.Sum256(cert.Raw)
+		serial := cert.SerialNumber
+		if serial == nil {
+			serial = new(big.Int)
+		}
+		chain = append(chain, CertificateInfo{
+			Subject:            cert.Subject.String(),
+			Issuer:             cert.Issuer.String(),
+			Serial:             serial.Text(16),
+			NotBefore:          cert.NotBefore,
+			NotAfter:           cert.NotAfter,
+			DNSNames:           cert.DNSNames,
+			KeyAlgorithm:       cert.PublicKeyAlgorithm.String(),
+			SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+			SHA256:             hex.EncodeToString(fingerprint[:]),
+		})
+	}
+	return chain
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Separator written between the lines of the sorted error log
+const errorLogSeparator = "--------------------------------"
+
+// Records the domains whose results have been written completely.
+// The file holds one domain per line and is appended to after the domain's rows reached the result files,
+// so every domain listed in it can be skipped when a scan is resumed.
+type checkpoint struct {
+	file *os.File
+}
+
+// Opens the checkpoint file for appending, creating it if needed.
+// Unless the scan is resumed, old content is removed.
+func openCheckpoint(filename string, resume bool) (*checkpoint, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint{file: file}, nil
+}
+
+// Appends a finished domain to the checkpoint file.
+// The line is written with a single write call, so a killed process leaves at most one partial line behind.
+func (c *checkpoint) markDone(domain string) error {
+	_, err := c.file.WriteString(domain + "\n")
+	return err
+}
+
+// Closes the checkpoint file
+func (c *checkpoint) close() {
+	c.file.Close()
+}
+
+// Reads the finished domains from a checkpoint file.
+// A partial last line, left behind by a killed process, is ignored and removed from the file.
+// A missing checkpoint file means that no domain has been finished yet.
+func loadCheckpoint(filename string) (map[string]bool, error) {
+	done := make(map[string]bool)
+
+	content, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	complete := completeLines(content)
+	if len(complete) != len(content) {
+		if err := os.Truncate(filename, int64(len(complete))); err != nil {
+			return nil, err
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(complete))
+	for scanner.Scan() {
+		if domain := strings.TrimSpace(scanner.Text()); domain != "" {
+			done[domain] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// Returns the content up to and including its last newline
+func completeLines(content []byte) []byte {
+	return content[:bytes.LastIndexByte(content, '\n')+1]
+}
+
+// Rewrites a result file so that it only contains the rows of finished domains.
+// Rows of domains that were being scanned when the previous run stopped are dropped, as these domains are scanned again,
+// and so is a partial last row. The domain is expected in the first column; the header, if any, is kept.
+func pruneResultFile(filename string, done map[string]bool, hasHeader bool) error {
+	content, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var pruned bytes.Buffer
+	writer := csv.NewWriter(&pruned)
+	reader := csv.NewReader(bytes.NewReader(completeLines(content)))
+	reader.FieldsPerRecord = -1
+
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		if (first && hasHeader) || (len(record) > 0 && done[record[0]]) {
+			writer.Write(record)
+		}
+	}
+	writer.Flush()
+
+	return replaceFile(filename, pruned.Bytes())
+}
+
+// Rewrites the error log so that it only contains the errors of finished domains.
+// Separator lines of a previously sorted log are dropped.
+func pruneErrorLog(filename string, done map[string]bool) error {
+	content, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var pruned bytes.Buffer
+	for _, line := range strings.Split(string(completeLines(content)), "\n") {
+		if line == "" || line == errorLogSeparator {
+			continue
+		}
+		domain, _, _ := strings.Cut(line, ": ")
+		if done[domain] {
+			pruned.WriteString(line + "\n")
+		}
+	}
+	return replaceFile(filename, pruned.Bytes())
+}
+
+// Rebuilds the error counts from the lines of an error log,
+// so that the report of a resumed scan includes the errors of the previous runs.
+func (c *ErrorCounter) loadErrorLog(filename string) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line == errorLogSeparator {
+			continue
+		}
+		_, errMsg, _ := strings.Cut(line, ": ")
+		category, _ := classifyError(errMsg)
+		if category == errMsg {
+			// Uncategorized errors are counted by their message, without the cipher suite appended by logError
+			if i := strings.LastIndex(errMsg, " for "); i >= 0 {
+				category = errMsg[:i]
+			}
+		}
+		c.add(category)
+	}
+	return scanner.Err()
+}
+
+// Replaces the content of a file by writing a temporary file and renaming it,
+// so the original stays intact if the process is killed in between.
+func replaceFile(filename string, content []byte) error {
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes a file in the directory and returns its path
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Returns the content of a file
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestResumePrunesUnfinishedDomains(t *testing.T) {
+	dir := t.TempDir()
+
+	// The previous run was killed while appending b.example to the checkpoint file
+	checkpointPath := writeTestFile(t, dir, "checkpoint.txt", "a.example\nc.example:8443\nb.exa")
+	done, err := loadCheckpoint(checkpointPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != 2 || !done["a.example"] || !done["c.example:8443"] {
+		t.Errorf("finished domains = %v, want a.example and c.example:8443", done)
+	}
+	if content := readTestFile(t, checkpointPath); content != "a.example\nc.example:8443\n" {
+		t.Errorf("checkpoint file = %q, want the partial line removed", content)
+	}
+
+	// b.example was written but not checkpointed, d.example was being written when the run stopped
+	resultPath := writeTestFile(t, dir, "cipherScan.csv",
+		"Domain,Ciphers\na.example,TLS_AES_128_GCM_SHA256\nb.example,TLS_AES_128_GCM_SHA256\n"+
+			"\"c.example:8443\",\"TLS_AES_128_GCM_SHA256;TLS_AES_256_GCM_SHA384\"\nd.exam")
+	if err := pruneResultFile(resultPath, done, true); err != nil {
+		t.Fatal(err)
+	}
+	want := "Domain,Ciphers\na.example,TLS_AES_128_GCM_SHA256\nc.example:8443,TLS_AES_128_GCM_SHA256;TLS_AES_256_GCM_SHA384\n"
+	if content := readTestFile(t, resultPath); content != want {
+		t.Errorf("result file = %q, want %q", content, want)
+	}
+
+	// Without a header the first row is pruned like any other
+	headerless := writeTestFile(t, dir, "headerless.csv", "b.example,1\na.example,2\n")
+	if err := pruneResultFile(headerless, done, false); err != nil {
+		t.Fatal(err)
+	}
+	if content := readTestFile(t, headerless); content != "a.example,2\n" {
+		t.Errorf("result file without header = %q", content)
+	}
+
+	errorLogPath := writeTestFile(t, dir, "errorLog.txt",
+		"a.example: tls: handshake failure for TLS_RSA_WITH_RC4_128_SHA\n"+errorLogSeparator+"\n"+
+			"b.example: i/o timeout\nc.example:8443: connection refused for TLS_AES_128_GCM_SHA256\nd.example: no such ho")
+	if err := pruneErrorLog(errorLogPath, done); err != nil {
+		t.Fatal(err)
+	}
+	want = "a.example: tls: handshake failure for TLS_RSA_WITH_RC4_128_SHA\nc.example:8443: connection refused for TLS_AES_128_GCM_SHA256\n"
+	if content := readTestFile(t, errorLogPath); content != want {
+		t.Errorf("error log = %q, want %q", content, want)
+	}
+
+	// Files of result types the previous run did not write are left missing
+	missing := filepath.Join(dir, "missing.csv")
+	if err := pruneResultFile(missing, done, true); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("pruning created %s", missing)
+	}
+}
+
+func TestLoadCheckpointMissing(t *testing.T) {
+	done, err := loadCheckpoint(filepath.Join(t.TempDir(), "checkpoint.txt"))
+	if err != nil || len(done) != 0 {
+		t.Errorf("loadCheckpoint of a missing file = %v, %v; want no domains", done, err)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	cryptobyte_asn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/crypto/ocsp"
+)
+
+// OIDs of the SCT list extensions in certificates and OCSP responses (RFC 6962)
+var (
+	oidEmbeddedSCT = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+	oidOCSPSCT     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 5}
+)
+
+// Sources an SCT can be delivered through
+const (
+	sctSourceTLS      = "tls"
+	sctSourceOCSP     = "ocsp"
+	sctSourceEmbedded = "embedded"
+)
+
+// Contains the CT logs known to the scanner, indexed by their base64 log ID
+type CTLogList struct {
+	Logs map[string]*CTLog
+}
+
+// A single CT log of the log list
+type CTLog struct {
+	Description string
+	Operator    string
+	Key         crypto.PublicKey
+	State       string
+	RetiredAt   time.Time
+}
+
+// Layout of Chrome's log_list.json (version 3)
+type ctLogListJSON struct {
+	Operators []struct {
+		Name string `json:"name"`
+		Logs []struct {
+			Description string `json:"description"`
+			LogID       string `json:"log_id"`
+			Key         string `json:"key"`
+			State       map[string]struct {
+				Timestamp time.Time `json:"timestamp"`
+			} `json:"state"`
+		} `json:"logs"`
+	} `json:"operators"`
+}
+
+// Contains the Certificate Transparency information of a domain
+type CTResult struct {
+	SCTs            []SCTInfo
+	ValidSCTs       int
+	Operators       int  // distinct operators of the logs that issued valid SCTs
+	PolicySatisfied bool // whether the browser CT policy is met
+	Error           string
+}
+
+// A single SCT and the outcome of its verification
+type SCTInfo struct {
+	Source    string
+	LogID     string
+	Log       string
+	Operator  string
+	Timestamp time.Time
+	Valid     bool
+	Error     string
+}
+
+// Reads a CT log list in the format of Chrome's log_list.json.
+// Logs whose key cannot be parsed are skipped.
+func loadCTLogList(filePath string) (*CTLogList, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw ctLogListJSON
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, err
+	}
+
+	list := &CTLogList{Logs: make(map[string]*CTLog)}
+	for _, operator := range raw.Operators {
+		for _, log := range operator.Logs {
+			der, err := base64.StdEncoding.DecodeString(log.Key)
+			if err != nil {
+				continue
+			}
+			key, err := x509.ParsePKIXPublicKey(der)
+			if err != nil {
+				continue
+			}
+			ctLog := &CTLog{Description: log.Description, Operator: operator.Name, Key: key}
+			for state, info := range log.State {
+				ctLog.State = state
+				if state == "retired" {
+					ctLog.RetiredAt = info.Timestamp
+				}
+			}
+			list.Logs[log.LogID] = ctLog
+		}
+	}
+	return list, nil
+}
+
+// Extracts the SCTs delivered through the TLS extension, the stapled OCSP response
+// and the certificate itself, and verifies them against the configured log list.
+func (s *Scanner) checkCT(state tls.ConnectionState) *CTResult {
+	result := &CTResult{}
+	if len(state.PeerCertificates) == 0 {
+		result.Error = "no peer certificates"
+		return result
+	}
+
+	leaf := state.PeerCertificates[0]
+	var issuer *x509.Certificate
+	if len(state.PeerCertificates) > 1 {
+		issuer = state.PeerCertificates[1]
+	}
+
+	for _, sct := range state.SignedCertificateTimestamps {
+		result.SCTs = append(result.SCTs, s.verifySCT(sct, sctSourceTLS, leaf, issuer))
+	}
+
+	if len(state.OCSPResponse) > 0 {
+		if resp, err := ocsp.ParseResponse(state.OCSPResponse, issuer); err == nil {
+			for _, ext := range resp.Extensions {
+				if ext.Id.Equal(oidOCSPSCT) {
+					result.addSCTList(s, ext.Value, sctSourceOCSP, leaf, issuer)
+				}
+			}
+		}
+	}
+
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(oidEmbeddedSCT) {
+			result.addSCTList(s, ext.Value, sctSourceEmbedded, leaf, issuer)
+		}
+	}
+
+	result.evaluatePolicy(leaf)
+	return result
+}
+
+// Parses an SCT list extension value and verifies each SCT in it
+func (r *CTResult) addSCTList(s *Scanner, value []byte, source string, leaf, issuer *x509.Certificate) {
+	var list []byte
+	if _, err := asn1.Unmarshal(value, &list); err != nil {
+		r.Error = source + " SCT list: " + err.Error()
+		return
+	}
+
+	scts, err := parseSCTList(list)
+	if err != nil {
+		r.Error = source + " SCT list: " + err.Error()
+		return
+	}
+	for _, sct := range scts {
+		r.SCTs = append(r.SCTs, s.verifySCT(sct, source, leaf, issuer))
+	}
+}
+
+// Splits a TLS encoded SignedCertificateTimestampList into single SCTs
+func parseSCTList(data []byte) ([][]byte, error) {
+	input := cryptobyte.String(data)
+	var list cryptobyte.String
+	if !input.ReadUint16LengthPrefixed(&list) || !input.Empty() {
+		return nil, errors.New("malformed SCT list")
+	}
+
+	var scts [][]byte
+	for !list.Empty() {
+		var sct cryptobyte.String
+		if !list.ReadUint16LengthPrefixed(&sct) {
+			return nil, errors.New("malformed SCT list")
+		}
+		scts = append(scts, sct)
+	}
+	return scts, nil
+}
+
+// Parsed form of a version 1 SignedCertificateTimestamp
+type sct struct {
+	logID      []byte
+	timestamp  uint64
+	extensions []byte
+	hashAlg    uint8
+	sigAlg     uint8
+	signature  []byte
+}
+
+// Parses a single TLS encoded SCT
+func parseSCT(data []byte) (*sct, error) {
+	input := cryptobyte.String(data)
+	var version uint8
+	if !input.ReadUint8(&version) {
+		return nil, errors.New("malformed SCT")
+	}
+	if version != 0 {
+		return nil, fmt.Errorf("unsupported SCT version %d", version)
+	}
+
+	var parsed sct
+	var extensions, signature cryptobyte.String
+	if !input.ReadBytes(&parsed.logID, 32) ||
+		!input.ReadUint64(&parsed.timestamp) ||
+		!input.ReadUint16LengthPrefixed(&extensions) ||
+		!input.ReadUint8(&parsed.hashAlg) ||
+		!input.ReadUint8(&parsed.sigAlg) ||
+		!input.ReadUint16LengthPrefixed(&signature) ||
+		!input.Empty() {
+		return nil, errors.New("malformed SCT")
+	}
+	parsed.extensions = extensions
+	parsed.signature = signature
+	return &parsed, nil
+}
+
+// Verifies an SCT against the log list.
+// SCTs delivered through TLS or OCSP sign the final certificate,
+// embedded SCTs sign the precertificate.
+func (s *Scanner) verifySCT(data []byte, source string, leaf, issuer *x509.Certificate) SCTInfo {
+	info := SCTInfo{Source: source}
+
+	parsed, err := parseSCT(data)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.LogID = base64.StdEncoding.EncodeToString(parsed.logID)
+	info.Timestamp = time.UnixMilli(int64(parsed.timestamp)).UTC()
+
+	if s.CTLogs == nil {
+		info.Error = "no log list configured"
+		return info
+	}
+	log, ok := s.CTLogs.Logs[info.LogID]
+	if !ok {
+		info.Error = "unknown log"
+		return info
+	}
+	info.Log = log.Description
+	info.Operator = log.Operator
+
+	switch log.State {
+	case "usable", "qualified", "readonly":
+	case "retired":
+		if !info.Timestamp.Before(log.RetiredAt) {
+			info.Error = "log retired before SCT was issued"
+			return info
+		}
+	default:
+		info.Error = "log state " + log.State
+		return info
+	}
+
+	signed, err := sctSignedData(parsed, source, leaf, issuer)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	if err := verifySCTSignature(log.Key, parsed, signed); err != nil {
+		info.Error = err.Error()
+		return info
+	}
+
+	info.Valid = true
+	return info
+}
+
+// Builds the data covered by the SCT signature (RFC 6962, section 3.2)
+func sctSignedData(parsed *sct, source string, leaf, issuer *x509.Certificate) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddUint8(0) // version v1
+	b.AddUint8(0) // signature type certificate_timestamp
+	b.AddUint64(parsed.timestamp)
+
+	if source == sctSourceEmbedded {
+		if issuer == nil {
+			return nil, errors.New("issuer certificate required for embedded SCT")
+		}
+		tbs, err := removeSCTExtension(leaf.RawTBSCertificate)
+		if err != nil {
+			return nil, err
+		}
+		issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+
+		b.AddUint16(1) // precert_entry
+		b.AddBytes(issuerKeyHash[:])
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(tbs) })
+	} else {
+		b.AddUint16(0) // x509_entry
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(leaf.Raw) })
+	}
+
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(parsed.extensions) })
+	return b.Bytes()
+}
+
+// Rebuilds a TBSCertificate without the embedded SCT extension,
+// which yields the TBSCertificate of the precertificate the log signed.
+func removeSCTExtension(rawTBS []byte) ([]byte, error) {
+	input := cryptobyte.String(rawTBS)
+	var tbs cryptobyte.String
+	if !input.ReadASN1(&tbs, cryptobyte_asn1.SEQUENCE) {
+		return nil, errors.New("malformed TBSCertificate")
+	}
+
+	extensionsTag := cryptobyte_asn1.Tag(3).Constructed().ContextSpecific()
+
+	var b cryptobyte.Builder
+	b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !tbs.Empty() {
+			var element cryptobyte.String
+			var tag cryptobyte_asn1.Tag
+			if !tbs.ReadAnyASN1Element(&element, &tag) {
+				b.SetError(errors.New("malformed TBSCertificate"))
+				return
+			}
+			if tag != extensionsTag {
+				b.AddBytes(element)
+				continue
+			}
+
+			var wrapper, extensions cryptobyte.String
+			if !element.ReadASN1(&wrapper, extensionsTag) || !wrapper.ReadASN1(&extensions, cryptobyte_asn1.SEQUENCE) {
+				b.SetError(errors.New("malformed extensions"))
+				return
+			}
+			b.AddASN1(extensionsTag, func(b *cryptobyte.Builder) {
+				b.AddASN1(cryptobyte_asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					for !extensions.Empty() {
+						var extension, body cryptobyte.String
+						var oid asn1.ObjectIdentifier
+						if !extensions.ReadASN1Element(&extension, cryptobyte_asn1.SEQUENCE) {
+							b.SetError(errors.New("malformed extension"))
+							return
+						}
+						element := extension
+						if !element.ReadASN1(&body, cryptobyte_asn1.SEQUENCE) || !body.ReadASN1ObjectIdentifier(&oid) {
+							b.SetError(errors.New("malformed extension"))
+							return
+						}
+						if !oid.Equal(oidEmbeddedSCT) {
+							b.AddBytes(extension)
+						}
+					}
+				})
+			})
+		}
+	})
+	return b.Bytes()
+}
+
+// Checks the SCT signature with the log's public key.
+// RFC 6962 logs sign with SHA-256 using either ECDSA or RSA.
+func verifySCTSignature(key crypto.PublicKey, parsed *sct, signed []byte) error {
+	if parsed.hashAlg != 4 { // sha256
+		return fmt.Errorf("unsupported hash algorithm %d", parsed.hashAlg)
+	}
+	digest := sha256.Sum256(signed)
+
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		if parsed.sigAlg != 3 {
+			return errors.New("signature algorithm does not match log key")
+		}
+		if !ecdsa.VerifyASN1(pub, digest[:], parsed.signature) {
+			return errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if parsed.sigAlg != 1 {
+			return errors.New("signature algorithm does not match log key")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], parsed.signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("unsupported log key type")
+	}
+	return nil
+}
+
+// Counts the valid SCTs and their distinct operators and checks the browser CT policy.
+// Following Chrome's policy, embedded SCTs must come from two (certificate lifetime up to 180 days)
+// or three distinct logs, while SCTs delivered through TLS or OCSP need two distinct logs.
+// In both cases the logs must belong to at least two distinct operators.
+func (r *CTResult) evaluatePolicy(leaf *x509.Certificate) {
+	operators := make(map[string]bool)
+	embeddedLogs := make(map[string]bool)
+	embeddedOperators := make(map[string]bool)
+	deliveredLogs := make(map[string]bool)
+	deliveredOperators := make(map[string]bool)
+
+	for _, sct := range r.SCTs {
+		if !sct.Valid {
+			continue
+		}
+		r.ValidSCTs++
+		operators[sct.Operator] = true
+		if sct.Source == sctSourceEmbedded {
+			embeddedLogs[sct.LogID] = true
+			embeddedOperators[sct.Operator] = true
+		} else {
+			deliveredLogs[sct.LogID] = true
+			deliveredOperators[sct.Operator] = true
+		}
+	}
+	r.Operators = len(operators)
+
+	requiredEmbedded := 3
+	if leaf.NotAfter.Sub(leaf.NotBefore) <= 180*24*time.Hour {
+		requiredEmbedded = 2
+	}
+
+	embeddedOK := len(embeddedLogs) >= requiredEmbedded && len(embeddedOperators) >= 2
+	deliveredOK := len(deliveredLogs) >= 2 && len(deliveredOperators) >= 2
+	r.PolicySatisfied = embeddedOK || deliveredOK
+}
+
+// Header of the Certificate Transparency result file
+var ctHeader = []string{"Domain", "SCTs", "ValidSCTs", "Operators", "PolicySatisfied", "Details", "Error"}
+
+// Converts the Certificate Transparency result of a domain to a row of the CT result file.
+// It returns nil if the domain has no CT result.
+func ctRecord(result *DomainResult) []string {
+	if result.CT == nil {
+		return nil
+	}
+	ct := result.CT
+
+	details := make([]string, 0, len(ct.SCTs))
+	for _, sct := range ct.SCTs {
+		detail := sct.Source + " " + sct.LogID
+		if sct.Log != "" {
+			detail = sct.Source + " " + sct.Log
+		}
+		if sct.Valid {
+			detail += " valid"
+		} else {
+			detail += " invalid (" + sct.Error + ")"
+		}
+		details = append(details, detail)
+	}
+
+	return []string{
+		result.Domain,
+		fmt.Sprintf("%d", len(ct.SCTs)),
+		fmt.Sprintf("%d", ct.ValidSCTs),
+		fmt.Sprintf("%d", ct.Operators),
+		fmt.Sprintf("%t", ct.PolicySatisfied),
+		strings.Join(details, ";"),
+		ct.Error,
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// A CT log with its signing key, created for the tests
+type testLog struct {
+	key *ecdsa.PrivateKey
+	id  []byte // SHA-256 of the DER encoded public key
+	der []byte
+}
+
+// Creates a CT log with a fresh ECDSA key
+func newTestLog(t *testing.T) *testLog {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := sha256.Sum256(der)
+	return &testLog{key: key, id: id[:], der: der}
+}
+
+// Returns the base64 log ID, the key of the log in the log list
+func (l *testLog) logID() string {
+	return base64.StdEncoding.EncodeToString(l.id)
+}
+
+// Signs an SCT for the certificate as the log does and returns it TLS encoded
+func (l *testLog) sign(t *testing.T, timestamp time.Time, source string, leaf, issuer *x509.Certificate) []byte {
+	t.Helper()
+	parsed := &sct{logID: l.id, timestamp: uint64(timestamp.UnixMilli()), hashAlg: 4, sigAlg: 3}
+	signed, err := sctSignedData(parsed, source, leaf, issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(signed)
+	if parsed.signature, err = ecdsa.SignASN1(rand.Reader, l.key, digest[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint8(0) // version v1
+	b.AddBytes(parsed.logID)
+	b.AddUint64(parsed.timestamp)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {})
+	b.AddUint8(parsed.hashAlg)
+	b.AddUint8(parsed.sigAlg)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(parsed.signature) })
+	return b.BytesOrPanic()
+}
+
+// Writes a log list in the format of Chrome's log_list.json with the logs of two operators.
+// The first operator runs a usable and a retired log, the second a usable log.
+func writeTestLogList(t *testing.T, usable1, retired1, usable2 *testLog, retiredAt time.Time) string {
+	t.Helper()
+	content := fmt.Sprintf(`{"version": "3", "operators": [
+		{"name": "Operator One", "logs": [
+			{"description": "One usable", "log_id": %q, "key": %q, "state": {"usable": {"timestamp": "2023-01-01T00:00:00Z"}}},
+			{"description": "One retired", "log_id": %q, "key": %q, "state": {"retired": {"timestamp": %q}}},
+			{"description": "Broken key", "log_id": "AAAA", "key": "not base64", "state": {"usable": {"timestamp": "2023-01-01T00:00:00Z"}}}
+		]},
+		{"name": "Operator Two", "logs": [
+			{"description": "Two usable", "log_id": %q, "key": %q, "state": {"usable": {"timestamp": "2023-01-01T00:00:00Z"}}}
+		]}
+	]}`,
+		usable1.logID(), base64.StdEncoding.EncodeToString(usable1.der),
+		retired1.logID(), base64.StdEncoding.EncodeToString(retired1.der), retiredAt.Format(time.RFC3339),
+		usable2.logID(), base64.StdEncoding.EncodeToString(usable2.der))
+	path := filepath.Join(t.TempDir(), "log_list.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Creates a scanner verifying SCTs against the logs of the log list file
+func newCTTestScanner(t *testing.T, path string) *Scanner {
+	t.Helper()
+	list, err := loadCTLogList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestScanner(&Options{})
+	s.CTLogs = list
+	return s
+}
+
+func TestVerifySCT(t *testing.T) {
+	usable, retired, other := newTestLog(t), newTestLog(t), newTestLog(t)
+	retiredAt := time.Now().Add(-time.Hour)
+	s := newCTTestScanner(t, writeTestLogList(t, usable, retired, other, retiredAt))
+	if len(s.CTLogs.Logs) != 3 {
+		t.Fatalf("%d logs loaded, want 3 without the one with a broken key", len(s.CTLogs.Logs))
+	}
+
+	ca := newTestCA(t)
+	leaf := newTestLeaf(t, ca, nil, "example.com")
+	now := time.Now()
+
+	valid := usable.sign(t, now, sctSourceTLS, leaf.cert, ca.cert)
+	tampered := bytes.Clone(valid)
+	tampered[len(tampered)-20] ^= 0xff // a byte of the signature
+	laterTimestamp := bytes.Clone(valid)
+	laterTimestamp[33+7]++ // the last byte of the timestamp, which is covered by the signature
+
+	tests := []struct {
+		name  string
+		data  []byte
+		leaf  *x509.Certificate
+		error string
+	}{
+		{"valid", valid, leaf.cert, ""},
+		{"tampered signature", tampered, leaf.cert, "invalid signature"},
+		{"tampered timestamp", laterTimestamp, leaf.cert, "invalid signature"},
+		{"other certificate", valid, newTestLeaf(t, ca, nil, "other.example.com").cert, "invalid signature"},
+		{"unknown log", newTestLog(t).sign(t, now, sctSourceTLS, leaf.cert, ca.cert), leaf.cert, "unknown log"},
+		{"retired log before retirement", retired.sign(t, retiredAt.Add(-time.Hour), sctSourceTLS, leaf.cert, ca.cert), leaf.cert, ""},
+		{"retired log after retirement", retired.sign(t, now, sctSourceTLS, leaf.cert, ca.cert), leaf.cert, "log retired before SCT was issued"},
+		{"truncated", valid[:40], leaf.cert, "malformed SCT"},
+	}
+	for _, test := range tests {
+		info := s.verifySCT(test.data, sctSourceTLS, test.leaf, ca.cert)
+		if info.Error != test.error || info.Valid != (test.error == "") {
+			t.Errorf("%s: valid %t, error %q; want error %q", test.name, info.Valid, info.Error, test.error)
+		}
+	}
+
+	info := s.verifySCT(valid, sctSourceTLS, leaf.cert, ca.cert)
+	if info.Log != "One usable" || info.Operator != "Operator One" || !info.Timestamp.Equal(time.UnixMilli(now.UnixMilli())) {
+		t.Errorf("SCT info = %+v", info)
+	}
+}
+
+// Issues the same leaf certificate with and without the extra extensions.
+// Both certificates share key, serial number and validity, so their TBSCertificates differ in the extensions only.
+func issueLeafWithExtensions(t *testing.T, ca *testCert, key *ecdsa.PrivateKey, notBefore time.Time, extra []pkix.Extension) *x509.Certificate {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(42),
+		Subject:         pkix.Name{CommonName: "example.com"},
+		DNSNames:        []string{"example.com"},
+		NotBefore:       notBefore,
+		NotAfter:        notBefore.Add(90 * 24 * time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtraExtensions: extra,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// Encodes SCTs as the value of the embedded SCT list extension
+func sctListExtension(t *testing.T, scts ...[]byte) pkix.Extension {
+	t.Helper()
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, sct := range scts {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(sct) })
+		}
+	})
+	value, err := asn1.Marshal(b.BytesOrPanic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: oidEmbeddedSCT, Value: value}
+}
+
+func TestEmbeddedSCT(t *testing.T) {
+	first, retired, second := newTestLog(t), newTestLog(t), newTestLog(t)
+	s := newCTTestScanner(t, writeTestLogList(t, first, retired, second, time.Now()))
+
+	ca := newTestCA(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notBefore := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	// The logs sign the TBSCertificate of the precertificate with its poison extension removed,
+	// which is the one of the final certificate without the SCT list
+	precert := issueLeafWithExtensions(t, ca, key, notBefore, nil)
+	scts := [][]byte{
+		first.sign(t, notBefore, sctSourceEmbedded, precert, ca.cert),
+		second.sign(t, notBefore, sctSourceEmbedded, precert, ca.cert),
+	}
+	final := issueLeafWithExtensions(t, ca, key, notBefore, []pkix.Extension{sctListExtension(t, scts...)})
+
+	tbs, err := removeSCTExtension(final.RawTBSCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tbs, precert.RawTBSCertificate) {
+		t.Error("removing the SCT list does not yield the TBSCertificate of the precertificate")
+	}
+	if _, err := removeSCTExtension(final.RawTBSCertificate[:20]); err == nil {
+		t.Error("removing the SCT list of a truncated TBSCertificate succeeded")
+	}
+
+	result := s.checkCT(tls.ConnectionState{PeerCertificates: []*x509.Certificate{final, ca.cert}})
+	if result.Error != "" || len(result.SCTs) != 2 || result.ValidSCTs != 2 {
+		t.Fatalf("CT result = %+v", result)
+	}
+	for _, info := range result.SCTs {
+		if info.Source != sctSourceEmbedded {
+			t.Errorf("SCT source = %q, want embedded", info.Source)
+		}
+	}
+	if !result.PolicySatisfied || result.Operators != 2 {
+		t.Errorf("policy satisfied %t with %d operators, want true with 2", result.PolicySatisfied, result.Operators)
+	}
+
+	// Without the issuer the precertificate entry cannot be built
+	result = s.checkCT(tls.ConnectionState{PeerCertificates: []*x509.Certificate{final}})
+	if result.ValidSCTs != 0 {
+		t.Errorf("%d embedded SCTs valid without the issuer", result.ValidSCTs)
+	}
+}
+
+func TestParseSCTList(t *testing.T) {
+	scts, err := parseSCTList([]byte{0, 7, 0, 2, 'a', 'b', 0, 1, 'c'})
+	if err != nil || len(scts) != 2 || string(scts[0]) != "ab" || string(scts[1]) != "c" {
+		t.Errorf("parseSCTList = %q, %v", scts, err)
+	}
+	for _, data := range [][]byte{{0, 5, 0, 2, 'a'}, {0, 3, 0, 5, 'a'}, {0, 0, 'x'}} {
+		if _, err := parseSCTList(data); err == nil {
+			t.Errorf("parseSCTList(%v) succeeded", data)
+		}
+	}
+}
+
+func TestEvaluatePolicy(t *testing.T) {
+	one, oneRetired, two := newTestLog(t), newTestLog(t), newTestLog(t)
+	retiredAt := time.Now()
+	s := newCTTestScanner(t, writeTestLogList(t, one, oneRetired, two, retiredAt))
+
+	ca := newTestCA(t)
+	leaf := newTestLeaf(t, ca, nil, "example.com")
+	before := retiredAt.Add(-time.Hour)
+	sign := func(log *testLog, source string) []byte {
+		return log.sign(t, before, source, leaf.cert, ca.cert)
+	}
+
+	tests := []struct {
+		name      string
+		scts      map[string][][]byte // by source
+		valid     int
+		operators int
+		satisfied bool
+	}{
+		{"two operators over TLS", map[string][][]byte{sctSourceTLS: {sign(one, sctSourceTLS), sign(two, sctSourceTLS)}}, 2, 2, true},
+		{"TLS and OCSP", map[string][][]byte{sctSourceTLS: {sign(one, sctSourceTLS)}, sctSourceOCSP: {sign(two, sctSourceOCSP)}}, 2, 2, true},
+		{"one operator", map[string][][]byte{sctSourceTLS: {sign(one, sctSourceTLS), sign(oneRetired, sctSourceTLS)}}, 2, 1, false},
+		{"same log twice", map[string][][]byte{sctSourceTLS: {sign(one, sctSourceTLS), sign(one, sctSourceTLS)}}, 2, 1, false},
+		{"single SCT", map[string][][]byte{sctSourceTLS: {sign(two, sctSourceTLS)}}, 1, 1, false},
+		{"invalid SCT", map[string][][]byte{sctSourceTLS: {sign(one, sctSourceTLS), sign(newTestLog(t), sctSourceTLS)}}, 1, 1, false},
+	}
+	for _, test := range tests {
+		result := &CTResult{}
+		for source, scts := range test.scts {
+			for _, data := range scts {
+				result.SCTs = append(result.SCTs, s.verifySCT(data, source, leaf.cert, ca.cert))
+			}
+		}
+		result.evaluatePolicy(leaf.cert)
+		if result.ValidSCTs != test.valid || result.Operators != test.operators || result.PolicySatisfied != test.satisfied {
+			t.Errorf("%s: %d valid SCTs of %d operators, satisfied %t; want %d, %d, %t", test.name,
+				result.ValidSCTs, result.Operators, result.PolicySatisfied, test.valid, test.operators, test.satisfied)
+		}
+	}
+
+	// Embedded SCTs need a third log for certificates valid longer than 180 days
+	embedded := []SCTInfo{
+		{Source: sctSourceEmbedded, LogID: "a", Operator: "Operator One", Valid: true},
+		{Source: sctSourceEmbedded, LogID: "b", Operator: "Operator Two", Valid: true},
+	}
+	for _, lifetime := range []struct {
+		days      int
+		satisfied bool
+	}{{90, true}, {180, true}, {365, false}} {
+		cert := &x509.Certificate{NotBefore: retiredAt, NotAfter: retiredAt.Add(time.Duration(lifetime.days) * 24 * time.Hour)}
+		result := &CTResult{SCTs: embedded}
+		result.evaluatePolicy(cert)
+		if result.PolicySatisfied != lifetime.satisfied {
+			t.Errorf("two embedded SCTs for %d days: satisfied %t, want %t", lifetime.days, result.PolicySatisfied, lifetime.satisfied)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Opens the TCP connections of the scan.
+// The scanner dials resolved IP addresses through it, so a dialer only has to connect to host:port.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Creates the dialer of the scan from the -proxy and -sourceIP options.
+// Without a proxy, connections are opened directly, from the source address if one is given.
+// With a proxy, the source address is used for the connection to the proxy.
+func newDialer(proxyURL, sourceIP string) (Dialer, error) {
+	direct := &net.Dialer{}
+	if sourceIP != "" {
+		ip := net.ParseIP(sourceIP)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source IP %q", sourceIP)
+		}
+		direct.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if proxyURL == "" {
+		return direct, nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy %q has no host", proxyURL)
+	}
+
+	switch u.Scheme {
+	case "socks5":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		socks, err := proxy.SOCKS5("tcp", u.Host, auth, direct)
+		if err != nil {
+			return nil, err
+		}
+		dialer, ok := socks.(Dialer)
+		if !ok {
+			return nil, errors.New("SOCKS5 dialer does not support contexts")
+		}
+		return dialer, nil
+	case "http":
+		dialer := &httpConnectDialer{proxyAddress: u.Host, forward: direct}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			credentials := u.User.Username() + ":" + password
+			dialer.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+		}
+		return dialer, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %q, expected socks5 or http", u.Scheme)
+}
+
+// Tunnels connections through an HTTP proxy using the CONNECT method
+type httpConnectDialer struct {
+	proxyAddress  string
+	authorization string // value of the Proxy-Authorization header, empty without credentials
+	forward       Dialer // opens the connection to the proxy
+}
+
+// Connects to the proxy and asks it to open a tunnel to the address.
+// The context's deadline also bounds the CONNECT exchange.
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, d.proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.authorization != "" {
+		req.Header.Set("Proxy-Authorization", d.authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT %s: %v", address, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT %s: %v", address, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", address, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// A connection whose first bytes were already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Reads from the buffer before reading from the connection
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
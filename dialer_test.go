@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Starts a TCP server on a local port that echoes what it receives.
+// It returns the address of the server and a function returning the remote address of the last connection.
+func newEchoServer(t *testing.T) (string, func() string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var mutex sync.Mutex
+	var remote string
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			remote = conn.RemoteAddr().String()
+			mutex.Unlock()
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), func() string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return remote
+	}
+}
+
+// Sends a line over the connection and checks that it is echoed
+func checkEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("echo = %q, %v; want ping", line, err)
+	}
+}
+
+// Stands in for an HTTP proxy: CONNECT requests are tunnelled to the backend, whatever address they ask for
+type connectProxy struct {
+	backend       string
+	authorization string // required Proxy-Authorization header, empty for none
+	status        int    // status answered instead of opening the tunnel, 0 to open it
+
+	mutex     sync.Mutex
+	requested []string // addresses of the CONNECT requests
+	remotes   []string // addresses the requests came from
+}
+
+// Returns the addresses of the CONNECT requests and the addresses they came from
+func (p *connectProxy) requests() ([]string, []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string(nil), p.requested...), append([]string(nil), p.remotes...)
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	p.requested = append(p.requested, r.Host)
+	p.remotes = append(p.remotes, r.RemoteAddr)
+	p.mutex.Unlock()
+
+	switch {
+	case r.Method != http.MethodConnect:
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	case p.authorization != "" && r.Header.Get("Proxy-Authorization") != p.authorization:
+		w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	case p.status != 0:
+		w.WriteHeader(p.status)
+		return
+	}
+
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer backend.Close()
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	go io.Copy(backend, conn)
+	io.Copy(conn, backend)
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	backend, _ := newEchoServer(t)
+	tests := []struct {
+		name      string
+		userinfo  string
+		required  string // Proxy-Authorization the proxy expects
+		status    int
+		wantError string
+	}{
+		{"tunnel", "", "", 0, ""},
+		{"credentials", "user:secret@", "Basic dXNlcjpzZWNyZXQ=", 0, ""},
+		{"missing credentials", "", "Basic dXNlcjpzZWNyZXQ=", 0, "407 Proxy Authentication Required"},
+		{"wrong credentials", "user:wrong@", "Basic dXNlcjpzZWNyZXQ=", 0, "407 Proxy Authentication Required"},
+		{"refused", "", "", http.StatusForbidden, "403 Forbidden"},
+		{"bad gateway", "", "", http.StatusBadGateway, "502 Bad Gateway"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := &connectProxy{backend: backend, authorization: test.required, status: test.status}
+			proxy := httptest.NewServer(handler)
+			defer proxy.Close()
+
+			dialer, err := newDialer("http://"+test.userinfo+proxy.Listener.Addr().String(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			conn, err := dialer.DialContext(ctx, "tcp", "example.com:443")
+			if test.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantError) {
+					t.Fatalf("error = %v, want %q", err, test.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			checkEcho(t, conn)
+
+			// The host name is passed to the proxy as it is, so the proxy resolves it
+			if requested, _ := handler.requests(); len(requested) != 1 || requested[0] != "example.com:443" {
+				t.Errorf("CONNECT requests = %v, want example.com:443", requested)
+			}
+		})
+	}
+}
+
+// Stands in for a SOCKS5 proxy (RFC 1928, RFC 1929 for the credentials): connections are forwarded to the backend,
+// whatever address they ask for
+type socks5Proxy struct {
+	listener net.Listener
+	backend  string
+	user     string // required user name and password, empty for no authentication
+	password string
+	reply    byte // reply code of the CONNECT request, 0 to forward the connection
+
+	mutex     sync.Mutex
+	requested []string // addresses of the CONNECT requests, host names as they were sent
+}
+
+// Starts a SOCKS5 stand-in on a local port
+func newSOCKS5Proxy(t *testing.T, backend string) *socks5Proxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	p := &socks5Proxy{listener: listener, backend: backend}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	return p
+}
+
+// Returns the addresses of the CONNECT requests
+func (p *socks5Proxy) requests() []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]string(nil), p.requested...)
+}
+
+func (p *socks5Proxy) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	readBytes := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(reader, b); err != nil {
+			return nil
+		}
+		return b
+	}
+	// Reads a string prefixed by its length
+	readString := func() string {
+		length := readBytes(1)
+		if length == nil {
+			return ""
+		}
+		return string(readBytes(int(length[0])))
+	}
+
+	// Method selection
+	header := readBytes(2)
+	if header == nil || header[0] != 5 || readBytes(int(header[1])) == nil {
+		return
+	}
+	if p.user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		version := readBytes(1)
+		user, password := readString(), readString()
+		if version == nil || user != p.user || password != p.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	// CONNECT request
+	request := readBytes(4)
+	if request == nil || request[1] != 1 {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		host = net.IP(readBytes(4)).String()
+	case 3:
+		host = readString()
+	case 4:
+		host = net.IP(readBytes(16)).String()
+	}
+	port := readBytes(2)
+	if port == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.requested = append(p.requested, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	p.mutex.Unlock()
+
+	if p.reply != 0 {
+		conn.Write([]byte{5, p.reply, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer backend.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go io.Copy(backend, reader)
+	io.Copy(conn, backend)
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	backend, _ := newEchoServer(t)
+	tests := []struct {
+		name      string
+		userinfo  string
+		user      string // credentials the proxy expects
+		password  string
+		reply     byte
+		address   string
+		wantError string
+	}{
+		{"host name", "", "", "", 0, "example.com:443", ""},
+		{"IP address", "", "", "", 0, "192.0.2.1:8443", ""},
+		{"credentials", "user:secret@", "user", "secret", 0, "example.com:443", ""},
+		{"wrong credentials", "user:wrong@", "user", "secret", 0, "example.com:443", "authentication failed"},
+		{"host unreachable", "", "", "", 4, "example.com:443", "host unreachable"},
+		{"connection refused", "", "", "", 5, "example.com:443", "connection refused"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := newSOCKS5Proxy(t, backend)
+			proxy.user, proxy.password, proxy.reply = test.user, test.password, test.reply
+
+			dialer, err := newDialer("socks5://"+test.userinfo+proxy.listener.Addr().String(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			conn, err := dialer.DialContext(ctx, "tcp", test.address)
+			if test.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantError) {
+					t.Fatalf("error = %v, want %q", err, test.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			checkEcho(t, conn)
+
+			// Host names are sent as such, so the proxy resolves them
+			if requested := proxy.requests(); len(requested) != 1 || requested[0] != test.address {
+				t.Errorf("CONNECT requests = %v, want %s", requested, test.address)
+			}
+		})
+	}
+}
+
+func TestDialerSourceIP(t *testing.T) {
+	backend, remote := newEchoServer(t)
+
+	// Directly, the connection to the target is opened from the source address
+	dialer, err := newDialer("", "127.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+	if host, _, _ := net.SplitHostPort(remote()); host != "127.0.0.2" {
+		t.Errorf("connection from %s, want 127.0.0.2", remote())
+	}
+
+	// Through a proxy, the connection to the proxy is
+	handler := &connectProxy{backend: backend}
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+	dialer, err = newDialer("http://"+proxy.Listener.Addr().String(), "127.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = dialer.DialContext(context.Background(), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	conn.Close()
+	if _, remotes := handler.requests(); len(remotes) != 1 || !strings.HasPrefix(remotes[0], "127.0.0.2:") {
+		t.Errorf("connections to the proxy from %v, want 127.0.0.2", remotes)
+	}
+}
+
+func TestNewDialerErrors(t *testing.T) {
+	tests := []struct {
+		proxy, sourceIP, want string
+	}{
+		{"", "not an address", "invalid source IP"},
+		{"ftp://proxy.example:21", "", "unsupported proxy scheme"},
+		{"socks5://", "", "has no host"},
+	}
+	for _, test := range tests {
+		if _, err := newDialer(test.proxy, test.sourceIP); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("newDialer(%q, %q) = %v, want %q", test.proxy, test.sourceIP, err, test.want)
+		}
+	}
+}
+
+func TestProxyDNSDialsByName(t *testing.T) {
+	backend, _ := newEchoServer(t)
+	proxy := newSOCKS5Proxy(t, backend)
+
+	s := newTestScanner(&Options{Proxy: "socks5://" + proxy.listener.Addr().String(), ProxyDNS: true})
+	dialer, err := newDialer(s.opts.Proxy, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Dialer = dialer
+
+	target := Target{Domain: "unresolvable.invalid", Port: "8443"}
+	resolve := s.resolveDomain(context.Background(), target)
+	if resolve.Status != resolveProxy || len(resolve.Addresses) != 0 || resolve.Error != "" {
+		t.Fatalf("resolve = %+v, want status %s without addresses", resolve, resolveProxy)
+	}
+
+	conn, err := s.dial(context.Background(), "tcp", net.JoinHostPort(target.Domain, target.port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn)
+	if requested := proxy.requests(); len(requested) != 1 || requested[0] != "unresolvable.invalid:8443" {
+		t.Errorf("CONNECT requests = %v, want unresolvable.invalid:8443", requested)
+	}
+}
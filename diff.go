@@ -0,0 +1,581 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/TeoLj/TLSscanner_FP.git/schema"
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/components"
+	"github.com/go-echarts/go-echarts/v2/opts"
+)
+
+// The results of a domain in one scan, reduced to what the diff compares
+type domainSnapshot struct {
+	status      string // completed, failed or closed
+	ciphers     []string
+	versions    []string        // TLS versions of the supported cipher suites, e.g. "TLS 1.3"
+	certificate string          // SHA-256 fingerprint of the leaf certificate, empty if unknown
+	errors      map[string]bool // errors keyed by diffErrorKey
+}
+
+// The results of a scan loaded for the diff
+type scanSnapshot struct {
+	dir          *resultDir
+	source       string // file the results were read from
+	domains      map[string]*domainSnapshot
+	detailed     bool // read from the JSON results, which hold the negotiated versions and the certificates
+	certificates bool // the leaf certificates are known, from the JSON results or the database
+}
+
+// What changed for a single domain between two scans
+type domainDiff struct {
+	Domain          string
+	Change          string // added, removed or changed
+	OldStatus       string
+	NewStatus       string
+	AddedCiphers    []string
+	RemovedCiphers  []string
+	AddedVersions   []string
+	RemovedVersions []string
+	OldCertificate  string // set if the leaf certificate was rotated
+	NewCertificate  string
+	NewErrors       []string
+	ResolvedErrors  []string
+}
+
+// Header of the diff file
+var diffHeader = []string{"Domain", "Change", "OldStatus", "NewStatus", "AddedCiphers", "RemovedCiphers",
+	"AddedVersions", "RemovedVersions", "OldCertificate", "NewCertificate", "NewErrors", "ResolvedErrors"}
+
+// Runs the diff command: go run . diff [-out=DIR] [-db=FILE] OLD NEW
+// It compares the results of two scans domain by domain and reports added and removed cipher suites and TLS versions,
+// status changes, rotated certificates and new or resolved errors, on the console, in a CSV file and in an HTML page.
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	out := flags.String("out", "diff", "Directory to save the diff")
+	dbPath := flags.String("db", "", "SQLite database the scans were also written to with -db, to compare the certificates of scans without JSON results")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: go run . diff [-out=DIR] [-db=FILE] OLD NEW")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return
+	}
+
+	var store *resultStore
+	if *dbPath != "" {
+		if !fileExists(*dbPath) {
+			fmt.Printf("Error opening the database: %s does not exist\n", *dbPath)
+			return
+		}
+		var err error
+		if store, err = openResultStore(*dbPath); err != nil {
+			fmt.Println("Error opening the database:", err)
+			return
+		}
+		defer store.close()
+	}
+
+	var scans [2]*scanSnapshot
+	for i, path := range flags.Args() {
+		scan, err := loadScanSnapshot(path)
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", path, err)
+			return
+		}
+		if !scan.certificates && store != nil {
+			if err := scan.loadStoreCertificates(store); err != nil {
+				fmt.Printf("Error reading the certificates of %s from the database: %v\n", path, err)
+				return
+			}
+		}
+		fmt.Printf("\033[38;5;208m%s: %d domains from %s, scanned %s\033[0m\n",
+			scan.dir.path, len(scan.domains), filepath.Base(scan.source), scan.dir.modified.Format("2006-01-02 15:04:05"))
+		scans[i] = scan
+	}
+	for _, scan := range scans {
+		if !scan.detailed {
+			fmt.Printf("\033[38;5;208m%s has no JSON results, its TLS versions are derived from the cipher suites\033[0m\n", scan.dir.path)
+		}
+		if !scan.certificates {
+			fmt.Printf("\033[1;33mCertificates not compared: %s has no JSON results and no run in the database given with -db\033[0m\n", scan.dir.path)
+		}
+	}
+
+	diffs := diffScans(scans[0], scans[1])
+	printDiff(diffs)
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		fmt.Println("Error creating the output directory:", err)
+		return
+	}
+	if err := saveDiff(filepath.Join(*out, "diff.csv"), diffs); err != nil {
+		fmt.Println("Error writing the diff file:", err)
+		return
+	}
+	if err := renderDiff(filepath.Join(*out, "diff.html"), scans[0], scans[1], diffs); err != nil {
+		fmt.Println("Error writing the diff page:", err)
+		return
+	}
+	fmt.Printf("\033[38;5;208mDiff saved to %s\033[0m\n", *out)
+}
+
+// Loads the results of a scan from its output directory.
+// The JSON results are used if the scan wrote any, the cipher scan file and the error log otherwise.
+func loadScanSnapshot(path string) (*scanSnapshot, error) {
+	dir, err := loadResultDir(path)
+	if err != nil {
+		return nil, err
+	}
+	scan := &scanSnapshot{dir: dir, domains: make(map[string]*domainSnapshot)}
+
+	for _, format := range []string{jsonLines, jsonArray} {
+		filename := dir.file(jsonResultName(format))
+		if !fileExists(filename) {
+			continue
+		}
+		err := forEachJSONResult(filename, func(r *schema.Result) {
+			scan.domains[r.Domain] = jsonSnapshot(r)
+		})
+		if err != nil {
+			return nil, err
+		}
+		scan.source, scan.detailed, scan.certificates = filename, true, true
+		return scan, nil
+	}
+
+	// Domains without a row in the cipher scan file were aborted
+	for domain := range dir.done {
+		scan.domains[domain] = &domainSnapshot{status: schema.StatusFailed, errors: make(map[string]bool)}
+	}
+	scan.source = dir.file("cipherScan.csv")
+	err = readResultRows(scan.source, false, func(header, record []string) {
+		snapshot := &domainSnapshot{status: schema.StatusCompleted, errors: make(map[string]bool)}
+		if len(record) > 1 && record[1] != "" {
+			snapshot.ciphers = strings.Split(record[1], ";")
+		}
+		snapshot.versions = cipherVersions(snapshot.ciphers)
+		scan.domains[record[0]] = snapshot
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir.path, "errorLog.txt"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(completeLines(content)), "\n") {
+		domain, message, found := strings.Cut(line, ": ")
+		if snapshot, ok := scan.domains[domain]; ok && found {
+			message, cipher := splitErrorLogMessage(message)
+			snapshot.errors[diffErrorKey(message, cipher)] = true
+		}
+	}
+	return scan, nil
+}
+
+// Reads the leaf certificates of a scan from the most recent run of the database that wrote the scan's result files
+func (scan *scanSnapshot) loadStoreCertificates(st *resultStore) error {
+	runID, err := st.latestRunWriting(scan.dir.file("cipherScan.csv"), "cipherScan.csv")
+	if err != nil || runID == 0 {
+		return err
+	}
+
+	certificates, err := st.leafCertificates(runID)
+	if err != nil {
+		return err
+	}
+	for domain, sha256 := range certificates {
+		if snapshot, ok := scan.domains[domain]; ok {
+			snapshot.certificate = sha256
+		}
+	}
+	scan.certificates = true
+	return nil
+}
+
+// Reduces a JSON result to the compared values
+func jsonSnapshot(r *schema.Result) *domainSnapshot {
+	snapshot := &domainSnapshot{status: r.Status, ciphers: r.Ciphers, errors: make(map[string]bool)}
+	for version := range r.CiphersByVersion {
+		snapshot.versions = append(snapshot.versions, version)
+	}
+	sort.Strings(snapshot.versions)
+	if snapshot.versions == nil {
+		snapshot.versions = cipherVersions(r.Ciphers)
+	}
+	if len(r.Certificates) > 0 {
+		snapshot.certificate = r.Certificates[0].SHA256
+	}
+	for _, e := range r.Errors {
+		snapshot.errors[diffErrorKey(e.Message, e.Cipher)] = true
+	}
+	return snapshot
+}
+
+// Returns the key an error is compared by. The messages of the same error differ between scans,
+// as they name the dialed address, and a domain-wide error may be hit by any of the concurrent probes.
+// Errors are therefore compared by their category, per cipher suite only for the errors specific to a cipher suite.
+// Errors outside the categories keep their message, without the addresses.
+func diffErrorKey(message, cipher string) string {
+	category, domainWide := classifyError(message)
+	if category == message {
+		category = stripAddresses(message)
+	}
+	if domainWide || cipher == "" {
+		return category
+	}
+	return category + " for " + cipher
+}
+
+// Replaces the IP addresses with ports in an error message, e.g. "dial tcp 192.0.2.1:443: ...", by "address"
+func stripAddresses(message string) string {
+	fields := strings.Split(message, " ")
+	for i, field := range fields {
+		// Connection errors name both ends, "local->remote"
+		ends := strings.Split(field, "->")
+		for j, end := range ends {
+			trimmed := strings.TrimRight(end, ":,")
+			if host, _, err := net.SplitHostPort(trimmed); err == nil && net.ParseIP(host) != nil {
+				ends[j] = "address" + end[len(trimmed):]
+			}
+		}
+		fields[i] = strings.Join(ends, "->")
+	}
+	return strings.Join(fields, " ")
+}
+
+// Splits a message of the error log into the error and the cipher suite it was logged for, see errorLogMessage
+func splitErrorLogMessage(message string) (string, string) {
+	i := strings.LastIndex(message, " for ")
+	if i < 0 {
+		return message, ""
+	}
+	cipher := message[i+len(" for "):]
+	for _, suites := range [][]*tls.CipherSuite{tls.CipherSuites(), tls.InsecureCipherSuites()} {
+		for _, suite := range suites {
+			if suite.Name == cipher {
+				return message[:i], cipher
+			}
+		}
+	}
+	return message, ""
+}
+
+// Returns the TLS versions of the cipher suites, for results that do not record the negotiated versions.
+// The scanner only probes TLS 1.2 and TLS 1.3, and the TLS 1.3 cipher suites cannot be used with any other version.
+func cipherVersions(ciphers []string) []string {
+	found := make(map[string]bool)
+	for _, name := range ciphers {
+		for _, cipher := range tls.CipherSuites() {
+			if cipher.Name == name {
+				found[tls.VersionName(cipher.SupportedVersions[len(cipher.SupportedVersions)-1])] = true
+			}
+		}
+	}
+	var versions []string
+	for version := range found {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// Compares two scans, returning the domains that were added, removed or changed, sorted by domain
+func diffScans(old, new *scanSnapshot) []*domainDiff {
+	compareCertificates := old.certificates && new.certificates
+
+	var diffs []*domainDiff
+	for domain, n := range new.domains {
+		o, ok := old.domains[domain]
+		if !ok {
+			diffs = append(diffs, &domainDiff{Domain: domain, Change: "added", NewStatus: n.status})
+			continue
+		}
+		d := &domainDiff{
+			Domain:          domain,
+			Change:          "changed",
+			OldStatus:       o.status,
+			NewStatus:       n.status,
+			AddedCiphers:    difference(n.ciphers, o.ciphers),
+			RemovedCiphers:  difference(o.ciphers, n.ciphers),
+			AddedVersions:   difference(n.versions, o.versions),
+			RemovedVersions: difference(o.versions, n.versions),
+			NewErrors:       sortedDifference(n.errors, o.errors),
+			ResolvedErrors:  sortedDifference(o.errors, n.errors),
+		}
+		if compareCertificates && o.certificate != "" && n.certificate != "" && o.certificate != n.certificate {
+			d.OldCertificate, d.NewCertificate = o.certificate, n.certificate
+		}
+		if d.OldStatus != d.NewStatus || len(d.AddedCiphers) > 0 || len(d.RemovedCiphers) > 0 || len(d.AddedVersions) > 0 ||
+			len(d.RemovedVersions) > 0 || d.NewCertificate != "" || len(d.NewErrors) > 0 || len(d.ResolvedErrors) > 0 {
+			diffs = append(diffs, d)
+		}
+	}
+	for domain, o := range old.domains {
+		if _, ok := new.domains[domain]; !ok {
+			diffs = append(diffs, &domainDiff{Domain: domain, Change: "removed", OldStatus: o.status})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Domain < diffs[j].Domain })
+	return diffs
+}
+
+// Returns the values of a that are not in b, in the order of a
+func difference(a, b []string) []string {
+	var result []string
+	for _, value := range a {
+		found := false
+		for _, other := range b {
+			if value == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// Returns the keys of a that are not in b, sorted
+func sortedDifference(a, b map[string]bool) []string {
+	var result []string
+	for key := range a {
+		if !b[key] {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Prints the changes of every domain and a summary of the diff
+func printDiff(diffs []*domainDiff) {
+	counts := make(map[string]int)
+	for _, d := range diffs {
+		counts[d.Change]++
+		switch d.Change {
+		case "added":
+			fmt.Printf("\033[32m+ %s\033[0m (%s)\n", d.Domain, d.NewStatus)
+			continue
+		case "removed":
+			fmt.Printf("\033[31m- %s\033[0m (%s)\n", d.Domain, d.OldStatus)
+			continue
+		}
+
+		fmt.Printf("\033[1;33m~ %s\033[0m\n", d.Domain)
+		if d.OldStatus != d.NewStatus {
+			fmt.Printf("    status: %s -> %s\n", d.OldStatus, d.NewStatus)
+		}
+		for _, version := range d.AddedVersions {
+			fmt.Printf("    \033[32m+ %s\033[0m\n", version)
+		}
+		for _, version := range d.RemovedVersions {
+			fmt.Printf("    \033[31m- %s\033[0m\n", version)
+		}
+		for _, cipher := range d.AddedCiphers {
+			fmt.Printf("    \033[32m+ %s\033[0m\n", cipher)
+		}
+		for _, cipher := range d.RemovedCiphers {
+			fmt.Printf("    \033[31m- %s\033[0m\n", cipher)
+		}
+		if d.NewCertificate != "" {
+			fmt.Printf("    certificate rotated: %.16s... -> %.16s...\n", d.OldCertificate, d.NewCertificate)
+		}
+		for _, e := range d.NewErrors {
+			fmt.Printf("    \033[1;31mnew error: %s\033[0m\n", e)
+		}
+		for _, e := range d.ResolvedErrors {
+			fmt.Printf("    resolved error: %s\n", e)
+		}
+	}
+
+	fmt.Printf("\n\033[1;33mDiff summary:\033[0m %d added, %d removed, %d changed domains\n",
+		counts["added"], counts["removed"], counts["changed"])
+}
+
+// Saves the changes of every domain to a CSV file, lists separated by ";"
+func saveDiff(filename string, diffs []*domainDiff) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write(diffHeader)
+	for _, d := range diffs {
+		writer.Write([]string{
+			d.Domain,
+			d.Change,
+			d.OldStatus,
+			d.NewStatus,
+			strings.Join(d.AddedCiphers, ";"),
+			strings.Join(d.RemovedCiphers, ";"),
+			strings.Join(d.AddedVersions, ";"),
+			strings.Join(d.RemovedVersions, ";"),
+			d.OldCertificate,
+			d.NewCertificate,
+			strings.Join(d.NewErrors, ";"),
+			strings.Join(d.ResolvedErrors, ";"),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Renders the HTML diff page: cipher suite occurrences and TLS versions of both scans side by side,
+// and the number of domains per kind of change
+func renderDiff(filename string, old, new *scanSnapshot, diffs []*domainDiff) error {
+	page := components.NewPage()
+	page.PageTitle = "Scan Diff"
+	page.AddCharts(
+		plotDiffOccurrences("Cipher Suite Occurrences", "Completed domains per cipher suite in both scans", old, new,
+			func(s *domainSnapshot) []string { return s.ciphers }),
+		plotDiffOccurrences("TLS Versions", "Completed domains per TLS version in both scans", old, new,
+			func(s *domainSnapshot) []string { return s.versions }),
+		plotDiffChanges(diffs, old.certificates && new.certificates),
+	)
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return page.Render(f)
+}
+
+// Generates a bar chart counting the completed domains per value in the old and the new scan
+func plotDiffOccurrences(title, subtitle string, old, new *scanSnapshot, values func(s *domainSnapshot) []string) *charts.Bar {
+	count := func(scan *scanSnapshot) map[string]int {
+		counts := make(map[string]int)
+		for _, snapshot := range scan.domains {
+			if snapshot.status == schema.StatusCompleted {
+				for _, value := range values(snapshot) {
+					counts[value]++
+				}
+			}
+		}
+		return counts
+	}
+	oldCounts, newCounts := count(old), count(new)
+
+	var keys []string
+	for key := range oldCounts {
+		keys = append(keys, key)
+	}
+	for key := range newCounts {
+		if _, ok := oldCounts[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	oldValues := make([]opts.BarData, 0, len(keys))
+	newValues := make([]opts.BarData, 0, len(keys))
+	for _, key := range keys {
+		oldValues = append(oldValues, opts.BarData{Value: oldCounts[key]})
+		newValues = append(newValues, opts.BarData{Value: newCounts[key]})
+	}
+
+	bar := charts.NewBar()
+	bar.SetGlobalOptions(
+		charts.WithTitleOpts(opts.Title{Title: title, Subtitle: subtitle}),
+		charts.WithLegendOpts(opts.Legend{Show: true, Right: "10%"}),
+		charts.WithToolboxOpts(opts.Toolbox{
+			Show: true,
+			Feature: &opts.ToolBoxFeature{
+				SaveAsImage: &opts.ToolBoxFeatureSaveAsImage{Show: true, Title: "Save as Image", Name: title, Type: "png"},
+				DataView:    &opts.ToolBoxFeatureDataView{Show: true, Title: "Data View", Lang: []string{"Data View", "Close", "Refresh"}},
+			},
+		}),
+		charts.WithInitializationOpts(opts.Initialization{Width: "1100px", Height: "700px"}),
+		charts.WithXAxisOpts(opts.XAxis{
+			AxisLabel: &opts.AxisLabel{Show: true, Interval: "0", Rotate: 60},
+		}),
+		charts.WithGridOpts(opts.Grid{Bottom: "50%"}),
+		charts.WithTooltipOpts(opts.Tooltip{
+			Show:        true,
+			Trigger:     "axis",
+			AxisPointer: &opts.AxisPointer{Type: "shadow"},
+		}),
+	)
+	bar.SetXAxis(keys).
+		AddSeries("Old: "+filepath.Base(old.dir.path), oldValues, charts.WithItemStyleOpts(opts.ItemStyle{Color: "orange"})).
+		AddSeries("New: "+filepath.Base(new.dir.path), newValues, charts.WithItemStyleOpts(opts.ItemStyle{Color: "green"}))
+	return bar
+}
+
+// Generates a bar chart of the number of domains per kind of change.
+// Hovering a bar lists its first domains.
+func plotDiffChanges(diffs []*domainDiff, certificatesCompared bool) *charts.Bar {
+	const maxListed = 10
+
+	categories := []string{"Domains added", "Domains removed", "Status changed", "Ciphers added", "Ciphers removed",
+		"Versions added", "Versions removed", "Certificate rotated", "New errors", "Resolved errors"}
+	domains := make([][]string, len(categories))
+	for _, d := range diffs {
+		changed := []bool{
+			d.Change == "added",
+			d.Change == "removed",
+			d.Change == "changed" && d.OldStatus != d.NewStatus,
+			len(d.AddedCiphers) > 0,
+			len(d.RemovedCiphers) > 0,
+			len(d.AddedVersions) > 0,
+			len(d.RemovedVersions) > 0,
+			d.NewCertificate != "",
+			len(d.NewErrors) > 0,
+			len(d.ResolvedErrors) > 0,
+		}
+		for i, c := range changed {
+			if c {
+				domains[i] = append(domains[i], d.Domain)
+			}
+		}
+	}
+
+	subtitle := "Number of domains per kind of change, see diff.csv for the details"
+	if !certificatesCompared {
+		categories[7] = "Certificate rotated (not compared)"
+		subtitle += "\nCertificates were not compared: a scan has no JSON results and no run in the database given with -db"
+	}
+
+	values := make([]opts.BarData, 0, len(categories))
+	for _, list := range domains {
+		name := strings.Join(list, ", ")
+		if len(list) > maxListed {
+			name = strings.Join(list[:maxListed], ", ") + " and " + strconv.Itoa(len(list)-maxListed) + " more"
+		}
+		values = append(values, opts.BarData{Name: name, Value: len(list)})
+	}
+
+	bar := charts.NewBar()
+	bar.SetGlobalOptions(
+		charts.WithTitleOpts(opts.Title{
+			Title:    "Changes",
+			Subtitle: subtitle,
+		}),
+		charts.WithXAxisOpts(opts.XAxis{
+			AxisLabel: &opts.AxisLabel{Show: true, Interval: "0", Rotate: 30},
+		}),
+		charts.WithInitializationOpts(opts.Initialization{Width: "1100px", Height: "500px"}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "item"}),
+	)
+	bar.SetXAxis(categories).AddSeries("Domains", values)
+	return bar
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestDiffErrorKey(t *testing.T) {
+	tests := []struct {
+		message, cipher, want string
+	}{
+		// Domain-wide errors are keyed by their category, whichever probe and address hit them
+		{"dial tcp 192.0.2.1:443: i/o timeout", "TLS_AES_128_GCM_SHA256", errTimeout},
+		{"dial tcp [2001:db8::1]:443: connect: connection refused", "TLS_AES_256_GCM_SHA384", errConnectionRefused},
+		{"lookup example.com: no such host", "", errNoSuchHost},
+		{"tls: failed to verify certificate: x509: certificate has expired", "", errCertificate},
+		// Errors of a single cipher suite are keyed by the cipher suite as well
+		{"remote error: tls: handshake failure", "TLS_RSA_WITH_AES_128_GCM_SHA256", errHandshakeFailure + " for TLS_RSA_WITH_AES_128_GCM_SHA256"},
+		{"read tcp 192.0.2.1:51234->192.0.2.2:443: read: broken pipe", "TLS_RSA_WITH_AES_128_GCM_SHA256",
+			"read tcp address->address: read: broken pipe for TLS_RSA_WITH_AES_128_GCM_SHA256"},
+		{"EOF", "TLS_RSA_WITH_AES_128_GCM_SHA256", "EOF for TLS_RSA_WITH_AES_128_GCM_SHA256"},
+	}
+	for _, test := range tests {
+		if got := diffErrorKey(test.message, test.cipher); got != test.want {
+			t.Errorf("diffErrorKey(%q, %q) = %q, want %q", test.message, test.cipher, got, test.want)
+		}
+	}
+}
+
+func TestSplitErrorLogMessage(t *testing.T) {
+	tests := []struct {
+		line, message, cipher string
+	}{
+		{"remote error: tls: handshake failure for TLS_RSA_WITH_AES_128_GCM_SHA256", "remote error: tls: handshake failure", "TLS_RSA_WITH_AES_128_GCM_SHA256"},
+		{"lookup example.com: no such host", "lookup example.com: no such host", ""},
+		{"x509: certificate is valid for example.com, not www.example.com", "x509: certificate is valid for example.com, not www.example.com", ""},
+	}
+	for _, test := range tests {
+		message, cipher := splitErrorLogMessage(test.line)
+		if message != test.message || cipher != test.cipher {
+			t.Errorf("splitErrorLogMessage(%q) = %q, %q; want %q, %q", test.line, message, cipher, test.message, test.cipher)
+		}
+		// The error log and the JSON results give the same key
+		if diffErrorKey(message, cipher) != diffErrorKey(test.message, test.cipher) {
+			t.Errorf("keys of %q differ", test.line)
+		}
+	}
+}
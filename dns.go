@@ -0,0 +1,672 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS record types that dnsmessage has no constants for
+const (
+	dnsTypeTLSA dnsmessage.Type = 52
+	dnsTypeCAA  dnsmessage.Type = 257
+)
+
+// Transports the resolver can send queries over
+const (
+	dnsTransportUDP   = "udp"
+	dnsTransportTCP   = "tcp"
+	dnsTransportTLS   = "tls"
+	dnsTransportHTTPS = "https"
+)
+
+// Sends DNS queries to a configurable server over UDP, TCP, DNS-over-TLS or DNS-over-HTTPS
+type DNSResolver struct {
+	Server     string // host:port, or the query URL for DNS-over-HTTPS
+	Transport  string
+	Timeout    time.Duration
+	TLSConfig  *tls.Config  // used for DNS-over-TLS
+	HTTPClient *http.Client // used for DNS-over-HTTPS
+	Dialer     Dialer       // opens the TCP connections if set, such as the dialer of a proxy
+}
+
+// Creates a resolver from an address of the form [udp|tcp|tls]://host[:port] or https://host/path.
+// Without a scheme UDP is used, and an empty address selects the first nameserver of /etc/resolv.conf.
+func newDNSResolver(address string, timeout time.Duration) (*DNSResolver, error) {
+	resolver := &DNSResolver{
+		Transport:  dnsTransportUDP,
+		Timeout:    timeout,
+		HTTPClient: &http.Client{Timeout: timeout},
+	}
+
+	if address == "" {
+		address = systemNameserver()
+	}
+
+	if strings.HasPrefix(address, "https://") {
+		resolver.Transport = dnsTransportHTTPS
+		resolver.Server = address
+		return resolver, nil
+	}
+
+	if scheme, rest, found := strings.Cut(address, "://"); found {
+		switch scheme {
+		case dnsTransportUDP, dnsTransportTCP, dnsTransportTLS:
+			resolver.Transport = scheme
+			address = rest
+		default:
+			return nil, fmt.Errorf("unsupported resolver scheme %q", scheme)
+		}
+	}
+
+	port := "53"
+	if resolver.Transport == dnsTransportTLS {
+		port = "853"
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	resolver.Server = address
+
+	if resolver.Transport == dnsTransportTLS {
+		host, _, _ := net.SplitHostPort(address)
+		resolver.TLSConfig = &tls.Config{ServerName: host}
+	}
+	return resolver, nil
+}
+
+// Returns the first nameserver listed in /etc/resolv.conf, or the local host if there is none
+func systemNameserver() string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "127.0.0.1:53"
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+// Sends a query for the given name and type and returns the parsed response.
+// Truncated UDP responses are retried over TCP.
+func (r *DNSResolver) Query(name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Intn(1 << 16)),
+			RecursionDesired: true,
+			AuthenticData:    true, // ask the resolver to report DNSSEC validation (RFC 6840)
+		},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	if r.Transport == dnsTransportHTTPS {
+		query.ID = 0 // RFC 8484 recommends an ID of 0 for cache friendliness
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	switch r.Transport {
+	case dnsTransportUDP:
+		raw, err = r.exchangeUDP(packed)
+	case dnsTransportTCP, dnsTransportTLS:
+		raw, err = r.exchangeStream(packed)
+	case dnsTransportHTTPS:
+		raw, err = r.exchangeHTTPS(packed)
+	default:
+		err = fmt.Errorf("unsupported transport %q", r.Transport)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var response dnsmessage.Message
+	if err := response.Unpack(raw); err != nil {
+		return nil, err
+	}
+	if response.ID != query.ID {
+		return nil, errors.New("DNS response ID mismatch")
+	}
+	if response.Truncated && r.Transport == dnsTransportUDP {
+		tcp := *r
+		tcp.Transport = dnsTransportTCP
+		return tcp.Query(name, qtype)
+	}
+	return &response, nil
+}
+
+// Looks up the IPv4 and IPv6 addresses of a host.
+// Failures are reported as *net.DNSError like the system resolver does, so they are classified the same way:
+// NXDOMAIN and answers without addresses as "no such host", SERVFAIL as "server misbehaving".
+func (r *DNSResolver) LookupIP(host string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		response, err := r.Query(host, qtype)
+		if err != nil {
+			dnsErr := &net.DNSError{Err: err.Error(), Name: host, Server: r.Server}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				dnsErr.Err = "i/o timeout"
+				dnsErr.IsTimeout = true
+			}
+			return nil, dnsErr
+		}
+
+		switch response.RCode {
+		case dnsmessage.RCodeSuccess:
+		case dnsmessage.RCodeNameError:
+			return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.Server, IsNotFound: true}
+		case dnsmessage.RCodeServerFailure:
+			return nil, &net.DNSError{Err: "server misbehaving", Name: host, Server: r.Server, IsTemporary: true}
+		default:
+			return nil, &net.DNSError{Err: response.RCode.String(), Name: host, Server: r.Server}
+		}
+
+		for _, answer := range response.Answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				ips = append(ips, net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				ips = append(ips, net.IP(body.AAAA[:]))
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.Server, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// Sends a query in a single UDP datagram
+func (r *DNSResolver) exchangeUDP(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", r.Server, r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.Timeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// Sends a length-prefixed query over TCP or DNS-over-TLS
+func (r *DNSResolver) exchangeStream(query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	conn, err := r.dialer().DialContext(ctx, "tcp", r.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(r.Timeout))
+	if r.Transport == dnsTransportTLS {
+		tlsConn := tls.Client(conn, r.TLSConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Sends the queries through the dialer of a proxy.
+// UDP cannot be tunnelled through a SOCKS5 or HTTP CONNECT proxy, so UDP queries are sent over TCP instead.
+func (r *DNSResolver) useProxy(dialer Dialer) {
+	r.Dialer = dialer
+	r.HTTPClient.Transport = &http.Transport{DialContext: dialer.DialContext}
+	if r.Transport == dnsTransportUDP {
+		r.Transport = dnsTransportTCP
+	}
+}
+
+// Returns the dialer opening the TCP connections of the resolver
+func (r *DNSResolver) dialer() Dialer {
+	if r.Dialer != nil {
+		return r.Dialer
+	}
+	return &net.Dialer{}
+}
+
+// Posts a query to a DNS-over-HTTPS endpoint (RFC 8484)
+func (r *DNSResolver) exchangeHTTPS(query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, r.Server, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS: HTTP %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// Contains the CAA and DANE/TLSA information of a domain
+type DNSResult struct {
+	CAA       []string // CAA records in presentation format
+	CAADomain string   // domain at which the relevant CAA record set was found
+	Issuer    string   // organization of the certificate issuer
+	CAAStatus string   // "no CAA", "allowed", "not allowed" or "unknown issuer"
+
+	TLSA      []string // TLSA records in presentation format
+	TLSAMatch bool     // whether the presented chain matches a TLSA record
+	DNSSEC    bool     // whether the resolver validated the TLSA response
+
+	Error string
+}
+
+// A parsed CAA record (RFC 8659)
+type caaRecord struct {
+	flags uint8
+	tag   string
+	value string
+}
+
+// A parsed TLSA record (RFC 6698)
+type tlsaRecord struct {
+	usage        uint8
+	selector     uint8
+	matchingType uint8
+	data         []byte
+}
+
+// Known CAA identifiers and the issuer organizations the corresponding CAs use in their certificates.
+// Issuers that are not listed here cannot be checked against CAA and are reported as unknown.
+var caaIssuers = map[string][]string{
+	"letsencrypt.org":   {"Let's Encrypt"},
+	"pki.goog":          {"Google Trust Services"},
+	"digicert.com":      {"DigiCert"},
+	"sectigo.com":       {"Sectigo", "COMODO", "The USERTRUST Network"},
+	"comodoca.com":      {"Sectigo", "COMODO", "The USERTRUST Network"},
+	"usertrust.com":     {"The USERTRUST Network"},
+	"globalsign.com":    {"GlobalSign"},
+	"amazon.com":        {"Amazon"},
+	"amazontrust.com":   {"Amazon"},
+	"godaddy.com":       {"GoDaddy.com, Inc.", "Starfield Technologies, Inc."},
+	"starfieldtech.com": {"Starfield Technologies, Inc."},
+	"entrust.net":       {"Entrust, Inc."},
+	"ssl.com":           {"SSL Corporation", "SSL.com"},
+	"zerossl.com":       {"ZeroSSL"},
+	"buypass.com":       {"Buypass AS-983163327"},
+	"identrust.com":     {"IdenTrust"},
+	"certum.pl":         {"Asseco Data Systems S.A.", "Unizeto Technologies S.A."},
+	"microsoft.com":     {"Microsoft Corporation"},
+	"apple.com":         {"Apple Inc."},
+	"telekom.de":        {"T-Systems International GmbH", "Deutsche Telekom Security GmbH"},
+	"harica.gr":         {"Hellenic Academic and Research Institutions CA"},
+}
+
+// Looks up the CAA and TLSA records of a target and checks them against the certificate chain
+// of a successful handshake.
+func (s *Scanner) checkDNS(target Target, state tls.ConnectionState) *DNSResult {
+	result := &DNSResult{}
+	if len(state.PeerCertificates) == 0 {
+		result.Error = "no peer certificates"
+		return result
+	}
+	leaf := state.PeerCertificates[0]
+
+	records, caaDomain, err := s.lookupCAA(target.Domain)
+	if err != nil {
+		result.Error = "CAA: " + err.Error()
+	}
+	result.CAADomain = caaDomain
+	for _, record := range records {
+		result.CAA = append(result.CAA, fmt.Sprintf("%d %s %q", record.flags, record.tag, record.value))
+	}
+	if len(leaf.Issuer.Organization) > 0 {
+		result.Issuer = leaf.Issuer.Organization[0]
+	}
+	if err == nil {
+		result.CAAStatus = checkCAA(records, leaf)
+	}
+
+	tlsa, dnssec, err := s.lookupTLSA(target.Domain, target.port())
+	if err != nil {
+		if result.Error != "" {
+			result.Error += "; "
+		}
+		result.Error += "TLSA: " + err.Error()
+	}
+	result.DNSSEC = dnssec
+	for _, record := range tlsa {
+		result.TLSA = append(result.TLSA, fmt.Sprintf("%d %d %d %s",
+			record.usage, record.selector, record.matchingType, hex.EncodeToString(record.data)))
+		if matchTLSA(record, state.PeerCertificates) {
+			result.TLSAMatch = true
+		}
+	}
+
+	return result
+}
+
+// Finds the relevant CAA record set by climbing from the domain towards the root (RFC 8659, section 3).
+// It returns the records and the domain they were found at.
+func (s *Scanner) lookupCAA(domain string) ([]caaRecord, string, error) {
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	for i := 0; i < len(labels)-1; i++ { // top-level domains do not carry CAA records
+		name := strings.Join(labels[i:], ".")
+		response, err := s.Resolver.Query(name, dnsTypeCAA)
+		if err != nil {
+			return nil, "", err
+		}
+		if response.RCode != dnsmessage.RCodeSuccess && response.RCode != dnsmessage.RCodeNameError {
+			return nil, "", fmt.Errorf("%s: %s", name, response.RCode)
+		}
+
+		var records []caaRecord
+		for _, answer := range response.Answers {
+			if answer.Header.Type != dnsTypeCAA {
+				continue
+			}
+			unknown, ok := answer.Body.(*dnsmessage.UnknownResource)
+			if !ok {
+				continue
+			}
+			if record, err := parseCAA(unknown.Data); err == nil {
+				records = append(records, record)
+			}
+		}
+		if len(records) > 0 {
+			return records, name, nil
+		}
+	}
+	return nil, "", nil
+}
+
+// Parses the RDATA of a CAA record
+func parseCAA(data []byte) (caaRecord, error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return caaRecord{}, errors.New("malformed CAA record")
+	}
+	tagLength := int(data[1])
+	return caaRecord{
+		flags: data[0],
+		tag:   strings.ToLower(string(data[2 : 2+tagLength])),
+		value: string(data[2+tagLength:]),
+	}, nil
+}
+
+// Checks whether the certificate's issuer is authorized by the CAA record set.
+// Wildcard certificates are checked against "issuewild" records if present.
+// A record set without issue or issuewild records, such as only iodef, does not restrict issuance (RFC 8659 section 4.2).
+func checkCAA(records []caaRecord, leaf *x509.Certificate) string {
+	if len(records) == 0 {
+		return "no CAA"
+	}
+
+	wildcard := false
+	for _, name := range leaf.DNSNames {
+		if strings.HasPrefix(name, "*.") {
+			wildcard = true
+		}
+	}
+
+	tag := "issue"
+	if wildcard {
+		for _, record := range records {
+			if record.tag == "issuewild" {
+				tag = "issuewild"
+				break
+			}
+		}
+	}
+
+	issuerOrgs := leaf.Issuer.Organization
+	known, relevant := false, false
+	for _, record := range records {
+		if record.tag != tag {
+			continue
+		}
+		relevant = true
+		// The issuer domain name is followed by optional parameters separated by ";"
+		caDomain := strings.ToLower(strings.TrimSpace(strings.Split(record.value, ";")[0]))
+		if caDomain == "" {
+			continue // an empty issuer value forbids issuance
+		}
+		orgs, ok := caaIssuers[caDomain]
+		if !ok {
+			continue
+		}
+		known = true
+		for _, org := range orgs {
+			for _, issuerOrg := range issuerOrgs {
+				if strings.Contains(issuerOrg, org) {
+					return "allowed"
+				}
+			}
+		}
+	}
+
+	if !relevant {
+		return "allowed"
+	}
+	if !known && !issuerKnown(issuerOrgs) {
+		return "unknown issuer"
+	}
+	return "not allowed"
+}
+
+// Reports whether any of the issuer organizations belongs to a CA listed in caaIssuers
+func issuerKnown(issuerOrgs []string) bool {
+	for _, orgs := range caaIssuers {
+		for _, org := range orgs {
+			for _, issuerOrg := range issuerOrgs {
+				if strings.Contains(issuerOrg, org) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Looks up the TLSA records for TLS on the port of the domain (RFC 6698, section 3).
+// It also returns whether the resolver marked the response as DNSSEC validated.
+func (s *Scanner) lookupTLSA(domain, port string) ([]tlsaRecord, bool, error) {
+	response, err := s.Resolver.Query("_"+port+"._tcp."+domain, dnsTypeTLSA)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var records []tlsaRecord
+	for _, answer := range response.Answers {
+		if answer.Header.Type != dnsTypeTLSA {
+			continue
+		}
+		unknown, ok := answer.Body.(*dnsmessage.UnknownResource)
+		if !ok || len(unknown.Data) < 3 {
+			continue
+		}
+		records = append(records, tlsaRecord{
+			usage:        unknown.Data[0],
+			selector:     unknown.Data[1],
+			matchingType: unknown.Data[2],
+			data:         unknown.Data[3:],
+		})
+	}
+	return records, response.AuthenticData, nil
+}
+
+// Checks whether a TLSA record matches the presented certificate chain.
+// Usages 1 and 3 constrain the leaf certificate, usages 0 and 2 a CA certificate of the chain.
+func matchTLSA(record tlsaRecord, chain []*x509.Certificate) bool {
+	var candidates []*x509.Certificate
+	switch record.usage {
+	case 1, 3:
+		candidates = chain[:1]
+	case 0, 2:
+		candidates = chain[1:]
+	default:
+		return false
+	}
+
+	for _, cert := range candidates {
+		var selected []byte
+		switch record.selector {
+		case 0:
+			selected = cert.Raw
+		case 1:
+			selected = cert.RawSubjectPublicKeyInfo
+		default:
+			return false
+		}
+
+		var digest []byte
+		switch record.matchingType {
+		case 0:
+			digest = selected
+		case 1:
+			sum := sha256.Sum256(selected)
+			digest = sum[:]
+		case 2:
+			sum := sha512.Sum512(selected)
+			digest = sum[:]
+		default:
+			return false
+		}
+
+		if bytes.Equal(digest, record.data) {
+			return true
+		}
+	}
+	return false
+}
+
+// Header of the DNS result file
+var dnsHeader = []string{"Domain", "CAA", "CAADomain", "Issuer", "CAAStatus", "TLSA", "TLSAMatch", "DNSSEC", "Error"}
+
+// Converts the DNS result of a domain to a row of the DNS result file.
+// It returns nil if the domain has no DNS result.
+func dnsRecord(result *DomainResult) []string {
+	if result.DNS == nil {
+		return nil
+	}
+	d := result.DNS
+	return []string{
+		result.Domain,
+		strings.Join(d.CAA, ";"),
+		d.CAADomain,
+		d.Issuer,
+		d.CAAStatus,
+		strings.Join(d.TLSA, ";"),
+		fmt.Sprintf("%t", d.TLSAMatch),
+		fmt.Sprintf("%t", d.DNSSEC),
+		d.Error,
+	}
+}
+
+// Generates a bar chart summarizing the CAA and DANE/TLSA results from the rows of the DNS result file.
+func (a *Analyzer) plotDNSResults(records recordSource) *charts.Bar {
+	categories := []string{"CAA present", "CAA allows issuer", "CAA violation", "TLSA present", "TLSA match", "DNSSEC validated"}
+	counts := make([]int, len(categories))
+
+	err := records(func(row map[string]string) {
+		if row["CAA"] != "" {
+			counts[0]++
+		}
+		if row["CAAStatus"] == "allowed" {
+			counts[1]++
+		}
+		if row["CAAStatus"] == "not allowed" {
+			counts[2]++
+		}
+		if row["TLSA"] != "" {
+			counts[3]++
+		}
+		if row["TLSAMatch"] == "true" {
+			counts[4]++
+		}
+		if row["DNSSEC"] == "true" {
+			counts[5]++
+		}
+	})
+	if err != nil {
+		fmt.Println("Error reading DNS results:", err)
+	}
+
+	values := make([]opts.BarData, 0, len(counts))
+	for _, count := range counts {
+		values = append(values, opts.BarData{Value: count})
+	}
+
+	bar := charts.NewBar()
+	bar.SetGlobalOptions(
+		charts.WithTitleOpts(opts.Title{
+			Title:    "DNS: CAA and DANE/TLSA",
+			Subtitle: "Number of domains per check",
+		}),
+		charts.WithTooltipOpts(opts.Tooltip{
+			Show:        true,
+			Trigger:     "axis",
+			AxisPointer: &opts.AxisPointer{Type: "shadow"},
+		}),
+	)
+	bar.SetXAxis(categories).AddSeries("Domains", values)
+	return bar
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// A DNS server on a local UDP port answering from a fixed set of records
+type stubDNSServer struct {
+	conn    net.PacketConn
+	records map[string][][]byte // RDATA per "name type", names are fully qualified
+
+	mutex   sync.Mutex
+	queries []string // names asked for, in order
+}
+
+// Starts a stub server. The records are keyed by the fully qualified name and the type.
+func newStubDNSServer(t *testing.T, records map[string][][]byte) *stubDNSServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &stubDNSServer{conn: conn, records: records}
+	go server.serve()
+	t.Cleanup(func() { conn.Close() })
+	return server
+}
+
+// Returns the key of a record set in the records of the stub server
+func stubRecordKey(name string, qtype dnsmessage.Type) string {
+	return strings.ToLower(name) + " " + qtype.String()
+}
+
+func (s *stubDNSServer) serve() {
+	buffer := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buffer[:n]); err != nil || len(query.Questions) != 1 {
+			continue
+		}
+		question := query.Questions[0]
+		s.mutex.Lock()
+		s.queries = append(s.queries, question.Name.String())
+		s.mutex.Unlock()
+
+		response := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+			Questions: query.Questions,
+		}
+		for _, data := range s.records[stubRecordKey(question.Name.String(), question.Type)] {
+			response.Answers = append(response.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.UnknownResource{Type: question.Type, Data: data},
+			})
+		}
+		packed, err := response.Pack()
+		if err != nil {
+			continue
+		}
+		s.conn.WriteTo(packed, addr)
+	}
+}
+
+// Returns the names asked for so far
+func (s *stubDNSServer) asked() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// Creates a scanner that sends its DNS queries to the stub server
+func newDNSTestScanner(t *testing.T, server *stubDNSServer) *Scanner {
+	t.Helper()
+	resolver, err := newDNSResolver("udp://"+server.conn.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestScanner(&Options{DNSChecks: true})
+	s.Resolver = resolver
+	return s
+}
+
+// Encodes the RDATA of a CAA record
+func caaData(flags uint8, tag, value string) []byte {
+	return append([]byte{flags, byte(len(tag))}, tag+value...)
+}
+
+func TestLookupCAAClimbsToParent(t *testing.T) {
+	server := newStubDNSServer(t, map[string][][]byte{
+		stubRecordKey("example.com.", dnsTypeCAA): {
+			caaData(0, "issue", "letsencrypt.org"),
+			caaData(128, "IODEF", "mailto:security@example.com"),
+		},
+		stubRecordKey("com.", dnsTypeCAA): {caaData(0, "issue", "ca.example")},
+	})
+	s := newDNSTestScanner(t, server)
+
+	records, caaDomain, err := s.lookupCAA("a.b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caaDomain != "example.com" {
+		t.Errorf("CAA domain = %q, want example.com", caaDomain)
+	}
+	want := []caaRecord{{0, "issue", "letsencrypt.org"}, {128, "iodef", "mailto:security@example.com"}}
+	if len(records) != len(want) {
+		t.Fatalf("records = %v, want %v", records, want)
+	}
+	for i := range want {
+		if records[i] != want[i] {
+			t.Errorf("record %d = %v, want %v", i, records[i], want[i])
+		}
+	}
+	// The climb stops at the first record set and never reaches the top-level domain
+	if queries := strings.Join(server.asked(), " "); queries != "a.b.example.com. b.example.com. example.com." {
+		t.Errorf("queries = %s", queries)
+	}
+
+	records, caaDomain, err = s.lookupCAA("www.example.org")
+	if err != nil || len(records) != 0 || caaDomain != "" {
+		t.Errorf("lookupCAA without records = %v, %q, %v; want none", records, caaDomain, err)
+	}
+}
+
+func TestCheckCAA(t *testing.T) {
+	leaf := &x509.Certificate{DNSNames: []string{"*.example.com"}}
+	leaf.Issuer.Organization = []string{"Let's Encrypt"}
+
+	tests := []struct {
+		name    string
+		records []caaRecord
+		want    string
+	}{
+		{"no records", nil, "no CAA"},
+		{"allowed", []caaRecord{{0, "issue", "letsencrypt.org"}}, "allowed"},
+		{"parameters", []caaRecord{{0, "issue", "letsencrypt.org; validationmethods=dns-01"}}, "allowed"},
+		{"other CA", []caaRecord{{0, "issue", "digicert.com"}}, "not allowed"},
+		{"issuewild first", []caaRecord{{0, "issue", "letsencrypt.org"}, {0, "issuewild", "digicert.com"}}, "not allowed"},
+		{"empty issuer", []caaRecord{{0, "issue", ";"}}, "not allowed"},
+		{"iodef only", []caaRecord{{0, "iodef", "mailto:security@example.com"}}, "allowed"},
+		{"contactemail only", []caaRecord{{0, "contactemail", "security@example.com"}}, "allowed"},
+	}
+	for _, test := range tests {
+		if got := checkCAA(test.records, leaf); got != test.want {
+			t.Errorf("%s: checkCAA = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckDNSTLSA(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := newTestLeaf(t, ca, nil, "example.com")
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf.cert, ca.cert}}
+
+	leafSPKI := sha256.Sum256(leaf.cert.RawSubjectPublicKeyInfo)
+	server := newStubDNSServer(t, map[string][][]byte{
+		// Only the record of the scanned port matches, the one of 443 belongs to another key
+		stubRecordKey("_8443._tcp.example.com.", dnsTypeTLSA): {append([]byte{3, 1, 1}, leafSPKI[:]...)},
+		stubRecordKey("_443._tcp.example.com.", dnsTypeTLSA):  {append([]byte{3, 1, 1}, make([]byte, sha256.Size)...)},
+		stubRecordKey("_444._tcp.example.com.", dnsTypeTLSA):  {{3, 1}}, // too short to be a TLSA record
+	})
+	s := newDNSTestScanner(t, server)
+
+	tests := []struct {
+		port    string
+		records int
+		match   bool
+	}{
+		{"8443", 1, true},
+		{"", 1, false},
+		{"444", 0, false},
+	}
+	for _, test := range tests {
+		result := s.checkDNS(Target{Domain: "example.com", Port: test.port}, state)
+		if result.Error != "" {
+			t.Fatalf("port %q: %s", test.port, result.Error)
+		}
+		if len(result.TLSA) != test.records || result.TLSAMatch != test.match ||
+			(test.match && result.TLSA[0] != "3 1 1 "+hex.EncodeToString(leafSPKI[:])) {
+			t.Errorf("port %q: TLSA = %v, match %t; want %d records, match %t",
+				test.port, result.TLSA, result.TLSAMatch, test.records, test.match)
+		}
+	}
+}
+
+func TestMatchTLSA(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := newTestLeaf(t, ca, nil, "example.com")
+	chain := []*x509.Certificate{leaf.cert, ca.cert}
+
+	leafCert := sha256.Sum256(leaf.cert.Raw)
+	caSPKI := sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)
+	tests := []struct {
+		name   string
+		record tlsaRecord
+		want   bool
+	}{
+		{"DANE-EE full certificate", tlsaRecord{3, 0, 1, leafCert[:]}, true},
+		{"DANE-EE exact", tlsaRecord{3, 1, 0, leaf.cert.RawSubjectPublicKeyInfo}, true},
+		{"DANE-TA key", tlsaRecord{2, 1, 1, caSPKI[:]}, true},
+		{"DANE-TA with the leaf", tlsaRecord{2, 0, 1, leafCert[:]}, false},
+		{"unknown usage", tlsaRecord{4, 0, 1, leafCert[:]}, false},
+		{"unknown selector", tlsaRecord{3, 2, 1, leafCert[:]}, false},
+	}
+	for _, test := range tests {
+		if got := matchTLSA(test.record, chain); got != test.want {
+			t.Errorf("%s: matchTLSA = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
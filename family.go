@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Values of the -family option
+const (
+	familyAny  = "any"  // leave the address family to the order of the resolved addresses
+	familyV4   = "4"    // IPv4 only
+	familyV6   = "6"    // IPv6 only
+	familyBoth = "both" // probe IPv4 and IPv6 separately
+)
+
+// Address family names used in the results
+const (
+	familyIPv4 = "IPv4"
+	familyIPv6 = "IPv6"
+)
+
+// The addresses of a domain probed together.
+// Family is empty if the addresses are not restricted to an address family.
+type familyTarget struct {
+	Family string
+	IPs    []net.IP
+}
+
+// Contains whether TLS works over an address family and which ciphers are offered over it
+type FamilyResult struct {
+	Family    string
+	Addresses []net.IP
+	TLS       bool
+	Ciphers   []string
+	Error     string // domain-wide error, or the missing address
+}
+
+// Checks the value of the -family option
+func validFamily(family string) bool {
+	switch family {
+	case familyAny, familyV4, familyV6, familyBoth:
+		return true
+	}
+	return false
+}
+
+// Returns the addresses of the given family
+func filterFamily(ips []net.IP, family string) []net.IP {
+	var filtered []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (family == familyIPv4) {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// Splits the resolved addresses of a domain into the targets to probe according to -family.
+// It returns an error if the scan is restricted to a family the domain has no address of.
+func (s *Scanner) familyTargets(ips []net.IP) ([]familyTarget, error) {
+	switch s.opts.Family {
+	case familyBoth:
+		return []familyTarget{
+			{Family: familyIPv4, IPs: filterFamily(ips, familyIPv4)},
+			{Family: familyIPv6, IPs: filterFamily(ips, familyIPv6)},
+		}, nil
+	case familyV4, familyV6:
+		allowed, err := s.allowedAddresses(ips)
+		if err != nil {
+			return nil, err
+		}
+		return []familyTarget{{Family: s.familyName(), IPs: allowed}}, nil
+	}
+	return []familyTarget{{IPs: ips}}, nil
+}
+
+// Restricts addresses to the family of an IPv4-only or IPv6-only scan.
+// Otherwise all addresses are allowed.
+func (s *Scanner) allowedAddresses(ips []net.IP) ([]net.IP, error) {
+	if s.opts.Family != familyV4 && s.opts.Family != familyV6 {
+		return ips, nil
+	}
+	allowed := filterFamily(ips, s.familyName())
+	if len(allowed) == 0 {
+		return nil, errors.New("no " + s.familyName() + " address")
+	}
+	return allowed, nil
+}
+
+// Returns the name of the address family an IPv4-only or IPv6-only scan is restricted to
+func (s *Scanner) familyName() string {
+	if s.opts.Family == familyV6 {
+		return familyIPv6
+	}
+	return familyIPv4
+}
+
+// Summarizes the outcome of probing one address family
+func (o *probeOutcome) familyResult(target familyTarget) FamilyResult {
+	return FamilyResult{
+		Family:    target.Family,
+		Addresses: target.IPs,
+		TLS:       !o.aborted && len(o.ciphers) > 0,
+		Ciphers:   o.ciphers,
+		Error:     o.err,
+	}
+}
+
+// Header of the address family result file
+var familyHeader = []string{"Domain",
+	"IPv4Addresses", "IPv4TLS", "IPv4Ciphers", "IPv4Error",
+	"IPv6Addresses", "IPv6TLS", "IPv6Ciphers", "IPv6Error"}
+
+// Converts the per-family results of a domain to a row of the address family result file.
+// Families that were not probed are left empty. It returns nil if the domain was not probed.
+func familyRecord(result *DomainResult) []string {
+	if len(result.Families) == 0 {
+		return nil
+	}
+	row := []string{result.Domain, "", "", "", "", "", "", "", ""}
+	for _, family := range result.Families {
+		offset := 1
+		if family.Family == familyIPv6 {
+			offset = 5
+		}
+		addresses := make([]string, len(family.Addresses))
+		for i, ip := range family.Addresses {
+			addresses[i] = ip.String()
+		}
+		row[offset] = strings.Join(addresses, ";")
+		row[offset+1] = fmt.Sprintf("%t", family.TLS)
+		row[offset+2] = strings.Join(family.Ciphers, ";")
+		row[offset+3] = family.Error
+	}
+	return row
+}
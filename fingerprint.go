@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Contains the JA3S and JA4S fingerprints of a server's ServerHello
+type FingerprintResult struct {
+	JA3S       string // MD5 of JA3SString
+	JA3SString string // SSLVersion,Cipher,Extensions
+	JA4S       string
+	Version    uint16 // negotiated version, taken from supported_versions if present
+	Cipher     uint16
+	ALPN       string
+	// Whether the server answered with a HelloRetryRequest, asking for another key share, instead of a ServerHello.
+	// The fingerprints are then those of the HelloRetryRequest; as the probe is fixed, a server answers it alike every time.
+	HelloRetryRequest bool
+	Error             string
+}
+
+// The random of a HelloRetryRequest, which is a ServerHello with this fixed value (RFC 8446 section 4.1.3)
+var helloRetryRequestRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// The probe ClientHello is fixed so that fingerprints of different servers are comparable.
+// It offers TLS 1.3 and TLS 1.2 with the cipher suites below, and sends these extensions in order:
+// server_name, status_request, supported_groups (x25519, secp256r1, secp384r1), ec_point_formats (uncompressed),
+// signature_algorithms, ALPN (h2, http/1.1), signed_certificate_timestamp, extended_master_secret,
+// session_ticket, supported_versions (TLS 1.3, TLS 1.2), psk_key_exchange_modes (psk_dhe_ke),
+// key_share (x25519) and renegotiation_info.
+// Only the client random, session ID and key share vary between probes, none of which influence the ServerHello fields
+// the fingerprints are built from.
+var probeCipherSuites = []uint16{
+	0x1301, 0x1302, 0x1303, // TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384, TLS_CHACHA20_POLY1305_SHA256
+	0xc02b, 0xc02f, 0xc02c, 0xc030, // ECDHE-{ECDSA,RSA}-AES-GCM
+	0xcca9, 0xcca8, // ECDHE-{ECDSA,RSA}-CHACHA20-POLY1305
+	0xc009, 0xc013, 0xc00a, 0xc014, // ECDHE-{ECDSA,RSA}-AES-CBC-SHA
+	0x009c, 0x009d, 0x002f, 0x0035, // RSA-AES-GCM, RSA-AES-CBC-SHA
+}
+
+// Builds the probe ClientHello as a TLS record
+func probeClientHello(serverName string) ([]byte, error) {
+	random := make([]byte, 32)
+	sessionID := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(sessionID); err != nil {
+		return nil, err
+	}
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var hello cryptobyte.Builder
+	hello.AddUint16(0x0303) // legacy_version TLS 1.2
+	hello.AddBytes(random)
+	hello.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(sessionID) })
+	hello.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, suite := range probeCipherSuites {
+			b.AddUint16(suite)
+		}
+	})
+	hello.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) }) // null compression
+	hello.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		addExtension := func(extType uint16, body func(b *cryptobyte.Builder)) {
+			b.AddUint16(extType)
+			b.AddUint16LengthPrefixed(body)
+		}
+
+		if net.ParseIP(serverName) == nil { // SNI must not carry IP addresses
+			addExtension(0, func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0) // host_name
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(serverName)) })
+				})
+			})
+		}
+		addExtension(5, func(b *cryptobyte.Builder) { // status_request: OCSP without responder IDs or extensions
+			b.AddUint8(1)
+			b.AddUint16(0)
+			b.AddUint16(0)
+		})
+		addExtension(10, func(b *cryptobyte.Builder) { // supported_groups
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x001d)
+				b.AddUint16(0x0017)
+				b.AddUint16(0x0018)
+			})
+		})
+		addExtension(11, func(b *cryptobyte.Builder) { // ec_point_formats
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+		})
+		addExtension(13, func(b *cryptobyte.Builder) { // signature_algorithms
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, alg := range []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601, 0x0201} {
+					b.AddUint16(alg)
+				}
+			})
+		})
+		addExtension(16, func(b *cryptobyte.Builder) { // application_layer_protocol_negotiation
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, proto := range []string{"h2", "http/1.1"} {
+					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(proto)) })
+				}
+			})
+		})
+		addExtension(18, func(b *cryptobyte.Builder) {}) // signed_certificate_timestamp
+		addExtension(23, func(b *cryptobyte.Builder) {}) // extended_master_secret
+		addExtension(35, func(b *cryptobyte.Builder) {}) // session_ticket
+		addExtension(43, func(b *cryptobyte.Builder) {   // supported_versions
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x0304)
+				b.AddUint16(0x0303)
+			})
+		})
+		addExtension(45, func(b *cryptobyte.Builder) { // psk_key_exchange_modes
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(1) })
+		})
+		addExtension(51, func(b *cryptobyte.Builder) { // key_share
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(0x001d)
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(key.PublicKey().Bytes()) })
+			})
+		})
+		addExtension(0xff01, func(b *cryptobyte.Builder) { // renegotiation_info
+			b.AddUint8(0)
+		})
+	})
+
+	var record cryptobyte.Builder
+	record.AddUint8(22)      // handshake
+	record.AddUint16(0x0301) // record version TLS 1.0 for compatibility
+	record.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(1) // client_hello
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(hello.BytesOrPanic()) })
+	})
+	return record.Bytes()
+}
+
+// Sends the probe ClientHello to the target and computes the fingerprints from the ServerHello.
+func (s *Scanner) fingerprintServer(ctx context.Context, target Target) *FingerprintResult {
+	result := &FingerprintResult{}
+
+	hello, err := probeClientHello(target.Domain)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	conn, err := s.dial(ctx, "tcp", net.JoinHostPort(target.Domain, target.port()))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+
+	if _, err := conn.Write(hello); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	serverHello, err := readServerHello(conn)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if err := result.parseServerHello(serverHello); err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Reads handshake records from the connection until a complete ServerHello message is available.
+// It returns the body of the ServerHello message.
+func readServerHello(conn io.Reader) ([]byte, error) {
+	var handshake []byte
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, err
+		}
+		length := int(header[3])<<8 | int(header[4])
+		body := make([]byte, length)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return nil, err
+		}
+
+		switch header[0] {
+		case 21: // alert
+			if len(body) == 2 {
+				return nil, fmt.Errorf("server sent alert %d", body[1])
+			}
+			return nil, errors.New("server sent alert")
+		case 22: // handshake
+			handshake = append(handshake, body...)
+		default:
+			return nil, fmt.Errorf("unexpected record type %d", header[0])
+		}
+
+		if len(handshake) >= 4 {
+			if handshake[0] != 2 {
+				return nil, fmt.Errorf("unexpected handshake message %d", handshake[0])
+			}
+			messageLength := int(handshake[1])<<16 | int(handshake[2])<<8 | int(handshake[3])
+			if len(handshake) >= 4+messageLength {
+				return handshake[4 : 4+messageLength], nil
+			}
+		}
+	}
+}
+
+// Parses a ServerHello body and computes the JA3S and JA4S fingerprints.
+// A HelloRetryRequest is recognized by its random and flagged.
+func (r *FingerprintResult) parseServerHello(data []byte) error {
+	input := cryptobyte.String(data)
+	var legacyVersion, cipher uint16
+	var random []byte
+	var sessionID, extensionsData cryptobyte.String
+	var compression uint8
+	if !input.ReadUint16(&legacyVersion) ||
+		!input.ReadBytes(&random, 32) ||
+		!input.ReadUint8LengthPrefixed(&sessionID) ||
+		!input.ReadUint16(&cipher) ||
+		!input.ReadUint8(&compression) {
+		return errors.New("malformed ServerHello")
+	}
+	if !input.Empty() && !input.ReadUint16LengthPrefixed(&extensionsData) {
+		return errors.New("malformed ServerHello extensions")
+	}
+
+	r.Version = legacyVersion
+	r.Cipher = cipher
+	r.HelloRetryRequest = bytes.Equal(random, helloRetryRequestRandom)
+
+	var extensions []uint16
+	for !extensionsData.Empty() {
+		var extType uint16
+		var extData cryptobyte.String
+		if !extensionsData.ReadUint16(&extType) || !extensionsData.ReadUint16LengthPrefixed(&extData) {
+			return errors.New("malformed ServerHello extensions")
+		}
+		extensions = append(extensions, extType)
+
+		switch extType {
+		case 43: // supported_versions
+			var version uint16
+			if extData.ReadUint16(&version) {
+				r.Version = version
+			}
+		case 16: // application_layer_protocol_negotiation
+			var list, proto cryptobyte.String
+			if extData.ReadUint16LengthPrefixed(&list) && list.ReadUint8LengthPrefixed(&proto) {
+				r.ALPN = string(proto)
+			}
+		}
+	}
+
+	// JA3S: SSLVersion,Cipher,Extensions in decimal, extensions separated by "-"
+	extensionsDecimal := make([]string, 0, len(extensions))
+	for _, ext := range extensions {
+		extensionsDecimal = append(extensionsDecimal, strconv.Itoa(int(ext)))
+	}
+	r.JA3SString = fmt.Sprintf("%d,%d,%s", legacyVersion, cipher, strings.Join(extensionsDecimal, "-"))
+	ja3s := md5.Sum([]byte(r.JA3SString))
+	r.JA3S = hex.EncodeToString(ja3s[:])
+
+	// JA4S: protocol, version, extension count and ALPN, the cipher in hex,
+	// and the truncated SHA-256 of the extensions in the order the server sent them
+	alpn := "00"
+	if len(r.ALPN) > 0 {
+		alpn = string(r.ALPN[0]) + string(r.ALPN[len(r.ALPN)-1])
+	}
+	extensionsHex := make([]string, 0, len(extensions))
+	for _, ext := range extensions {
+		extensionsHex = append(extensionsHex, fmt.Sprintf("%04x", ext))
+	}
+	extensionsHash := sha256.Sum256([]byte(strings.Join(extensionsHex, ",")))
+	extensionCount := len(extensions)
+	if extensionCount > 99 {
+		extensionCount = 99
+	}
+	r.JA4S = fmt.Sprintf("t%s%02d%s_%04x_%s",
+		ja4Version(r.Version), extensionCount, alpn, cipher, hex.EncodeToString(extensionsHash[:])[:12])
+	return nil
+}
+
+// Returns the two-character JA4 notation of a TLS version
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	}
+	return "00"
+}
+
+// Header of the fingerprint result file
+var fingerprintHeader = []string{"Domain", "JA3S", "JA3SString", "JA4S", "ALPN", "HelloRetryRequest", "Error"}
+
+// Converts the fingerprint of a domain to a row of the fingerprint result file.
+// It returns nil if the domain was not fingerprinted.
+func fingerprintRecord(result *DomainResult) []string {
+	if result.Fingerprint == nil {
+		return nil
+	}
+	f := result.Fingerprint
+	return []string{result.Domain, f.JA3S, f.JA3SString, f.JA4S, f.ALPN, strconv.FormatBool(f.HelloRetryRequest), f.Error}
+}
+
+// A group of domains sharing the same server fingerprint
+type FingerprintCluster struct {
+	JA4S    string
+	JA3S    string
+	Domains []string
+}
+
+// Groups the domains in the rows of the fingerprint result file by their JA4S and JA3S fingerprint, largest clusters first.
+// Domains sharing a fingerprint most likely run the same TLS stack and configuration.
+func (a *Analyzer) clusterFingerprints(records recordSource) []FingerprintCluster {
+	clusters := make(map[string]*FingerprintCluster)
+	err := records(func(row map[string]string) {
+		if row["JA3S"] == "" {
+			return
+		}
+		key := row["JA4S"] + "|" + row["JA3S"]
+		if _, exists := clusters[key]; !exists {
+			clusters[key] = &FingerprintCluster{JA4S: row["JA4S"], JA3S: row["JA3S"]}
+		}
+		clusters[key].Domains = append(clusters[key].Domains, row["Domain"])
+	})
+	if err != nil {
+		fmt.Println("Error reading fingerprint results:", err)
+	}
+
+	sorted := make([]FingerprintCluster, 0, len(clusters))
+	for _, cluster := range clusters {
+		sort.Strings(cluster.Domains)
+		sorted = append(sorted, *cluster)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i].Domains) != len(sorted[j].Domains) {
+			return len(sorted[i].Domains) > len(sorted[j].Domains)
+		}
+		return sorted[i].JA4S < sorted[j].JA4S
+	})
+
+	fmt.Println("\n\033[1;33mServer fingerprint clusters:\033[0m")
+	for _, cluster := range sorted {
+		fmt.Printf("%s (JA3S %s): \033[1;34m%d\033[0m %s\n",
+			cluster.JA4S, cluster.JA3S, len(cluster.Domains), strings.Join(cluster.Domains, ", "))
+	}
+	return sorted
+}
+
+// Saves the fingerprint clusters to a CSV file.
+func (a *Analyzer) saveFingerprintClusters(filename string, clusters []FingerprintCluster) {
+
+	a.Mutex.Lock()
+	defer a.Mutex.Unlock()
+
+	file, err := os.Create(filename)
+	if err != nil {
+		fmt.Println("Error creating CSV file:", err)
+		return
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	defer writer.Flush()
+
+	writer.Write([]string{"JA4S", "JA3S", "Count", "Domains"})
+	for _, cluster := range clusters {
+		writer.Write([]string{cluster.JA4S, cluster.JA3S, fmt.Sprintf("%d", len(cluster.Domains)), strings.Join(cluster.Domains, ";")})
+	}
+}
+
+// Generates a bar chart of the largest fingerprint clusters.
+func (a *Analyzer) plotFingerprintClusters(clusters []FingerprintCluster) *charts.Bar {
+	const maxClusters = 20
+
+	keys := make([]string, 0, maxClusters)
+	values := make([]opts.BarData, 0, maxClusters)
+	for i, cluster := range clusters {
+		if i == maxClusters {
+			break
+		}
+		keys = append(keys, cluster.JA4S)
+		values = append(values, opts.BarData{
+			Name:  strings.Join(cluster.Domains, ", "),
+			Value: len(cluster.Domains),
+		})
+	}
+
+	bar := charts.NewBar()
+	bar.SetGlobalOptions(
+		charts.WithTitleOpts(opts.Title{
+			Title:    "Server Fingerprint Clusters",
+			Subtitle: "Domains per JA4S fingerprint (largest 20 clusters)",
+		}),
+		charts.WithXAxisOpts(opts.XAxis{
+			AxisLabel: &opts.AxisLabel{Show: true, Rotate: 60},
+		}),
+		charts.WithGridOpts(opts.Grid{Bottom: "40%"}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: true, Trigger: "item"}),
+	)
+	bar.SetXAxis(keys).AddSeries("Domains", values)
+	return bar
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Decodes a hex dump, ignoring white space
+func decodeHexDump(t *testing.T, dump string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(strings.Join(strings.Fields(dump), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// The ServerHello of the simple 1-RTT handshake of RFC 8448 section 3, without the handshake header.
+// Its JA4S is the example of the JA4S specification.
+const rfc8448ServerHello = `
+	03 03 a6 af 06 a4 12 18 60 dc 5e 6e 60 24 9c d3 4c 95 93 0c 8a c5 cb 14 34 da
+	c1 55 77 2e d3 e2 69 28 00 13 01 00 00 2e 00 33 00 24 00 1d 00 20 c9 82 88 76
+	11 20 95 fe 66 76 2b db f7 c6 72 e1 56 d6 cc 25 3b 83 3d f1 dd 69 b1 b0 4e 75
+	1f 0f 00 2b 00 02 03 04`
+
+// The ServerHello record of "The Illustrated TLS 1.2 Connection" (tls12.xargs.org)
+const illustratedTLS12ServerHello = `
+	16 03 03 00 31 02 00 00 2d 03 03 70 71 72 73 74 75 76 77 78 79 7a 7b 7c 7d 7e
+	7f 80 81 82 83 84 85 86 87 88 89 8a 8b 8c 8d 8e 8f 00 c0 13 00 00 05 ff 01 00
+	01 00`
+
+// Builds a HelloRetryRequest selecting secp256r1, as a server without x25519 answers the probe
+func testHelloRetryRequest() []byte {
+	var b cryptobyte.Builder
+	b.AddUint16(0x0303)
+	b.AddBytes(helloRetryRequestRandom)
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	b.AddUint16(0x1301)
+	b.AddUint8(0)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(43) // supported_versions
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint16(0x0304) })
+		b.AddUint16(51) // key_share with the selected group only
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint16(0x0017) })
+	})
+	return b.BytesOrPanic()
+}
+
+func TestParseServerHello(t *testing.T) {
+	tls12, err := readServerHello(bytes.NewReader(decodeHexDump(t, illustratedTLS12ServerHello)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		hello      []byte
+		ja3sString string
+		ja3s       string
+		ja4s       string
+		version    uint16
+		retry      bool
+	}{
+		{"RFC 8448 TLS 1.3", decodeHexDump(t, rfc8448ServerHello),
+			"771,4865,51-43", "eb1d94daa7e0344597e756a1fb6e7054", "t130200_1301_234ea6891581", 0x0304, false},
+		{"Illustrated TLS 1.2", tls12,
+			"771,49171,65281", "5a450169db1f168548fb87aa841fe743", "t120100_c013_bc98f8e001b5", 0x0303, false},
+		{"HelloRetryRequest", testHelloRetryRequest(),
+			"771,4865,43-51", "f4febc55ea12b31ae17cfb7e614afda8", "t130200_1301_a56c5b993250", 0x0304, true},
+	}
+	for _, test := range tests {
+		var result FingerprintResult
+		if err := result.parseServerHello(test.hello); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if result.JA3SString != test.ja3sString || result.JA3S != test.ja3s || result.JA4S != test.ja4s {
+			t.Errorf("%s: JA3S %s (%s), JA4S %s; want %s (%s), %s", test.name,
+				result.JA3SString, result.JA3S, result.JA4S, test.ja3sString, test.ja3s, test.ja4s)
+		}
+		if result.Version != test.version || result.HelloRetryRequest != test.retry {
+			t.Errorf("%s: version %#04x, HelloRetryRequest %t; want %#04x, %t", test.name,
+				result.Version, result.HelloRetryRequest, test.version, test.retry)
+		}
+	}
+
+	var result FingerprintResult
+	if err := result.parseServerHello(decodeHexDump(t, rfc8448ServerHello)[:40]); err == nil {
+		t.Error("parsing a truncated ServerHello succeeded")
+	}
+}
+
+func TestParseServerHelloALPN(t *testing.T) {
+	var b cryptobyte.Builder
+	b.AddUint16(0x0303)
+	b.AddBytes(make([]byte, 32))
+	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	b.AddUint16(0xc02f)
+	b.AddUint8(0)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(16) // application_layer_protocol_negotiation
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte("http/1.1")) })
+			})
+		})
+	})
+
+	var result FingerprintResult
+	if err := result.parseServerHello(b.BytesOrPanic()); err != nil {
+		t.Fatal(err)
+	}
+	if result.ALPN != "http/1.1" || !strings.HasPrefix(result.JA4S, "t1201h1_c02f_") {
+		t.Errorf("ALPN %q, JA4S %s; want http/1.1 and t1201h1_c02f_", result.ALPN, result.JA4S)
+	}
+}
+
+func TestReadServerHello(t *testing.T) {
+	record := decodeHexDump(t, illustratedTLS12ServerHello)
+	body := record[5:]
+
+	// The handshake message split over two records
+	var split []byte
+	split = append(split, 0x16, 0x03, 0x03, 0x00, 0x10)
+	split = append(split, body[:16]...)
+	split = append(split, 0x16, 0x03, 0x03, 0x00, byte(len(body)-16))
+	split = append(split, body[16:]...)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		error string
+	}{
+		{"single record", record, ""},
+		{"split", split, ""},
+		{"alert", []byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28}, "server sent alert 40"},
+		{"application data", []byte{0x17, 0x03, 0x03, 0x00, 0x01, 0x00}, "unexpected record type 23"},
+		{"certificate first", []byte{0x16, 0x03, 0x03, 0x00, 0x04, 0x0b, 0x00, 0x00, 0x00}, "unexpected handshake message 11"},
+		{"truncated", record[:20], "unexpected EOF"},
+	}
+	for _, test := range tests {
+		hello, err := readServerHello(bytes.NewReader(test.data))
+		if test.error != "" {
+			if err == nil || err.Error() != test.error {
+				t.Errorf("%s: error %v, want %s", test.name, err, test.error)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(hello, body[4:]) {
+			t.Errorf("%s: ServerHello %x, %v; want %x", test.name, hello, err, body[4:])
+		}
+	}
+}
@@ -1,5 +1,27 @@
 module github.com/TeoLj/TLSscanner_FP.git
 
-go 1.18
+go 1.22
 
-require github.com/go-echarts/go-echarts/v2 v2.3.3
+require (
+	github.com/go-echarts/go-echarts/v2 v2.3.3
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.23.0
+	modernc.org/sqlite v1.29.6
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/mattn/go-isatty v0.0.16 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	modernc.org/gc/v3 v3.0.0-20240107210532-573471604cb6 // indirect
+	modernc.org/libc v1.41.0 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.7.2 // indirect
+	modernc.org/strutil v1.2.0 // indirect
+	modernc.org/token v1.1.0 // indirect
+)
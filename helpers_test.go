@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// A certificate and its key, issued for the tests
+type testCert struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// Creates a self-signed CA
+func newTestCA(t *testing.T) *testCert {
+	t.Helper()
+	return issueTestCert(t, nil, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	})
+}
+
+// Issues a leaf certificate for the names from the CA. The template may set further fields.
+func newTestLeaf(t *testing.T, ca *testCert, template *x509.Certificate, names ...string) *testCert {
+	t.Helper()
+	if template == nil {
+		template = &x509.Certificate{}
+	}
+	template.Subject = pkix.Name{CommonName: names[0]}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	return issueTestCert(t, ca, template)
+}
+
+// Signs the template with the issuer, or self-signs it if the issuer is nil
+func issueTestCert(t *testing.T, issuer *testCert, template *x509.Certificate) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(24 * time.Hour)
+
+	parent, signer := template, crypto.Signer(key)
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+// Creates a scanner with the default options of the command line
+func newTestScanner(opts *Options) *Scanner {
+	if opts.Timeout == 0 {
+		opts.Timeout = 2 * time.Second
+	}
+	if opts.Family == "" {
+		opts.Family = familyAny
+	}
+	if opts.Attempts == 0 {
+		opts.Attempts = 1
+	}
+	if opts.IPv4Prefix == 0 {
+		opts.IPv4Prefix, opts.IPv6Prefix = 32, 64
+	}
+	return newScanner(nil, opts)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/opts"
+)
+
+// Contains the HTTP security layer information of a domain
+type HTTPResult struct {
+	StatusCode int
+
+	HSTS              bool
+	MaxAge            int64
+	IncludeSubDomains bool
+	Preload           bool
+
+	RedirectsToHTTPS bool   // whether plain HTTP on port 80 ends up on HTTPS
+	RedirectLocation string // final URL of the HTTP request
+	AltSvc           string
+
+	Error string
+}
+
+// Runs the HTTP phase for a target after its TLS handshakes.
+// It sends one HTTPS request to the scanned port to record HSTS and Alt-Svc, and one plain HTTP request
+// on port 80 to check the redirect to HTTPS.
+func (s *Scanner) checkHTTP(target Target) *HTTPResult {
+	result := &HTTPResult{}
+	if err := s.checkHSTS(rootURL("https", target.Domain, target.port(), "443"), result); err != nil {
+		result.Error = err.Error()
+	}
+	if err := s.checkHTTPRedirect(rootURL("http", target.Domain, "80", "80"), result); err != nil && result.Error == "" {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// Returns the URL of the root path of a host, leaving out the port if it is the default port of the scheme
+func rootURL(scheme, host, port, defaultPort string) string {
+	if port != defaultPort {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6 address
+	}
+	return scheme + "://" + host + "/"
+}
+
+// Requests the given HTTPS URL without following redirects
+// and records the Strict-Transport-Security and Alt-Svc headers of the response.
+func (s *Scanner) checkHSTS(url string, result *HTTPResult) error {
+	client := *s.HTTPClient
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse // HSTS is only honored on the response of the requested host
+	}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	result.AltSvc = resp.Header.Get("Alt-Svc")
+
+	if header := resp.Header.Get("Strict-Transport-Security"); header != "" {
+		parseHSTS(header, result)
+	}
+	return nil
+}
+
+// Requests the given plain HTTP URL, following redirects,
+// and records whether the final response was served over HTTPS.
+func (s *Scanner) checkHTTPRedirect(url string, result *HTTPResult) error {
+	resp, err := s.HTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	result.RedirectLocation = resp.Request.URL.String()
+	result.RedirectsToHTTPS = resp.Request.URL.Scheme == "https"
+	return nil
+}
+
+// Parses the directives of a Strict-Transport-Security header (RFC 6797).
+// A header without a valid max-age directive does not enable HSTS.
+func parseHSTS(header string, result *HTTPResult) {
+	for _, directive := range strings.Split(header, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "max-age":
+			maxAge, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(value), `"`), 10, 64)
+			if err == nil && maxAge >= 0 {
+				result.HSTS = maxAge > 0 // max-age=0 tells the browser to forget the host
+				result.MaxAge = maxAge
+			}
+		case "includesubdomains":
+			result.IncludeSubDomains = true
+		case "preload":
+			result.Preload = true
+		}
+	}
+}
+
+// Header of the HTTP security result file
+var httpHeader = []string{"Domain", "StatusCode", "HSTS", "MaxAge", "IncludeSubDomains", "Preload",
+	"RedirectsToHTTPS", "RedirectLocation", "AltSvc", "Error"}
+
+// Converts the HTTP security result of a domain to a row of the HTTP result file.
+// It returns nil if the domain has no HTTP result.
+func httpRecord(result *DomainResult) []string {
+	if result.HTTP == nil {
+		return nil
+	}
+	h := result.HTTP
+	return []string{
+		result.Domain,
+		fmt.Sprintf("%d", h.StatusCode),
+		fmt.Sprintf("%t", h.HSTS),
+		fmt.Sprintf("%d", h.MaxAge),
+		fmt.Sprintf("%t", h.IncludeSubDomains),
+		fmt.Sprintf("%t", h.Preload),
+		fmt.Sprintf("%t", h.RedirectsToHTTPS),
+		h.RedirectLocation,
+		h.AltSvc,
+		h.Error,
+	}
+}
+
+// Generates a pie chart of the HSTS adoption from the rows of the HTTP result file.
+// Each domain falls into exactly one category, from no HSTS up to a preload-ready policy.
+func (a *Analyzer) plotHSTSAdoption(records recordSource) *charts.Pie {
+	counts := map[string]int{}
+	categories := []string{"No HSTS", "HSTS", "HSTS + includeSubDomains", "HSTS preload"}
+
+	err := records(func(row map[string]string) {
+		switch {
+		case row["HSTS"] != "true":
+			counts["No HSTS"]++
+		case row["Preload"] == "true" && row["IncludeSubDomains"] == "true":
+			counts["HSTS preload"]++
+		case row["IncludeSubDomains"] == "true":
+			counts["HSTS + includeSubDomains"]++
+		default:
+			counts["HSTS"]++
+		}
+	})
+	if err != nil {
+		fmt.Println("Error reading HTTP results:", err)
+	}
+
+	var data []opts.PieData
+	for _, category := range categories {
+		data = append(data, opts.PieData{Name: fmt.Sprintf("%s: %d", category, counts[category]), Value: counts[category]})
+	}
+
+	pie := charts.NewPie()
+	pie.AddSeries("HSTS Adoption", data).
+		SetGlobalOptions(
+			charts.WithTitleOpts(opts.Title{Title: "HSTS Adoption"}),
+			charts.WithLegendOpts(opts.Legend{
+				Show:   true,
+				Left:   "left",
+				Orient: "horizontal",
+				Top:    "10%",
+			}),
+		).
+		SetSeriesOptions(
+			charts.WithPieChartOpts(opts.PieChart{
+				Radius: 140,
+				Center: []string{"50%", "60%"},
+			}),
+		)
+	return pie
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestParseHSTS(t *testing.T) {
+	tests := []struct {
+		header            string
+		hsts              bool
+		maxAge            int64
+		includeSubDomains bool
+		preload           bool
+	}{
+		{"max-age=31536000", true, 31536000, false, false},
+		{"max-age=31536000; includeSubDomains", true, 31536000, true, false},
+		{"max-age=63072000; includeSubDomains; preload", true, 63072000, true, true},
+		{`MAX-AGE="600" ; IncludeSubDomains`, true, 600, true, false},
+		{"max-age=0", false, 0, false, false},
+		{"max-age=-1", false, 0, false, false},
+		{"max-age=abc; preload", false, 0, false, true},
+		{"max-age=", false, 0, false, false},
+		{"includeSubDomains", false, 0, true, false},
+		{"", false, 0, false, false},
+	}
+	for _, test := range tests {
+		var result HTTPResult
+		parseHSTS(test.header, &result)
+		if result.HSTS != test.hsts || result.MaxAge != test.maxAge ||
+			result.IncludeSubDomains != test.includeSubDomains || result.Preload != test.preload {
+			t.Errorf("parseHSTS(%q) = HSTS %t, max-age %d, includeSubDomains %t, preload %t; want %t, %d, %t, %t",
+				test.header, result.HSTS, result.MaxAge, result.IncludeSubDomains, result.Preload,
+				test.hsts, test.maxAge, test.includeSubDomains, test.preload)
+		}
+	}
+}
+
+func TestRootURL(t *testing.T) {
+	tests := []struct {
+		scheme, host, port, defaultPort, want string
+	}{
+		{"https", "example.com", "443", "443", "https://example.com/"},
+		{"https", "example.com", "8443", "443", "https://example.com:8443/"},
+		{"https", "::1", "443", "443", "https://[::1]/"},
+		{"https", "::1", "8443", "443", "https://[::1]:8443/"},
+		{"http", "192.0.2.1", "80", "80", "http://192.0.2.1/"},
+	}
+	for _, test := range tests {
+		if got := rootURL(test.scheme, test.host, test.port, test.defaultPort); got != test.want {
+			t.Errorf("rootURL(%q, %q, %q, %q) = %q, want %q", test.scheme, test.host, test.port, test.defaultPort, got, test.want)
+		}
+	}
+}
+
+// Creates a scanner whose HTTP client trusts the certificate of the test server
+func newHTTPTestScanner(server *httptest.Server) *Scanner {
+	s := newTestScanner(&Options{HTTPChecks: true})
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	s.HTTPClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: roots}
+	return s
+}
+
+func TestCheckHTTPUsesTargetPort(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains; preload")
+		w.Header().Set("Alt-Svc", `h3=":443"`)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newHTTPTestScanner(server)
+	result := s.checkHTTP(Target{Domain: host, Port: port})
+
+	if result.StatusCode != http.StatusNoContent {
+		t.Fatalf("StatusCode = %d, want %d (error %q)", result.StatusCode, http.StatusNoContent, result.Error)
+	}
+	if !result.HSTS || result.MaxAge != 31536000 || !result.IncludeSubDomains || !result.Preload {
+		t.Errorf("HSTS = %t, max-age %d, includeSubDomains %t, preload %t", result.HSTS, result.MaxAge, result.IncludeSubDomains, result.Preload)
+	}
+	if result.AltSvc != `h3=":443"` {
+		t.Errorf("AltSvc = %q", result.AltSvc)
+	}
+}
+
+func TestCheckHSTSDoesNotFollowRedirects(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, "/www", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Strict-Transport-Security", "max-age=600")
+	}))
+	defer server.Close()
+
+	var result HTTPResult
+	if err := newHTTPTestScanner(server).checkHSTS(server.URL+"/", &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != http.StatusMovedPermanently || result.HSTS {
+		t.Errorf("StatusCode = %d, HSTS = %t; want %d, false", result.StatusCode, result.HSTS, http.StatusMovedPermanently)
+	}
+}
+
+func TestCheckHTTPRedirect(t *testing.T) {
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer secure.Close()
+
+	tests := []struct {
+		name     string
+		redirect string // empty to answer over plain HTTP
+		want     bool
+	}{
+		{"to HTTPS", secure.URL + "/", true},
+		{"plain HTTP", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.redirect != "" {
+					http.Redirect(w, r, test.redirect, http.StatusMovedPermanently)
+				}
+			}))
+			defer plain.Close()
+
+			var result HTTPResult
+			if err := newHTTPTestScanner(secure).checkHTTPRedirect(plain.URL+"/", &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.RedirectsToHTTPS != test.want {
+				t.Errorf("RedirectsToHTTPS = %t, want %t", result.RedirectsToHTTPS, test.want)
+			}
+			location, err := url.Parse(result.RedirectLocation)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantScheme := map[bool]string{true: "https", false: "http"}[test.want]; location.Scheme != wantScheme {
+				t.Errorf("RedirectLocation = %q, want scheme %s", result.RedirectLocation, wantScheme)
+			}
+		})
+	}
+}
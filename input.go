@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A domain to scan together with the input columns read for it
+type Target struct {
+	Domain string
+	Rank   int      // 0 if the input has no rank
+	Port   string   // empty for the default HTTPS port
+	IP     net.IP   // address to connect to instead of resolving the domain, nil to resolve
+	Extra  []string // input columns kept in the output files, see csvLayout.extraNames
+
+	Range *ipRange // the IP range of the input this address was expanded from, nil for listed targets, see expandRanges
+}
+
+// Returns the name of the target in the results, the error log and the checkpoint file.
+// Targets on a port other than 443 are named host:port.
+func (t Target) Label() string {
+	if t.Port == "" || t.Port == "443" {
+		return t.Domain
+	}
+	return net.JoinHostPort(t.Domain, t.Port)
+}
+
+// Returns the port to connect to, 443 by default as it is the default port for HTTPS
+func (t Target) port() string {
+	if t.Port == "" {
+		return "443"
+	}
+	return t.Port
+}
+
+// Column names recognized in a header line
+var (
+	domainColumnNames = []string{"domain", "domains", "host", "hostname", "url", "site", "name"}
+	rankColumnNames   = []string{"rank", "position", "number", "#"}
+	portColumnNames   = []string{"port"}
+	ipColumnNames     = []string{"ip", "address", "addr"}
+)
+
+// Describes where the fields of a CSV input file are.
+// Column indexes are 0-based and -1 if the input has no such column.
+type csvLayout struct {
+	comment   rune
+	hasHeader bool
+	domain    int
+	rank      int
+	port      int
+	ip        int
+
+	extra      []int    // columns kept in the output files: all columns but the domain
+	extraNames []string // names of the kept columns, from the header if there is one
+}
+
+// Determines the layout of a CSV input file from its first line and the column options.
+// Columns are given by header name or by 1-based index. A header line is detected by known column names.
+// Without options, the layout of top-1m.csv is assumed: rank,domain, or only the domain if there is one column.
+func detectCSVLayout(filePath string, opts *Options) (*csvLayout, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	layout := &csvLayout{}
+	if opts.Comment != "" {
+		layout.comment, _ = utf8.DecodeRuneInString(opts.Comment)
+	}
+
+	first, err := newCSVReader(file, layout.comment).Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%s is empty", filePath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	layout.hasHeader = isHeader(first, opts)
+	var header []string
+	if layout.hasHeader {
+		header = first
+	}
+
+	// Defaults when the columns are neither configured nor named in a header
+	defaultDomain, defaultRank := 0, -1
+	if len(first) >= 2 {
+		defaultDomain, defaultRank = 1, 0
+	}
+	if layout.hasHeader {
+		defaultDomain = findColumn(header, domainColumnNames, defaultDomain)
+		defaultRank = findColumn(header, rankColumnNames, -1)
+	}
+
+	if layout.domain, err = columnIndex(opts.DomainColumn, header, defaultDomain); err != nil {
+		return nil, err
+	}
+	if layout.rank, err = columnIndex(opts.RankColumn, header, defaultRank); err != nil {
+		return nil, err
+	}
+	if layout.port, err = columnIndex(opts.PortColumn, header, findColumn(header, portColumnNames, -1)); err != nil {
+		return nil, err
+	}
+	if layout.ip, err = columnIndex(opts.IPColumn, header, findColumn(header, ipColumnNames, -1)); err != nil {
+		return nil, err
+	}
+
+	for i := range first {
+		if i == layout.domain {
+			continue
+		}
+		layout.extra = append(layout.extra, i)
+		switch {
+		case layout.hasHeader && strings.TrimSpace(header[i]) != "":
+			layout.extraNames = append(layout.extraNames, strings.TrimSpace(header[i]))
+		case i == layout.rank:
+			layout.extraNames = append(layout.extraNames, "rank")
+		case i == layout.port:
+			layout.extraNames = append(layout.extraNames, "port")
+		case i == layout.ip:
+			layout.extraNames = append(layout.extraNames, "ip")
+		default:
+			layout.extraNames = append(layout.extraNames, fmt.Sprintf("column%d", i+1))
+		}
+	}
+	return layout, nil
+}
+
+// Creates a CSV reader that skips a UTF-8 byte order mark and comment lines,
+// tolerates stray quotes and allows lines with differing numbers of fields.
+func newCSVReader(r io.Reader, comment rune) *csv.Reader {
+	buffered := bufio.NewReader(r)
+	if bom, err := buffered.Peek(3); err == nil && bytes.Equal(bom, []byte("\xef\xbb\xbf")) {
+		buffered.Discard(3)
+	}
+
+	reader := csv.NewReader(buffered)
+	reader.Comment = comment
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.TrimLeadingSpace = true
+	return reader
+}
+
+// Reports whether the first line of the input is a header.
+// It is if one of its fields is a known column name or a column name given on the command line.
+func isHeader(record []string, opts *Options) bool {
+	names := append(append(append(append([]string{}, domainColumnNames...), rankColumnNames...), portColumnNames...), ipColumnNames...)
+	for _, spec := range []string{opts.DomainColumn, opts.RankColumn, opts.PortColumn, opts.IPColumn} {
+		if _, err := strconv.Atoi(spec); spec != "" && err != nil {
+			names = append(names, spec)
+		}
+	}
+	return findColumn(record, names, -1) >= 0
+}
+
+// Returns the index of the first header field matching one of the names, ignoring case,
+// or the fallback if none matches
+func findColumn(header []string, names []string, fallback int) int {
+	for i, field := range header {
+		field = strings.TrimSpace(field)
+		for _, name := range names {
+			if strings.EqualFold(field, name) {
+				return i
+			}
+		}
+	}
+	return fallback
+}
+
+// Converts a column option, a header name or a 1-based index, to a 0-based index.
+// An empty option selects the fallback.
+func columnIndex(spec string, header []string, fallback int) (int, error) {
+	if spec == "" {
+		return fallback, nil
+	}
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 1 {
+			return 0, fmt.Errorf("invalid column %d, columns are numbered from 1", n)
+		}
+		return n - 1, nil
+	}
+	if header == nil {
+		return 0, fmt.Errorf("column %q is given by name but the input has no header line", spec)
+	}
+	if i := findColumn(header, []string{spec}, -1); i >= 0 {
+		return i, nil
+	}
+	return 0, fmt.Errorf("column %q not found in the header line", spec)
+}
+
+// Converts a CSV record to a target according to the layout.
+// It returns false if the record holds no domain or an invalid IP address.
+func (l *csvLayout) target(record []string) (Target, bool) {
+	field := func(i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	// The domain and the port are checked by normalizeTarget, which reports invalid ones in the rejects file
+	target := Target{Domain: field(l.domain), Port: field(l.port)}
+	if target.Domain == "" {
+		return target, false
+	}
+	target.Rank, _ = strconv.Atoi(field(l.rank))
+
+	if ip := field(l.ip); ip != "" {
+		if target.IP = net.ParseIP(ip); target.IP == nil {
+			fmt.Printf("Skipping %s: invalid IP address %q\n", target.Domain, ip)
+			return target, false
+		}
+	}
+
+	for _, i := range l.extra {
+		target.Extra = append(target.Extra, field(i))
+	}
+	return target, true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Detects the layout of a CSV input and reads its targets, formatted as domain|rank|port|ip
+func readTestCSV(t *testing.T, content string, opts *Options) (*csvLayout, []string, error) {
+	t.Helper()
+	path := writeTestFile(t, t.TempDir(), "input.csv", content)
+	layout, err := detectCSVLayout(path, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	var targets []string
+	err = readCSV(path, layout, func(target Target) bool {
+		targets = append(targets, formatTestTarget(target))
+		return true
+	})
+	return layout, targets, err
+}
+
+// Formats the fields of a target read from an input as domain|rank|port|ip, leaving out missing fields
+func formatTestTarget(target Target) string {
+	rank, ip := "", ""
+	if target.Rank != 0 {
+		rank = strconv.Itoa(target.Rank)
+	}
+	if target.IP != nil {
+		ip = target.IP.String()
+	}
+	return strings.Join([]string{target.Domain, rank, target.Port, ip}, "|")
+}
+
+func TestCSVLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		opts    Options
+		targets []string
+		extra   []string
+	}{
+		{"top-1m without header", "1,google.com\n2,youtube.com\n", Options{},
+			[]string{"google.com|1||", "youtube.com|2||"}, []string{"rank"}},
+		{"single column", "example.com\nexample.org\n", Options{},
+			[]string{"example.com|||", "example.org|||"}, nil},
+		{"header by name", "Rank,Domain,Port,IP\n3,example.com,8443,192.0.2.1\n4,example.org,,\n", Options{},
+			[]string{"example.com|3|8443|192.0.2.1", "example.org|4||"}, []string{"Rank", "Port", "IP"}},
+		{"header in other order", "host,notes,#\nexample.com,first,1\n", Options{},
+			[]string{"example.com|1||"}, []string{"notes", "#"}},
+		{"byte order mark", "\xef\xbb\xbfdomain,rank\nexample.com,5\n", Options{},
+			[]string{"example.com|5||"}, []string{"rank"}},
+		{"comment lines", "# exported list\n1,example.com\n# more\n2,example.org\n", Options{Comment: "#"},
+			[]string{"example.com|1||", "example.org|2||"}, []string{"rank"}},
+		{"columns by index", "example.com,443,x,7\nexample.org,8443,y,8\n", Options{DomainColumn: "1", PortColumn: "2", RankColumn: "4"},
+			[]string{"example.com|7|443|", "example.org|8|8443|"}, []string{"port", "column3", "rank"}},
+		{"column by custom name", "target,server\nexample.com,192.0.2.9\n", Options{DomainColumn: "target", IPColumn: "server"},
+			[]string{"example.com|||192.0.2.9"}, []string{"server"}},
+		{"skipped rows", "rank,domain,ip\n1,,\n2,example.com,not-an-ip\n3,example.org,\n", Options{},
+			[]string{"example.org|3||"}, []string{"rank", "ip"}},
+	}
+	for _, test := range tests {
+		layout, targets, err := readTestCSV(t, test.content, &test.opts)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !slices.Equal(targets, test.targets) {
+			t.Errorf("%s: targets = %q, want %q", test.name, targets, test.targets)
+		}
+		if !slices.Equal(layout.extraNames, test.extra) {
+			t.Errorf("%s: kept columns = %q, want %q", test.name, layout.extraNames, test.extra)
+		}
+	}
+}
+
+func TestCSVLayoutErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		opts    Options
+	}{
+		{"empty file", "", Options{}},
+		{"only comments", "# nothing\n", Options{Comment: "#"}},
+		{"name without header", "example.com,1\n", Options{DomainColumn: "site"}},
+		{"name not in header", "domain,rank\nexample.com,1\n", Options{PortColumn: "tcp"}},
+		{"index 0", "example.com,1\n", Options{DomainColumn: "0"}},
+	}
+	for _, test := range tests {
+		if _, _, err := readTestCSV(t, test.content, &test.opts); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+
+	if _, err := detectCSVLayout(filepath.Join(t.TempDir(), "missing.csv"), &Options{}); err == nil {
+		t.Error("missing file: no error")
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TeoLj/TLSscanner_FP.git/schema"
+)
+
+// Formats of the -json option
+const (
+	jsonNone  = ""
+	jsonArray = "json"
+	jsonLines = "jsonl"
+)
+
+// Checks the value of the -json option
+func validJSONFormat(format string) bool {
+	return format == jsonNone || format == jsonArray || format == jsonLines
+}
+
+// Returns the name of the JSON result file of a format
+func jsonResultName(format string) string {
+	if format == jsonArray {
+		return "results.json"
+	}
+	return "results.jsonl"
+}
+
+// Appends the domain results to the JSON result file in the format of the schema package,
+// either one object per line or as a single array. The array is closed when the file is closed,
+// so JSON Lines suit long scans better: a crash leaves every line but the last one intact.
+type jsonResultFile struct {
+	file       *os.File
+	array      bool
+	count      int      // results written so far
+	inputNames []string // names of the input columns, without the input_ prefix of the CSV files
+}
+
+// Creates the JSON result file, overwriting old content.
+// When resuming, which is only supported for JSON Lines, lines of unfinished domains are removed
+// from an existing file and new lines are appended.
+func openJSONResultFile(filename, format string, done map[string]bool, inputNames []string) (*jsonResultFile, error) {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if done != nil {
+		if err := pruneJSONLFile(filename, done); err != nil {
+			return nil, err
+		}
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f := &jsonResultFile{file: file, array: format == jsonArray, inputNames: inputNames}
+	if f.array {
+		_, err = file.WriteString("[")
+	}
+	return f, err
+}
+
+// Appends a domain result, written with a single write call like the checkpoint lines
+func (f *jsonResultFile) write(result *DomainResult) error {
+	return f.writeSchema(schemaResult(result, f.inputNames))
+}
+
+// Appends a result that is already in the format of the schema package
+func (f *jsonResultFile) writeSchema(r *schema.Result) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if f.array {
+		separator := ",\n"
+		if f.count == 0 {
+			separator = "\n"
+		}
+		line = append([]byte(separator), line...)
+	} else {
+		line = append(line, '\n')
+	}
+	if _, err := f.file.Write(line); err != nil {
+		return err
+	}
+	f.count++
+	return nil
+}
+
+// Closes the array, if any, and the file
+func (f *jsonResultFile) close() {
+	if f.array {
+		f.file.WriteString("\n]\n")
+	}
+	f.file.Close()
+}
+
+// Rewrites a JSON Lines result file so that it only contains the lines of finished domains
+func pruneJSONLFile(filename string, done map[string]bool) error {
+	content, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var pruned bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(completeLines(content)))
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var line struct {
+			Domain string `json:"domain"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &line) == nil && done[line.Domain] {
+			pruned.Write(scanner.Bytes())
+			pruned.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return replaceFile(filename, pruned.Bytes())
+}
+
+// Reads a JSON or JSON Lines result file result by result, without holding the whole file in memory.
+// The format is detected from the content; a partial last line of JSON Lines, left behind by a killed scan, is ignored.
+func forEachJSONResult(filename string, fn func(r *schema.Result)) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil // empty file
+		}
+		if err != nil {
+			return err
+		}
+		if b == '[' {
+			reader.UnreadByte()
+			break // JSON array
+		}
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+
+		reader.UnreadByte()
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err == io.EOF {
+				return nil // the partial last line, if any
+			}
+			if err != nil {
+				return err
+			}
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var r schema.Result
+			if err := json.Unmarshal(line, &r); err != nil {
+				return fmt.Errorf("%s: %v", filename, err)
+			}
+			fn(&r)
+		}
+	}
+
+	decoder := json.NewDecoder(reader)
+	if _, err := decoder.Token(); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	for decoder.More() {
+		var r schema.Result
+		if err := decoder.Decode(&r); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		fn(&r)
+	}
+	return nil
+}
+
+// Converts a domain result to the published schema
+func schemaResult(result *DomainResult, inputNames []string) *schema.Result {
+	r := &schema.Result{
+		SchemaVersion: schema.Version,
+		Domain:        result.Domain,
+		Host:          result.Domain,
+		Port:          443,
+		Error:         result.Error,
+		Timings: schema.Timings{
+			Started: result.Started,
+			TotalMS: milliseconds(result.Duration),
+		},
+		Ciphers: result.Ciphers,
+	}
+	if host, port, err := net.SplitHostPort(result.Domain); err == nil {
+		r.Host = host
+		r.Port, _ = strconv.Atoi(port)
+	}
+	if r.Ciphers == nil {
+		r.Ciphers = []string{}
+	}
+
+	switch {
+	case result.Closed:
+		r.Status = schema.StatusClosed
+	case result.Completed:
+		r.Status = schema.StatusCompleted
+	default:
+		r.Status = schema.StatusFailed
+	}
+
+	for i, name := range inputNames {
+		if i < len(result.Extra) && result.Extra[i] != "" {
+			if r.Input == nil {
+				r.Input = make(map[string]string)
+			}
+			r.Input[name] = result.Extra[i]
+		}
+	}
+
+	if result.Resolve != nil {
+		r.Timings.ResolveMS = milliseconds(result.Resolve.Duration)
+		r.Resolve = &schema.Resolve{
+			Status:     result.Resolve.Status,
+			Addresses:  ipStrings(result.Resolve.Addresses),
+			ReverseDNS: result.Resolve.ReverseDNS,
+			Error:      result.Resolve.Error,
+		}
+	}
+
+	for _, probe := range result.Probes {
+		r.Probes = append(r.Probes, schema.Probe{
+			Cipher:     probe.Cipher,
+			Family:     probe.Family,
+			Version:    probe.Version,
+			Attempts:   probe.Attempts,
+			DurationMS: milliseconds(probe.Duration),
+			Error:      probe.Error,
+		})
+		if probe.Version != "" {
+			if r.CiphersByVersion == nil {
+				r.CiphersByVersion = make(map[string][]string)
+			}
+			if !slices.Contains(r.CiphersByVersion[probe.Version], probe.Cipher) {
+				r.CiphersByVersion[probe.Version] = append(r.CiphersByVersion[probe.Version], probe.Cipher)
+			}
+		}
+	}
+
+	for _, e := range result.Errors {
+		r.Errors = append(r.Errors, schema.Error{Cipher: e.Cipher, Message: e.Message, Category: e.Category})
+	}
+
+	for _, cert := range result.Certificates {
+		r.Certificates = append(r.Certificates, schema.Certificate{
+			Subject:            cert.Subject,
+			Issuer:             cert.Issuer,
+			Serial:             cert.Serial,
+			NotBefore:          cert.NotBefore,
+			NotAfter:           cert.NotAfter,
+			DNSNames:           cert.DNSNames,
+			KeyAlgorithm:       cert.KeyAlgorithm,
+			SignatureAlgorithm: cert.SignatureAlgorithm,
+			SHA256:             cert.SHA256,
+		})
+	}
+
+	for _, family := range result.Families {
+		r.Families = append(r.Families, schema.Family{
+			Family:    family.Family,
+			Addresses: ipStrings(family.Addresses),
+			TLS:       family.TLS,
+			Ciphers:   family.Ciphers,
+			Error:     family.Error,
+		})
+	}
+
+	if o := result.OCSP; o != nil {
+		r.OCSP = &schema.OCSP{
+			Stapled:         o.Stapled,
+			Status:          o.Status,
+			ProducedAt:      optionalTime(o.ProducedAt),
+			NextUpdate:      optionalTime(o.NextUpdate),
+			Responder:       o.Responder,
+			MustStaple:      o.MustStaple,
+			MissingStaple:   o.MissingStaple,
+			ResponderStatus: o.ResponderStatus,
+			CRLStatus:       o.CRLStatus,
+			Error:           o.Error,
+		}
+	}
+
+	if c := result.CT; c != nil {
+		r.CT = &schema.CT{ValidSCTs: c.ValidSCTs, Operators: c.Operators, PolicySatisfied: c.PolicySatisfied, Error: c.Error}
+		for _, sct := range c.SCTs {
+			r.CT.SCTs = append(r.CT.SCTs, schema.SCT{
+				Source:    sct.Source,
+				LogID:     sct.LogID,
+				Log:       sct.Log,
+				Operator:  sct.Operator,
+				Timestamp: sct.Timestamp,
+				Valid:     sct.Valid,
+				Error:     sct.Error,
+			})
+		}
+	}
+
+	if h := result.HTTP; h != nil {
+		r.HTTP = &schema.HTTP{
+			StatusCode:        h.StatusCode,
+			HSTS:              h.HSTS,
+			MaxAge:            h.MaxAge,
+			IncludeSubDomains: h.IncludeSubDomains,
+			Preload:           h.Preload,
+			RedirectsToHTTPS:  h.RedirectsToHTTPS,
+			RedirectLocation:  h.RedirectLocation,
+			AltSvc:            h.AltSvc,
+			Error:             h.Error,
+		}
+	}
+
+	if d := result.DNS; d != nil {
+		r.DNS = &schema.DNS{
+			CAA:       d.CAA,
+			CAADomain: d.CAADomain,
+			Issuer:    d.Issuer,
+			CAAStatus: d.CAAStatus,
+			TLSA:      d.TLSA,
+			TLSAMatch: d.TLSAMatch,
+			DNSSEC:    d.DNSSEC,
+			Error:     d.Error,
+		}
+	}
+
+	if f := result.Fingerprint; f != nil {
+		r.Fingerprint = &schema.Fingerprint{
+			JA3S:              f.JA3S,
+			JA3SString:        f.JA3SString,
+			JA4S:              f.JA4S,
+			ALPN:              f.ALPN,
+			HelloRetryRequest: f.HelloRetryRequest,
+			Error:             f.Error,
+		}
+		if f.Error == "" {
+			r.Fingerprint.Version = tls.VersionName(f.Version)
+			r.Fingerprint.Cipher = tls.CipherSuiteName(f.Cipher)
+		}
+	}
+	return r
+}
+
+// Converts a duration to milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Returns the addresses as strings
+func ipStrings(ips []net.IP) []string {
+	var addresses []string
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	return addresses
+}
+
+// Returns nil for the zero time, so it is left out of the JSON output
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Sections of the schema holding the rows of the result files the analyzer reads, by file name
+var schemaSections = map[string]string{
+	"http.csv":         "http",
+	"dns.csv":          "dns",
+	"fingerprints.csv": "fingerprint",
+}
+
+// Converts a result in the schema format to its row of a result file read by the analyzer,
+// keyed by the column names of the file. Only the columns the analyzer uses are set.
+// It returns nil if the result has no row in the file.
+func schemaRecord(name string, r *schema.Result) map[string]string {
+	switch {
+	case name == "http.csv" && r.HTTP != nil:
+		return map[string]string{
+			"Domain":            r.Domain,
+			"HSTS":              strconv.FormatBool(r.HTTP.HSTS),
+			"IncludeSubDomains": strconv.FormatBool(r.HTTP.IncludeSubDomains),
+			"Preload":           strconv.FormatBool(r.HTTP.Preload),
+		}
+	case name == "dns.csv" && r.DNS != nil:
+		return map[string]string{
+			"Domain":    r.Domain,
+			"CAA":       strings.Join(r.DNS.CAA, ";"),
+			"CAAStatus": r.DNS.CAAStatus,
+			"TLSA":      strings.Join(r.DNS.TLSA, ";"),
+			"TLSAMatch": strconv.FormatBool(r.DNS.TLSAMatch),
+			"DNSSEC":    strconv.FormatBool(r.DNS.DNSSEC),
+		}
+	case name == "fingerprints.csv" && r.Fingerprint != nil:
+		return map[string]string{"Domain": r.Domain, "JA3S": r.Fingerprint.JA3S, "JA4S": r.Fingerprint.JA4S}
+	}
+	return nil
+}
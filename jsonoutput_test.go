@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/TeoLj/TLSscanner_FP.git/schema"
+)
+
+// Returns results of a completed target with all sections, a failed one and a closed one
+func testDomainResults() []*DomainResult {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	completed := &DomainResult{
+		Domain:    "example.com:8443",
+		Extra:     []string{"7", ""},
+		Completed: true,
+		Started:   started,
+		Duration:  1500 * time.Millisecond,
+		Errors:    []ScanError{{Cipher: "TLS_RSA_WITH_RC4_128_SHA", Message: "remote error: tls: handshake failure", Category: errHandshakeFailure}},
+		Resolve: &ResolveResult{
+			Addresses: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+			Status:    "NOERROR",
+			Duration:  12 * time.Millisecond,
+		},
+		Ciphers: []string{"TLS_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+		Probes: []ProbeResult{
+			{Cipher: "TLS_AES_128_GCM_SHA256", Attempts: 1, Duration: 30 * time.Millisecond, Version: "TLS 1.3"},
+			{Cipher: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", Attempts: 2, Duration: 250 * time.Millisecond, Version: "TLS 1.2"},
+			{Cipher: "TLS_RSA_WITH_RC4_128_SHA", Attempts: 1, Duration: 20 * time.Millisecond, Error: "remote error: tls: handshake failure"},
+		},
+		Families: []FamilyResult{{Family: "IPv4", Addresses: []net.IP{net.ParseIP("192.0.2.1")}, TLS: true, Ciphers: []string{"TLS_AES_128_GCM_SHA256"}}},
+		OCSP:     &OCSPResult{Stapled: true, Status: "good", ProducedAt: started.Add(-time.Hour), NextUpdate: started.Add(time.Hour), Responder: "http://ocsp.example"},
+		CT: &CTResult{
+			SCTs:            []SCTInfo{{Source: sctSourceEmbedded, LogID: "bG9n", Log: "Test log", Operator: "Test", Timestamp: started.Add(-24 * time.Hour), Valid: true}},
+			ValidSCTs:       1,
+			Operators:       1,
+			PolicySatisfied: false,
+		},
+		HTTP: &HTTPResult{StatusCode: 200, HSTS: true, MaxAge: 31536000, IncludeSubDomains: true, RedirectsToHTTPS: true, RedirectLocation: "https://example.com/"},
+		DNS:  &DNSResult{CAA: []string{"0 issue \"letsencrypt.org\""}, CAADomain: "example.com", Issuer: "Let's Encrypt", CAAStatus: "allowed"},
+		Fingerprint: &FingerprintResult{
+			JA3S: "eb1d94daa7e0344597e756a1fb6e7054", JA3SString: "771,4865,51-43", JA4S: "t130200_1301_234ea6891581",
+			Version: tls.VersionTLS13, Cipher: tls.TLS_AES_128_GCM_SHA256,
+		},
+		Certificates: []CertificateInfo{{
+			Subject: "CN=example.com", Issuer: "CN=Test CA", Serial: "2a", NotBefore: started.Add(-24 * time.Hour), NotAfter: started.Add(90 * 24 * time.Hour),
+			DNSNames: []string{"example.com"}, KeyAlgorithm: "ECDSA", SignatureAlgorithm: "ECDSA-SHA256", SHA256: "00ff",
+		}},
+	}
+	failed := &DomainResult{
+		Domain:  "nxdomain.example",
+		Error:   "lookup nxdomain.example: no such host",
+		Started: started.Add(time.Second),
+		Errors:  []ScanError{{Message: "lookup nxdomain.example: no such host", Category: errNoSuchHost}},
+		Resolve: &ResolveResult{Status: "NXDOMAIN", Error: "no such host"},
+	}
+	closed := &DomainResult{Domain: "192.0.2.9", Closed: true, Started: started.Add(2 * time.Second)}
+	return []*DomainResult{completed, failed, closed}
+}
+
+// Writes the results to a JSON result file of the format and reads them back
+func roundTripJSON(t *testing.T, format string, results []*DomainResult, inputNames []string) (string, []*schema.Result) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), jsonResultName(format))
+	f, err := openJSONResultFile(path, format, nil, inputNames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if err := f.write(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.close()
+
+	var read []*schema.Result
+	if err := forEachJSONResult(path, func(r *schema.Result) { read = append(read, r) }); err != nil {
+		t.Fatal(err)
+	}
+	return path, read
+}
+
+func TestJSONResultRoundTrip(t *testing.T) {
+	results := testDomainResults()
+	inputNames := []string{"rank", "notes"}
+	for _, format := range []string{jsonLines, jsonArray} {
+		_, read := roundTripJSON(t, format, results, inputNames)
+		if len(read) != len(results) {
+			t.Fatalf("%s: read %d results, want %d", format, len(read), len(results))
+		}
+		for i, result := range results {
+			if want := schemaResult(result, inputNames); !reflect.DeepEqual(read[i], want) {
+				t.Errorf("%s: result %d read back as\n%+v\nwant\n%+v", format, i, read[i], want)
+			}
+		}
+	}
+
+	r := schemaResult(results[0], inputNames)
+	if r.Host != "example.com" || r.Port != 8443 || r.Status != schema.StatusCompleted || r.Timings.TotalMS != 1500 {
+		t.Errorf("host %s, port %d, status %s, total %vms", r.Host, r.Port, r.Status, r.Timings.TotalMS)
+	}
+	if !reflect.DeepEqual(r.Input, map[string]string{"rank": "7"}) {
+		t.Errorf("input = %v, want the rank without the empty notes", r.Input)
+	}
+	if !reflect.DeepEqual(r.CiphersByVersion, map[string][]string{
+		"TLS 1.3": {"TLS_AES_128_GCM_SHA256"}, "TLS 1.2": {"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	}) {
+		t.Errorf("ciphers by version = %v", r.CiphersByVersion)
+	}
+	if r.Fingerprint.Version != "TLS 1.3" || r.Fingerprint.Cipher != "TLS_AES_128_GCM_SHA256" {
+		t.Errorf("fingerprint version %s, cipher %s", r.Fingerprint.Version, r.Fingerprint.Cipher)
+	}
+	if failed := schemaResult(results[1], nil); failed.Status != schema.StatusFailed || failed.Ciphers == nil || failed.Port != 443 {
+		t.Errorf("failed result: status %s, ciphers %v, port %d", failed.Status, failed.Ciphers, failed.Port)
+	}
+	if closed := schemaResult(results[2], nil); closed.Status != schema.StatusClosed {
+		t.Errorf("closed result: status %s", closed.Status)
+	}
+}
+
+func TestForEachJSONResultTruncated(t *testing.T) {
+	results := testDomainResults()
+	path, _ := roundTripJSON(t, jsonLines, results[:2], nil)
+
+	// A killed scan leaves a partial last line behind
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"schema_version":1,"domain":"192.0.2.9","host":"192.0.2`)
+	file.Close()
+
+	var domains []string
+	if err := forEachJSONResult(path, func(r *schema.Result) { domains = append(domains, r.Domain) }); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(domains, []string{"example.com:8443", "nxdomain.example"}) {
+		t.Errorf("domains = %v, want the two complete lines", domains)
+	}
+
+	// Resuming keeps the lines of finished domains only and drops the partial line
+	f, err := openJSONResultFile(path, jsonLines, map[string]bool{"nxdomain.example": true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.write(results[2]); err != nil {
+		t.Fatal(err)
+	}
+	f.close()
+	domains = nil
+	if err := forEachJSONResult(path, func(r *schema.Result) { domains = append(domains, r.Domain) }); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(domains, []string{"nxdomain.example", "192.0.2.9"}) {
+		t.Errorf("domains after resuming = %v", domains)
+	}
+
+	// An array cut off in the middle is an error, it cannot be resumed
+	arrayPath := writeTestFile(t, t.TempDir(), "results.json", "[\n{\"domain\":\"example.com\",\"ciphers\":[]},\n{\"domain\":\"exa")
+	if err := forEachJSONResult(arrayPath, func(r *schema.Result) {}); err == nil {
+		t.Error("reading a truncated array succeeded")
+	}
+	emptyPath := writeTestFile(t, t.TempDir(), "results.jsonl", "")
+	if err := forEachJSONResult(emptyPath, func(r *schema.Result) { t.Error("result in an empty file") }); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,15 +1,32 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "merge":
+			runMerge(os.Args[2:])
+			return
+		case "diff":
+			runDiff(os.Args[2:])
+			return
+		case "analyze":
+			runAnalyze(os.Args[2:])
+			return
+		}
+	}
 
 	start := time.Now()
 	fmt.Println("\033[1;35mStart:", start.Format("2006-01-02 15:04:05"), "\033[0m")
@@ -17,31 +34,176 @@ func main() {
 	opts := ParseFlags()
 
 	flag.Parse() // execute the command-line parsing
-	var domains []string
+	var source domainSource
+	var inputColumns []string
 
 	if opts.CSVFilePath != "" {
-		var err error
-		domains, err = readCSV(opts.CSVFilePath, opts.EntriesToScan)
-
+		// The file is read lazily while scanning, its layout is determined from the first line before starting
+		layout, err := detectCSVLayout(opts.CSVFilePath, opts)
 		if err != nil {
-			//fmt.Println("Error reading CSV file:", err)
+			fmt.Println("Error reading CSV file:", err)
+			return
+		}
+		source = csvSource(absolutePath(opts.CSVFilePath), layout)
+		inputColumns = layout.extraNames
+	} else if opts.Input != "" {
+		if !validInputFormat(opts.InputFormat) {
+			fmt.Println("Invalid -inputFormat: expected auto, text, json, jsonl or nmap")
 			return
 		}
+		// Like a CSV file, the input is read lazily while scanning, check that it can be opened before starting
+		if opts.Input != "-" {
+			file, err := os.Open(opts.Input)
+			if err != nil {
+				fmt.Println("Error reading input file:", err)
+				return
+			}
+			file.Close()
+		}
+		source = inputSource(absolutePath(opts.Input), opts.InputFormat)
 	} else if opts.DomainsList != "" {
 		domainsPrepared := strings.Split(opts.DomainsList, ",")
-		domains = make([]string, 0, len(domainsPrepared)) // Initialize with capacity, not fixed length
+		domains := make([]string, 0, len(domainsPrepared)) // Initialize with capacity, not fixed length
 
 		for _, domain := range domainsPrepared {
- 		   domain = strings.TrimSpace(domain) // Trim whitespace
- 		   extractedDomain := extractDomain(domain) // Extract the domain
-   		   if extractedDomain != "" { // Ensure the domain is not empty
-      		  domains = append(domains, extractedDomain) // Add to the list
-  			}	
+			domain = strings.TrimSpace(domain) // Trim whitespace, the domain is normalized while scanning
+			if domain != "" {                  // Ensure the domain is not empty
+				domains = append(domains, domain) // Add to the list
+			}
+		}
+		source = listSource(domains)
+	} else {
+		source = listSource(nil)
+	}
+
+	// The window of the input to scan: rank range, offset and number of entries
+	firstRank, lastRank, err := parseRankRange(opts.Ranks)
+	if err != nil {
+		fmt.Println("Invalid -ranks:", err)
+		return
+	}
+	if opts.Offset < 0 {
+		fmt.Println("Invalid -offset: must not be negative")
+		return
+	}
+	source = selectEntries(source, firstRank, lastRank, opts.Offset, opts.EntriesToScan)
+
+	// CIDR blocks and IP ranges are accepted from every source
+	source = expandRanges(source)
+
+	// Sampling and sharding select among the normalized targets, see startScanner
+	shard, shards, err := parseShard(opts.Shard)
+	if err != nil {
+		fmt.Println("Invalid -shard:", err)
+		return
+	}
+	if opts.Sample <= 0 || opts.Sample > 1 {
+		fmt.Println("Invalid -sample: expected a fraction above 0 and at most 1")
+		return
+	}
+	if opts.Sample < 1 && opts.Seed == 0 {
+		if opts.Resume {
+			fmt.Println("Resuming a sampled scan needs the -seed of the interrupted run")
+			return
 		}
+		opts.Seed = time.Now().UnixNano()
+	}
+	if opts.Sample < 1 {
+		fmt.Printf("\033[38;5;208mSampling %g%% of the targets with seed %d\033[0m\n", opts.Sample*100, opts.Seed)
+	}
+	if shards > 0 {
+		fmt.Printf("\033[38;5;208mScanning shard %d of %d\033[0m\n", shard, shards)
+	}
+
+	if opts.IPv4Prefix < 0 || opts.IPv4Prefix > 32 || opts.IPv6Prefix < 0 || opts.IPv6Prefix > 128 {
+		fmt.Println("Invalid prefix length: -ipv4Prefix must be between 0 and 32, -ipv6Prefix between 0 and 128")
+		return
+	}
+
+	if !validFamily(opts.Family) {
+		fmt.Println("Invalid -family: expected any, 4, 6 or both")
+		return
+	}
+
+	if opts.ProxyDNS && opts.Proxy == "" {
+		fmt.Println("Invalid -proxyDNS: needs a -proxy to resolve the domains")
+		return
+	}
+	if opts.ProxyDNS && opts.Family != familyAny {
+		fmt.Println("Invalid -proxyDNS: -family needs the addresses of the domains, which the proxy does not report")
+		return
 	}
 
-	scanner := newScanner(domains, opts)
-	scanner.startScanner()
+	if !validJSONFormat(opts.JSONOutput) {
+		fmt.Println("Invalid -json: expected json or jsonl")
+		return
+	}
+	if opts.JSONOutput == jsonArray && opts.Resume {
+		fmt.Println("Resuming is only supported with -json=jsonl, a JSON array cannot be appended to")
+		return
+	}
+
+	retryOn, err := parseRetryClasses(opts.RetryClasses)
+	if err != nil {
+		fmt.Println("Invalid -retryOn:", err)
+		return
+	}
+
+	scanner := newScanner(source, opts)
+	scanner.inputColumns = inputColumns
+	scanner.retryOn = retryOn
+	scanner.shard, scanner.shards = shard, shards
+
+	// Like the input, the database is opened relative to the working directory at start
+	if opts.DBPath != "" {
+		store, err := openResultStore(absolutePath(opts.DBPath))
+		if err != nil {
+			fmt.Println("Error opening the database:", err)
+			return
+		}
+		defer store.close()
+		scanner.store = store
+	}
+
+	dialer, err := newDialer(opts.Proxy, opts.SourceIP)
+	if err != nil {
+		fmt.Println("Error configuring the dialer:", err)
+		return
+	}
+	scanner.Dialer = dialer
+
+	if opts.CTLogList != "" {
+		ctLogs, err := loadCTLogList(opts.CTLogList)
+		if err != nil {
+			fmt.Println("Error reading CT log list:", err)
+			return
+		}
+		scanner.CTLogs = ctLogs
+	}
+
+	// The resolver is used for the CAA and TLSA lookups and, if set explicitly, for resolving the domains
+	if opts.DNSChecks || opts.Resolver != "" {
+		resolver, err := newDNSResolver(opts.Resolver, opts.Timeout)
+		if err != nil {
+			fmt.Println("Error configuring the DNS resolver:", err)
+			return
+		}
+		if opts.Proxy != "" {
+			resolver.useProxy(dialer)
+		}
+		scanner.Resolver = resolver
+	}
+
+	// The first SIGINT/SIGTERM stops the scan gracefully, the results gathered so far are still analyzed.
+	// Afterwards the default handling is restored, so a second signal terminates the process right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		fmt.Println("\n\033[38;5;208mStopping scan, waiting for running probes (interrupt again to quit immediately)\033[0m")
+	}()
+
+	scanner.startScanner(ctx)
 	scanner.analyzeResults()
 
 	end := time.Now()
@@ -59,55 +221,75 @@ func main() {
 
 }
 
-// Reads a CSV file from the specified file path and extracts domains from the file.
-// It returns a slice of strings containing the extracted domains.
-// The function stops reading the file when the number of entries to scan is reached.
-func readCSV(filePath string, entriesToScan int) ([]string, error) {
+// Produces the targets to scan, passing them one by one to emit.
+// It stops early if emit returns false.
+type domainSource func(emit func(target Target) bool) error
+
+// Returns a source producing the domains of a list
+func listSource(domains []string) domainSource {
+	return func(emit func(target Target) bool) error {
+		for _, domain := range domains {
+			if !emit(Target{Domain: domain}) {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+// Returns the absolute form of an input path, as the working directory changes to -saveDir
+// before the input is read. Stdin (-) and paths that cannot be resolved are returned unchanged.
+func absolutePath(path string) string {
+	if path == "-" {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// Returns a source reading the targets of a CSV file lazily, so the full list is never held in memory
+func csvSource(filePath string, layout *csvLayout) domainSource {
+	return func(emit func(target Target) bool) error {
+		return readCSV(filePath, layout, emit)
+	}
+}
+
+// Reads a CSV file from the specified file path and extracts the targets from the file.
+// The columns are taken from the layout; the header line and comment lines are skipped.
+// Each target is passed to emit as soon as it is read; reading stops if emit returns false.
+func readCSV(filePath string, layout *csvLayout, emit func(target Target) bool) error {
 
 	file, err := os.Open(filePath)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer file.Close()
 
-	var domains []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		if entriesToScan > 0 && len(domains) >= entriesToScan {
-			break
-		}
-		line := scanner.Text()
-        record := strings.Split(line, ",")
-        
-        // Assuming the format is always number,domain and the domain is the second element.
-        if len(record) >= 2 { // Check if the line has at least two elements
-            domain := record[1] // Directly access the domain part
-            
-            // Assuming extractDomain function validates or processes the domain further.
-            validatedDomain:= extractDomain(domain)
-           
-            if validatedDomain != "" {
-                domains = append(domains, validatedDomain)
-            }
-        }
-    }
-	if err := scanner.Err(); err != nil {
-		fmt.Println("Error reading CSV file:", err)
-		return nil, err
-	}
-
-	return domains, nil
-}
-
-// Extracts the domain from a given field.
-// The dial function is used to establish a lower-level TCP connection, 
-// and it requires just the domain name (or IP address) and the port number, without the scheme (http or https).
-func extractDomain(field string) (string) {
+	reader := newCSVReader(file, layout.comment)
+	if layout.hasHeader {
+		if _, err := reader.Read(); err != nil && err != io.EOF {
+			return err
+		}
+	}
 
-	field = strings.TrimSpace(field)
-	domain := strings.TrimPrefix(field, "https://")
-	domain = strings.TrimPrefix(domain, "http://")
-	domain = strings.TrimPrefix(domain, "www.")
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			fmt.Println("Error reading CSV file:", err)
+			return err
+		}
 
-	return domain
+		target, ok := layout.target(record)
+		if !ok {
+			continue
+		}
+		if !emit(target) {
+			return nil
+		}
+	}
 }
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/TeoLj/TLSscanner_FP.git/schema"
+)
+
+// A result file with one row per domain, merged by the merge command
+type mergeFile struct {
+	name      string
+	hasHeader bool
+}
+
+// Result files merged by domain. The cipher counts, fingerprint clusters and the HTML report are computed again
+// from the merged files instead.
+var mergeFiles = []mergeFile{
+	{"cipherScan.csv", false},
+	{"resolve.csv", true},
+	{"ocsp.csv", true},
+	{"ct.csv", true},
+	{"families.csv", true},
+	{"attempts.csv", true},
+	{"http.csv", true},
+	{"dns.csv", true},
+	{"fingerprints.csv", true},
+}
+
+// The output directory of a previous scan
+type resultDir struct {
+	path       string
+	prefix     string               // prefix of the result files: the name of the input CSV file followed by _, or empty
+	modified   time.Time            // last write to the checkpoint file, or to the cipher scan file without a checkpoint
+	done       map[string]bool      // domains with results in the directory
+	jsonFormat string               // format of the JSON result file, jsonNone if the scan wrote none
+	started    map[string]time.Time // start of the scan of each domain, recorded in the JSON results
+}
+
+// Runs the merge command: go run . merge [-out=DIR] DIR...
+// It combines the result files of several scans, such as the shards of a list or repeated runs, into one directory.
+// A domain found in several directories is taken from the directory that scanned it last, with all its rows and errors.
+// The cipher counts, error counts and the HTML report are then computed from the merged results.
+func runMerge(args []string) {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	out := flags.String("out", "merged", "Directory to save the merged results")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: go run . merge [-out=DIR] DIR...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return
+	}
+
+	// The analyzer changes the working directory, so all paths are made absolute first
+	outDir, err := filepath.Abs(*out)
+	if err != nil {
+		fmt.Println("Invalid -out:", err)
+		return
+	}
+
+	var dirs []*resultDir
+	for _, path := range flags.Args() {
+		dir, err := loadResultDir(path)
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", path, err)
+			return
+		}
+		if dir.path == outDir {
+			fmt.Printf("Error: %s is both an input and the output directory\n", path)
+			return
+		}
+		if databases := dir.databases(); len(databases) > 0 {
+			fmt.Printf("Error: %s holds the SQLite database %s, which cannot be merged; "+
+				"write the scans to a single database with -db instead, or move the database out of the directory\n",
+				path, strings.Join(databases, ", "))
+			return
+		}
+		dirs = append(dirs, dir)
+	}
+
+	// Oldest first, so the merged files take the header of the most recent directory
+	sort.SliceStable(dirs, func(i, j int) bool { return dirs[i].modified.Before(dirs[j].modified) })
+	for _, dir := range dirs {
+		fmt.Printf("\033[38;5;208m%s: %d domains, scanned %s\033[0m\n", dir.path, len(dir.done), dir.modified.Format("2006-01-02 15:04:05"))
+	}
+	owner := mergeOwners(dirs)
+
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		fmt.Println("Error creating the output directory:", err)
+		return
+	}
+
+	// The merged files take the prefix of the most recent scan
+	opts := &Options{SaveDir: outDir, Family: familyAny}
+	if prefix := dirs[len(dirs)-1].prefix; prefix != "" {
+		opts.CSVFilePath = strings.TrimSuffix(prefix, "_") + ".csv"
+	}
+	s := newScanner(nil, opts)
+
+	for _, file := range mergeFiles {
+		if err := mergeResultFile(dirs, owner, file, s.resultPath(file.name)); err != nil {
+			fmt.Printf("Error merging %s: %v\n", file.name, err)
+			return
+		}
+	}
+	if err := mergeJSONFiles(dirs, owner, s.resultPath); err != nil {
+		fmt.Println("Error merging the JSON result files:", err)
+		return
+	}
+	if err := mergeRejects(dirs, s.resultPath("rejects.csv")); err != nil {
+		fmt.Println("Error merging the rejects files:", err)
+		return
+	}
+	if err := mergeCheckpoints(owner, s.resultPath("checkpoint.txt")); err != nil {
+		fmt.Println("Error writing the checkpoint file:", err)
+		return
+	}
+
+	logFileName := filepath.Join(outDir, "errorLog.txt")
+	if err := mergeErrorLogs(dirs, owner, logFileName); err != nil {
+		fmt.Println("Error merging the error logs:", err)
+		return
+	}
+	if err := s.ErrorCounts.loadErrorLog(logFileName); err != nil {
+		fmt.Println("Error reading the merged error log:", err)
+		return
+	}
+	s.sortErrorFile(logFileName)
+
+	fmt.Printf("\033[38;5;208mMerged %d domains from %d directories into %s\033[0m\n", len(owner), len(dirs), outDir)
+	s.analyzeResults()
+}
+
+// Returns the index of the directory each domain is taken from: the directory that scanned it last,
+// see resultDir.scanned. On a tie, the later directory in dirs, which are sorted oldest first, wins.
+func mergeOwners(dirs []*resultDir) map[string]int {
+	owner := make(map[string]int)
+	latest := make(map[string]time.Time)
+	for i, dir := range dirs {
+		for domain := range dir.done {
+			scanned := dir.scanned(domain)
+			if _, ok := owner[domain]; !ok || !scanned.Before(latest[domain]) {
+				owner[domain], latest[domain] = i, scanned
+			}
+		}
+	}
+	return owner
+}
+
+// Finds the result files of a scan in a directory and reads the domains they hold.
+// The domains are taken from the checkpoint file, or from the resolution and cipher scan files
+// of scans that have none.
+func loadResultDir(path string) (*resultDir, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	matches, err := filepath.Glob(filepath.Join(abs, "*cipherScan.csv"))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no scan results found")
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("results of several scans found: %s", strings.Join(matches, ", "))
+	}
+	dir := &resultDir{path: abs, prefix: strings.TrimSuffix(filepath.Base(matches[0]), "cipherScan.csv")}
+	if err := dir.loadStartTimes(); err != nil {
+		return nil, err
+	}
+
+	checkpoint := dir.file("checkpoint.txt")
+	info, err := os.Stat(checkpoint)
+	if err == nil {
+		dir.modified = info.ModTime()
+		dir.done, err = loadCheckpoint(checkpoint)
+		return dir, err
+	}
+
+	if info, err = os.Stat(matches[0]); err != nil {
+		return nil, err
+	}
+	dir.modified = info.ModTime()
+	dir.done = make(map[string]bool)
+	for _, file := range []mergeFile{{"resolve.csv", true}, {"cipherScan.csv", false}} {
+		err := readResultRows(dir.file(file.name), file.hasHeader, func(header, record []string) {
+			dir.done[record[0]] = true
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return dir, nil
+}
+
+// Returns the path of a result file in the directory
+func (d *resultDir) file(name string) string {
+	return filepath.Join(d.path, d.prefix+name)
+}
+
+// Reads the start of the scan of each domain from the JSON results, if the scan wrote any
+func (d *resultDir) loadStartTimes() error {
+	d.started = make(map[string]time.Time)
+	for _, format := range []string{jsonLines, jsonArray} {
+		filename := d.file(jsonResultName(format))
+		if !fileExists(filename) {
+			continue
+		}
+		d.jsonFormat = format
+		return forEachJSONResult(filename, func(r *schema.Result) {
+			if !r.Timings.Started.IsZero() {
+				d.started[r.Domain] = r.Timings.Started
+			}
+		})
+	}
+	return nil
+}
+
+// Returns when the domain was scanned: the start of its scan if the JSON results record it,
+// the last write to the directory otherwise
+func (d *resultDir) scanned(domain string) time.Time {
+	if started, ok := d.started[domain]; ok {
+		return started
+	}
+	return d.modified
+}
+
+// Returns the names of the SQLite databases in the directory, whose runs the merge cannot combine
+func (d *resultDir) databases() []string {
+	var names []string
+	for _, pattern := range []string{"*.db", "*.sqlite", "*.sqlite3"} {
+		matches, _ := filepath.Glob(filepath.Join(d.path, pattern))
+		for _, match := range matches {
+			names = append(names, filepath.Base(match))
+		}
+	}
+	return names
+}
+
+// Reads the rows of a result file, passing the header (nil without one) and each non-empty row to fn.
+// A partial last row, left behind by a killed scan, is ignored.
+func readResultRows(filename string, hasHeader bool, fn func(header, record []string)) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	reader := csv.NewReader(bytes.NewReader(completeLines(content)))
+	reader.FieldsPerRecord = -1
+
+	var header []string
+	if hasHeader {
+		if header, err = reader.Read(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		if len(record) > 0 && record[0] != "" {
+			fn(header, record)
+		}
+	}
+}
+
+// Writes the rows of a result file of all directories that belong to domains owned by the directory.
+// The header of the most recent directory is used; rows of directories with other columns,
+// such as other input columns, are matched to it by column name. Files missing in all directories are not created.
+func mergeResultFile(dirs []*resultDir, owner map[string]int, file mergeFile, filename string) error {
+	var header []string
+	found := false
+	for i := len(dirs) - 1; i >= 0 && !found; i-- {
+		if !fileExists(dirs[i].file(file.name)) {
+			continue
+		}
+		found = true
+		if file.hasHeader {
+			var err error
+			if header, err = readHeader(dirs[i].file(file.name)); err != nil && err != io.EOF {
+				return err
+			}
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	writer := csv.NewWriter(out)
+	if header != nil {
+		writer.Write(header)
+	}
+
+	for i, dir := range dirs {
+		err := readResultRows(dir.file(file.name), file.hasHeader, func(dirHeader, record []string) {
+			if j, ok := owner[record[0]]; !ok || j != i {
+				return // taken from a more recent scan
+			}
+			if header == nil {
+				writer.Write(record)
+				return
+			}
+			row := make([]string, len(header))
+			for k, column := range header {
+				for l, name := range dirHeader {
+					if name == column && l < len(record) {
+						row[k] = record[l]
+						break
+					}
+				}
+			}
+			writer.Write(row)
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// Returns the first row of a CSV file
+func readHeader(filename string) ([]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	return reader.Read()
+}
+
+// Writes the JSON results of all directories that belong to domains owned by the directory.
+// JSON Lines and JSON array files are both read; the merged file takes the format of the most recent directory
+// with JSON results. The file is not created if no directory has one.
+func mergeJSONFiles(dirs []*resultDir, owner map[string]int, resultPath func(name string) string) error {
+	format := jsonNone
+	for _, dir := range dirs {
+		if dir.jsonFormat != jsonNone {
+			format = dir.jsonFormat
+		}
+	}
+	if format == jsonNone {
+		return nil
+	}
+
+	out, err := openJSONResultFile(resultPath(jsonResultName(format)), format, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer out.close()
+
+	for i, dir := range dirs {
+		if dir.jsonFormat == jsonNone {
+			continue
+		}
+		var writeErr error
+		err := forEachJSONResult(dir.file(jsonResultName(dir.jsonFormat)), func(r *schema.Result) {
+			if j, ok := owner[r.Domain]; ok && j == i && writeErr == nil {
+				writeErr = out.writeSchema(r)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+	return nil
+}
+
+// Writes the rejected entries of all directories, each one once
+func mergeRejects(dirs []*resultDir, filename string) error {
+	var rows [][]string
+	seen := make(map[string]bool)
+	for _, dir := range dirs {
+		err := readResultRows(dir.file("rejects.csv"), true, func(header, record []string) {
+			key := strings.Join(record, "\x00")
+			if !seen[key] {
+				seen[key] = true
+				rows = append(rows, record)
+			}
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	writer := csv.NewWriter(out)
+	writer.Write(rejectsHeader)
+	writer.WriteAll(rows)
+	return writer.Error()
+}
+
+// Writes the checkpoint file of the merged results, so that a merged scan can be continued with -resume
+func mergeCheckpoints(owner map[string]int, filename string) error {
+	cp, err := openCheckpoint(filename, false)
+	if err != nil {
+		return err
+	}
+	defer cp.close()
+
+	domains := make([]string, 0, len(owner))
+	for domain := range owner {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		if err := cp.markDone(domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes the error log lines of all directories that belong to domains owned by the directory
+func mergeErrorLogs(dirs []*resultDir, owner map[string]int, filename string) error {
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	for i, dir := range dirs {
+		content, err := os.ReadFile(filepath.Join(dir.path, "errorLog.txt"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(completeLines(content)), "\n") {
+			if line == "" || line == errorLogSeparator {
+				continue
+			}
+			domain, _, _ := strings.Cut(line, ": ")
+			if j, ok := owner[domain]; ok && j == i {
+				if _, err := out.WriteString(line + "\n"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
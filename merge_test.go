@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMergeOwners(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	dirs := []*resultDir{
+		{
+			modified: base,
+			done:     map[string]bool{"a.example": true, "b.example": true, "c.example": true},
+		},
+		{
+			// Written to later, but a.example was scanned at its start, before the first directory scanned it again
+			modified: base.Add(20 * time.Minute),
+			done:     map[string]bool{"a.example": true, "b.example": true, "d.example": true},
+			started:  map[string]time.Time{"a.example": base.Add(-time.Hour), "b.example": base.Add(30 * time.Minute)},
+		},
+		{
+			// Without start times, the last write counts, and the later directory wins a tie
+			modified: base.Add(30 * time.Minute),
+			done:     map[string]bool{"b.example": true},
+		},
+	}
+
+	want := map[string]int{"a.example": 0, "b.example": 2, "c.example": 0, "d.example": 1}
+	owner := mergeOwners(dirs)
+	if len(owner) != len(want) {
+		t.Errorf("owners = %v, want %v", owner, want)
+	}
+	for domain, i := range want {
+		if owner[domain] != i {
+			t.Errorf("owner of %s = %d, want %d", domain, owner[domain], i)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Converts Unicode host names to their ASCII (punycode) form for lookups and validates them:
+// labels of letters, digits and hyphens not starting or ending with a hyphen, at most 63 characters per label
+// and 253 overall. The check is the one applied by browsers, so underscores are rejected too.
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.VerifyDNSLength(true), idna.Transitional(false))
+
+// Header of the rejects file listing the input entries that are not scanned
+var rejectsHeader = []string{"Input", "Reason"}
+
+// Normalizes the targets of a source before they are scanned.
+// Invalid and duplicate targets are skipped and written to the rejects file.
+// The addresses of expanded IP ranges are not added to the set of seen targets, as a large range such as a /8
+// would fill it with millions of entries. Instead the ranges themselves are remembered: an address is a duplicate
+// if an earlier range with the same port includes it or if it was listed on its own before.
+// It is only used by the producer, so it needs no locking.
+type targetNormalizer struct {
+	keepWWW    bool
+	seen       map[uint64]struct{} // hashes of the labels produced so far, smaller than the labels of a long list
+	ranges     []seenRange         // the IP ranges produced so far, in input order
+	file       *os.File
+	writer     *csv.Writer
+	invalid    int
+	duplicates int
+}
+
+// An IP range of the input and the port its addresses are scanned on
+type seenRange struct {
+	r    *ipRange
+	port string
+}
+
+// Creates a normalizer writing its rejects to the given file.
+// The file is always overwritten: the whole input is read again when resuming, so its rejects are found again.
+func newTargetNormalizer(filename string, keepWWW bool) (*targetNormalizer, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	n := &targetNormalizer{keepWWW: keepWWW, seen: make(map[uint64]struct{}), file: file, writer: csv.NewWriter(file)}
+	n.writer.Write(rejectsHeader)
+	n.writer.Flush()
+	return n, n.writer.Error()
+}
+
+// Wraps a source so that it produces normalized targets, each one only once
+func (n *targetNormalizer) wrap(source domainSource) domainSource {
+	return func(emit func(target Target) bool) error {
+		return source(func(target Target) bool {
+			normalized, err := normalizeTarget(target, n.keepWWW)
+			if err != nil {
+				n.invalid++
+				n.reject(target.Domain, err.Error())
+				return true
+			}
+			if normalized.Range != nil {
+				if len(n.ranges) == 0 || n.ranges[len(n.ranges)-1].r != normalized.Range {
+					n.ranges = append(n.ranges, seenRange{r: normalized.Range, port: normalized.Port})
+				}
+				// The range itself is the last one, only the earlier ones can include the address already
+				_, found := n.seen[targetHash(normalized.Label(), nil)]
+				if found || n.inRange(n.ranges[:len(n.ranges)-1], normalized) {
+					n.duplicate(target.Domain, normalized)
+					return true
+				}
+				return emit(normalized)
+			}
+
+			key := targetHash(normalized.Label(), nil)
+			if _, found := n.seen[key]; found || n.inRange(n.ranges, normalized) {
+				n.duplicate(target.Domain, normalized)
+				return true
+			}
+			n.seen[key] = struct{}{}
+			return emit(normalized)
+		})
+	}
+}
+
+// Reports whether one of the ranges includes the target's address on the target's port
+func (n *targetNormalizer) inRange(ranges []seenRange, target Target) bool {
+	ip := net.ParseIP(target.Domain)
+	if ip == nil {
+		return false
+	}
+	for _, seen := range ranges {
+		if seen.port == target.Port && seen.r.contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts a duplicate target and writes it to the rejects file
+func (n *targetNormalizer) duplicate(input string, normalized Target) {
+	n.duplicates++
+	n.reject(input, "duplicate of "+normalized.Label())
+}
+
+// Appends an entry to the rejects file
+func (n *targetNormalizer) reject(input, reason string) {
+	n.writer.Write([]string{input, reason})
+	n.writer.Flush()
+	if err := n.writer.Error(); err != nil {
+		fmt.Printf("Error writing to %s: %v\n", n.file.Name(), err)
+	}
+}
+
+// Closes the rejects file
+func (n *targetNormalizer) close() {
+	n.writer.Flush()
+	n.file.Close()
+}
+
+// Normalizes a target as read from the input to the name that is scanned.
+// The domain may be a URL such as https://Example.com:8443/index.html or a host with a port;
+// the scheme, user info, path, query and fragment are dropped, a port is kept unless the input set one.
+// Host names are lowercased, a trailing dot is removed, Unicode names are converted to punycode
+// and a leading www. is removed unless keepWWW is set. IP addresses are written in their canonical form.
+func normalizeTarget(target Target, keepWWW bool) (Target, error) {
+	raw := strings.TrimSpace(target.Domain)
+	if raw == "" {
+		return target, fmt.Errorf("empty host")
+	}
+
+	var host, port string
+	if ip := net.ParseIP(strings.Trim(raw, "[]")); ip != nil {
+		host = ip.String() // an IPv6 address without brackets is no valid URL host
+	} else {
+		s := raw
+		if !strings.Contains(s, "://") {
+			s = "//" + s
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return target, fmt.Errorf("invalid URL: %v", err.(*url.Error).Err)
+		}
+		if u.Scheme != "" && u.Scheme != "https" && u.Scheme != "http" {
+			return target, fmt.Errorf("unsupported scheme %q", u.Scheme)
+		}
+		host, port = u.Hostname(), u.Port()
+	}
+
+	if target.Port == "" && port != "" && port != "443" {
+		target.Port = port
+	}
+	if target.Port != "" {
+		if n, err := strconv.Atoi(target.Port); err != nil || n < 1 || n > 65535 {
+			return target, fmt.Errorf("invalid port %q", target.Port)
+		}
+		if target.Port == "443" {
+			target.Port = ""
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		target.Domain = ip.String()
+		return target, nil
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return target, fmt.Errorf("empty host")
+	}
+	// Only strip www. from a name that keeps at least two labels, www.com is a domain of its own
+	if rest, found := strings.CutPrefix(host, "www."); found && !keepWWW && strings.Contains(rest, ".") {
+		host = rest
+	}
+
+	ascii, err := idnaProfile.ToASCII(host)
+	if err != nil {
+		return target, fmt.Errorf("invalid hostname: %s", strings.TrimPrefix(err.Error(), "idna: "))
+	}
+	target.Domain = ascii
+	return target, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestNormalizerDedupsRanges(t *testing.T) {
+	n, err := newTargetNormalizer(filepath.Join(t.TempDir(), "rejects.csv"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.close()
+
+	source := n.wrap(expandRanges(listSource([]string{
+		"10.0.0.0/30", "10.0.0.1", "10.0.0.1:8443", // an address of the range, then the same address on another port
+		"10.0.0.2-10.0.0.5",      // overlaps the first range
+		"10.0.0.6", "10.0.0.4-7", // includes a listed address and addresses of the ranges
+		"10.0.0.8/31", "10.0.0.8/31", // the same range twice
+		"https://www.Example.com/", "example.com", "example.com:8443",
+	})))
+	var labels []string
+	if err := source(func(target Target) bool {
+		labels = append(labels, target.Label())
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1:8443", "10.0.0.4", "10.0.0.5",
+		"10.0.0.6", "10.0.0.7", "10.0.0.8", "10.0.0.9", "example.com", "example.com:8443",
+	}
+	if !slices.Equal(labels, want) {
+		t.Errorf("targets = %v, want %v", labels, want)
+	}
+	if n.duplicates != 9 {
+		t.Errorf("duplicates = %d, want 9", n.duplicates)
+	}
+	// Only the targets listed one by one are remembered one by one, the ranges as a whole
+	if len(n.seen) != 4 || len(n.ranges) != 5 {
+		t.Errorf("%d targets and %d ranges remembered, want 4 and 5", len(n.seen), len(n.ranges))
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OID of the TLS Feature extension (RFC 7633) which carries the Must-Staple flag
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// TLS Feature value of the status_request extension
+const tlsFeatureStatusRequest = 5
+
+// Contains the OCSP and revocation information of a domain's leaf certificate
+type OCSPResult struct {
+	Stapled       bool
+	Status        string
+	ProducedAt    time.Time
+	NextUpdate    time.Time
+	Responder     string
+	MustStaple    bool
+	MissingStaple bool // Must-Staple is set but the server did not staple a response
+
+	ResponderStatus string // Status reported by querying the OCSP responder directly
+	CRLStatus       string // Status according to the CRL distribution point
+	Error           string
+}
+
+// Inspects the connection state of a successful handshake.
+// It parses the stapled OCSP response, checks the leaf certificate for the Must-Staple extension
+// and, if enabled, queries the OCSP responder and the CRL distribution point using the scanner's HTTP client.
+func (s *Scanner) checkOCSP(state tls.ConnectionState) *OCSPResult {
+	result := &OCSPResult{}
+	if len(state.PeerCertificates) == 0 {
+		result.Error = "no peer certificates"
+		return result
+	}
+
+	leaf := state.PeerCertificates[0]
+	var issuer *x509.Certificate
+	if len(state.PeerCertificates) > 1 {
+		issuer = state.PeerCertificates[1]
+	}
+
+	result.MustStaple = hasMustStaple(leaf)
+
+	if len(state.OCSPResponse) > 0 {
+		result.Stapled = true
+		// The response must be for the leaf, a server could staple a valid response of another certificate
+		resp, err := ocsp.ParseResponseForCert(state.OCSPResponse, leaf, issuer)
+		if err != nil {
+			result.Error = "stapled response: " + err.Error()
+		} else {
+			result.Status = ocspStatusString(resp.Status)
+			result.ProducedAt = resp.ProducedAt
+			result.NextUpdate = resp.NextUpdate
+			result.Responder = ocspResponderName(resp)
+		}
+	} else if result.MustStaple {
+		result.MissingStaple = true
+	}
+
+	if s.opts.Revocation {
+		result.ResponderStatus = s.queryOCSPResponder(leaf, issuer)
+		result.CRLStatus = s.queryCRL(leaf, issuer)
+	}
+
+	return result
+}
+
+// Checks whether the certificate requests OCSP stapling through the TLS Feature extension.
+func hasMustStaple(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidTLSFeature) {
+			continue
+		}
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			return false
+		}
+		for _, feature := range features {
+			if feature == tlsFeatureStatusRequest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Converts an OCSP status code to a readable string
+func ocspStatusString(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	case ocsp.Unknown:
+		return "unknown"
+	case ocsp.ServerFailed:
+		return "server failed"
+	}
+	return fmt.Sprintf("status %d", status)
+}
+
+// Returns the responder of an OCSP response, either by name or by key hash
+func ocspResponderName(resp *ocsp.Response) string {
+	if len(resp.RawResponderName) > 0 {
+		var rdn pkix.RDNSequence
+		if _, err := asn1.Unmarshal(resp.RawResponderName, &rdn); err == nil {
+			var name pkix.Name
+			name.FillFromRDNSequence(&rdn)
+			return name.String()
+		}
+	}
+	if len(resp.ResponderKeyHash) > 0 {
+		return "key:" + hex.EncodeToString(resp.ResponderKeyHash)
+	}
+	return ""
+}
+
+// Sends an OCSP request for the leaf certificate to the first responder listed in the certificate.
+// It returns the certificate status or a description of the failure.
+func (s *Scanner) queryOCSPResponder(leaf, issuer *x509.Certificate) string {
+	if len(leaf.OCSPServer) == 0 {
+		return "no responder"
+	}
+	if issuer == nil {
+		return "no issuer certificate"
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return "request error: " + err.Error()
+	}
+
+	resp, err := s.HTTPClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return "query error: " + err.Error()
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Sprintf("query error: HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "query error: " + err.Error()
+	}
+
+	parsed, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return "parse error: " + err.Error()
+	}
+	return ocspStatusString(parsed.Status)
+}
+
+// Downloads the first CRL distribution point of the leaf certificate
+// and checks whether the certificate's serial number is listed.
+func (s *Scanner) queryCRL(leaf, issuer *x509.Certificate) string {
+	if len(leaf.CRLDistributionPoints) == 0 {
+		return "no distribution point"
+	}
+
+	resp, err := s.HTTPClient.Get(leaf.CRLDistributionPoints[0])
+	if err != nil {
+		return "query error: " + err.Error()
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Sprintf("query error: HTTP %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "query error: " + err.Error()
+	}
+
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return "parse error: " + err.Error()
+	}
+	if issuer != nil {
+		if err := crl.CheckSignatureFrom(issuer); err != nil {
+			return "invalid signature: " + err.Error()
+		}
+	}
+
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			return "revoked"
+		}
+	}
+	return "good"
+}
+
+// Header of the OCSP result file
+var ocspHeader = []string{"Domain", "Stapled", "Status", "ProducedAt", "NextUpdate", "Responder",
+	"MustStaple", "MissingStaple", "ResponderStatus", "CRLStatus", "Error"}
+
+// Converts the OCSP result of a domain to a row of the OCSP result file.
+// It returns nil if the domain has no OCSP result.
+func ocspRecord(result *DomainResult) []string {
+	if result.OCSP == nil {
+		return nil
+	}
+	o := result.OCSP
+	return []string{
+		result.Domain,
+		fmt.Sprintf("%t", o.Stapled),
+		o.Status,
+		formatTime(o.ProducedAt),
+		formatTime(o.NextUpdate),
+		o.Responder,
+		fmt.Sprintf("%t", o.MustStaple),
+		fmt.Sprintf("%t", o.MissingStaple),
+		o.ResponderStatus,
+		o.CRLStatus,
+		o.Error,
+	}
+}
+
+// Formats a timestamp for the result files, leaving zero values empty
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Creates an OCSP response of the CA for the certificate
+func newTestOCSPResponse(t *testing.T, ca, leaf *testCert, status int) []byte {
+	t.Helper()
+	template := ocsp.Response{
+		Status:       status,
+		SerialNumber: leaf.cert.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}
+	if status == ocsp.Revoked {
+		template.RevokedAt = time.Now().Add(-time.Minute)
+	}
+	resp, err := ocsp.CreateResponse(ca.cert, ca.cert, template, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// Returns a leaf certificate template with the Must-Staple extension
+func mustStapleTemplate(t *testing.T) *x509.Certificate {
+	t.Helper()
+	value, err := asn1.Marshal([]int{tlsFeatureStatusRequest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &x509.Certificate{ExtraExtensions: []pkix.Extension{{Id: oidTLSFeature, Value: value}}}
+}
+
+func TestCheckOCSPStapled(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := newTestLeaf(t, ca, nil, "example.com")
+	other := newTestLeaf(t, ca, nil, "other.example.com")
+
+	tests := []struct {
+		name      string
+		staple    []byte
+		status    string
+		wantError bool
+	}{
+		{"good", newTestOCSPResponse(t, ca, leaf, ocsp.Good), "good", false},
+		{"revoked", newTestOCSPResponse(t, ca, leaf, ocsp.Revoked), "revoked", false},
+		{"other certificate", newTestOCSPResponse(t, ca, other, ocsp.Good), "", true},
+		{"garbage", []byte("not an OCSP response"), "", true},
+	}
+	s := newTestScanner(&Options{})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := s.checkOCSP(tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{leaf.cert, ca.cert},
+				OCSPResponse:     test.staple,
+			})
+			if !result.Stapled {
+				t.Error("Stapled = false, want true")
+			}
+			if result.Status != test.status {
+				t.Errorf("Status = %q, want %q", result.Status, test.status)
+			}
+			if (result.Error != "") != test.wantError {
+				t.Errorf("Error = %q, want error: %t", result.Error, test.wantError)
+			}
+			if result.MissingStaple {
+				t.Error("MissingStaple = true for a stapled response")
+			}
+		})
+	}
+}
+
+func TestCheckOCSPMissingStaple(t *testing.T) {
+	ca := newTestCA(t)
+	s := newTestScanner(&Options{})
+
+	leaf := newTestLeaf(t, ca, mustStapleTemplate(t), "example.com")
+	result := s.checkOCSP(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf.cert, ca.cert}})
+	if !result.MustStaple || !result.MissingStaple || result.Stapled {
+		t.Errorf("MustStaple, MissingStaple, Stapled = %t, %t, %t, want true, true, false",
+			result.MustStaple, result.MissingStaple, result.Stapled)
+	}
+
+	// Without Must-Staple, a missing staple is not reported
+	leaf = newTestLeaf(t, ca, nil, "example.com")
+	result = s.checkOCSP(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf.cert, ca.cert}})
+	if result.MustStaple || result.MissingStaple {
+		t.Errorf("MustStaple, MissingStaple = %t, %t, want false, false", result.MustStaple, result.MissingStaple)
+	}
+}
+
+func TestQueryOCSPResponder(t *testing.T) {
+	ca := newTestCA(t)
+	status := map[string]int{}
+	var leaves []*testCert
+
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, leaf := range leaves {
+			if leaf.cert.SerialNumber.Cmp(req.SerialNumber) == 0 {
+				w.Write(newTestOCSPResponse(t, ca, leaf, status[leaf.cert.Subject.CommonName]))
+				return
+			}
+		}
+		http.Error(w, "unknown certificate", http.StatusNotFound)
+	}))
+	defer responder.Close()
+
+	tests := []struct {
+		name   string
+		status int
+		want   string
+	}{
+		{"good.example.com", ocsp.Good, "good"},
+		{"revoked.example.com", ocsp.Revoked, "revoked"},
+	}
+	s := newTestScanner(&Options{Revocation: true})
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			leaf := newTestLeaf(t, ca, &x509.Certificate{OCSPServer: []string{responder.URL}}, test.name)
+			leaves = append(leaves, leaf)
+			status[test.name] = test.status
+
+			result := s.checkOCSP(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf.cert, ca.cert}})
+			if result.ResponderStatus != test.want {
+				t.Errorf("ResponderStatus = %q, want %q", result.ResponderStatus, test.want)
+			}
+			if result.CRLStatus != "no distribution point" {
+				t.Errorf("CRLStatus = %q, want no distribution point", result.CRLStatus)
+			}
+		})
+	}
+}
+
+// Creates a CRL of the CA that lists the revoked certificates
+func newTestCRL(t *testing.T, ca *testCert, revoked ...*testCert) []byte {
+	t.Helper()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, cert := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   cert.cert.SerialNumber,
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crl
+}
+
+func TestQueryCRL(t *testing.T) {
+	ca := newTestCA(t)
+	var crl []byte
+
+	distributionPoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ca.crl" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(crl)
+	}))
+	defer distributionPoint.Close()
+
+	template := func() *x509.Certificate {
+		return &x509.Certificate{CRLDistributionPoints: []string{distributionPoint.URL + "/ca.crl"}}
+	}
+	revoked := newTestLeaf(t, ca, template(), "revoked.example.com")
+	good := newTestLeaf(t, ca, template(), "good.example.com")
+	crl = newTestCRL(t, ca, revoked)
+
+	s := newTestScanner(&Options{Revocation: true})
+	if status := s.queryCRL(revoked.cert, ca.cert); status != "revoked" {
+		t.Errorf("revoked certificate: CRL status %q, want revoked", status)
+	}
+	if status := s.queryCRL(good.cert, ca.cert); status != "good" {
+		t.Errorf("certificate not on the CRL: status %q, want good", status)
+	}
+
+	// The CRL is checked through checkOCSP as well
+	result := s.checkOCSP(tls.ConnectionState{PeerCertificates: []*x509.Certificate{revoked.cert, ca.cert}})
+	if result.CRLStatus != "revoked" {
+		t.Errorf("CRLStatus = %q, want revoked", result.CRLStatus)
+	}
+
+	// A CRL signed by another CA is not trusted
+	crl = newTestCRL(t, newTestCA(t), revoked)
+	if status := s.queryCRL(revoked.cert, ca.cert); !strings.HasPrefix(status, "invalid signature") {
+		t.Errorf("CRL of another CA: status %q, want an invalid signature", status)
+	}
+
+	missing := newTestLeaf(t, ca, &x509.Certificate{CRLDistributionPoints: []string{distributionPoint.URL + "/missing.crl"}}, "missing.example.com")
+	if status := s.queryCRL(missing.cert, ca.cert); status != "query error: HTTP 404" {
+		t.Errorf("missing CRL: status %q, want query error: HTTP 404", status)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Parses a target that denotes several addresses: a CIDR block such as 10.0.0.0/24,
+// a range such as 10.0.0.1-10.0.0.50 or 2001:db8::1-2001:db8::ff, or the short IPv4 form 10.0.0.1-50.
+// It returns the first and last address of the range, both included.
+func parseIPRange(s string) (first, last net.IP, ok bool) {
+	if ip, network, err := net.ParseCIDR(s); err == nil {
+		first = ip.Mask(network.Mask)
+		last = make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^network.Mask[i]
+		}
+		return first, last, true
+	}
+
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		return nil, nil, false
+	}
+	first = net.ParseIP(strings.TrimSpace(from))
+	if first == nil {
+		return nil, nil, false
+	}
+	to = strings.TrimSpace(to)
+	if octet, err := strconv.Atoi(to); err == nil && first.To4() != nil {
+		if octet < 0 || octet > 255 {
+			return nil, nil, false
+		}
+		last = append(net.IP{}, first.To4()...)
+		last[3] = byte(octet)
+	} else if last = net.ParseIP(to); last == nil {
+		return nil, nil, false
+	}
+
+	if (first.To4() == nil) != (last.To4() == nil) {
+		return nil, nil, false // mixed address families
+	}
+	if first.To4() != nil {
+		first, last = first.To4(), last.To4()
+	}
+	if bytes.Compare(first, last) > 0 {
+		return nil, nil, false
+	}
+	return first, last, true
+}
+
+// An IP range of the input, from the first to the last address, both included.
+// Both addresses have the same length: 4 bytes for IPv4, 16 for IPv6.
+type ipRange struct {
+	first, last net.IP
+}
+
+// Reports whether the range includes ip
+func (r *ipRange) contains(ip net.IP) bool {
+	if len(r.first) == net.IPv4len {
+		ip = ip.To4()
+	} else if ip.To4() != nil {
+		return false
+	} else {
+		ip = ip.To16()
+	}
+	return ip != nil && bytes.Compare(ip, r.first) >= 0 && bytes.Compare(ip, r.last) <= 0
+}
+
+// Returns the address following ip
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP{}, ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// Wraps a source so that CIDR blocks and IP ranges are expanded to one target per address.
+// The addresses are produced one by one, so large ranges are never held in memory.
+// The expanded targets keep the port, rank and input columns of the range and refer to the range they come from.
+func expandRanges(source domainSource) domainSource {
+	return func(emit func(target Target) bool) error {
+		return source(func(target Target) bool {
+			first, last, ok := parseIPRange(target.Domain)
+			if !ok {
+				return emit(target)
+			}
+			r := &ipRange{first: first, last: last}
+			for ip := first; ; ip = nextIP(ip) {
+				expanded := target
+				expanded.Domain = ip.String()
+				expanded.IP = ip
+				expanded.Range = r
+				if !emit(expanded) {
+					return false
+				}
+				if ip.Equal(last) {
+					return true
+				}
+			}
+		})
+	}
+}
+
+// Checks with a single TCP connection whether the target's port is open at one of its addresses
+func (s *Scanner) portOpen(ctx context.Context, target Target, ips []net.IP) bool {
+	allowed, err := s.allowedAddresses(ips)
+	if err != nil {
+		return false
+	}
+	conn, err := s.dialAddresses(ctx, "tcp", target.Domain, allowed, target.port())
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Looks up the names of an IP address, using the configured resolver if -resolver is set
+// and the system resolver otherwise, unless the proxy resolves the names.
+// Failures leave the names empty, as they only serve the report.
+func (s *Scanner) reverseLookup(ctx context.Context, ip net.IP) []string {
+	if s.opts.Resolver != "" {
+		name, err := reverseName(ip)
+		if err != nil {
+			return nil
+		}
+		response, err := s.Resolver.Query(name, dnsmessage.TypePTR)
+		if err != nil {
+			return nil
+		}
+		var names []string
+		for _, answer := range response.Answers {
+			if ptr, ok := answer.Body.(*dnsmessage.PTRResource); ok {
+				names = append(names, strings.TrimSuffix(ptr.PTR.String(), "."))
+			}
+		}
+		return names
+	}
+	// The system resolver would query the local nameserver, which -proxyDNS is meant to avoid
+	if s.opts.ProxyDNS {
+		return nil
+	}
+
+	lookupCtx, cancel := s.probeContext(ctx)
+	defer cancel()
+	names, _ := net.DefaultResolver.LookupAddr(lookupCtx, ip.String())
+	for i := range names {
+		names[i] = strings.TrimSuffix(names[i], ".")
+	}
+	return names
+}
+
+// Returns the in-addr.arpa or ip6.arpa name of an IP address
+func reverseName(ip net.IP) (string, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", ip4[3], ip4[2], ip4[1], ip4[0]), nil
+	}
+	ip6 := ip.To16()
+	if ip6 == nil {
+		return "", fmt.Errorf("invalid IP address")
+	}
+	var name strings.Builder
+	for i := len(ip6) - 1; i >= 0; i-- {
+		fmt.Fprintf(&name, "%x.%x.", ip6[i]&0x0f, ip6[i]>>4)
+	}
+	name.WriteString("ip6.arpa.")
+	return name.String(), nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of destination buckets above which idle buckets are dropped
+const maxIdleDestinations = 4096
+
+// Limits the rate of new connections, overall and per destination.
+// Destinations are grouped by subnet, so hosts sharing a network are limited together.
+// A random jitter can be added before every connection to avoid a regular pattern.
+type RateLimiter struct {
+	Rate       float64 // connections per second overall, 0 for no limit
+	HostRate   float64 // connections per second per destination, 0 for no limit
+	IPv4Prefix int     // prefix length grouping IPv4 destinations
+	IPv6Prefix int     // prefix length grouping IPv6 destinations
+	Jitter     time.Duration
+
+	mutex        sync.Mutex
+	global       *tokenBucket
+	destinations map[string]*tokenBucket
+}
+
+// Holds the tokens of a single rate.
+// The tokens may become negative, in which case they are reserved by callers waiting for their turn.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// Creates a rate limiter from the command-line options
+func newRateLimiter(opts *Options) *RateLimiter {
+	l := &RateLimiter{
+		Rate:         opts.Rate,
+		HostRate:     opts.HostRate,
+		IPv4Prefix:   opts.IPv4Prefix,
+		IPv6Prefix:   opts.IPv6Prefix,
+		Jitter:       opts.Jitter,
+		destinations: make(map[string]*tokenBucket),
+	}
+	if l.Rate > 0 {
+		l.global = newTokenBucket(l.Rate, time.Now())
+	}
+	return l
+}
+
+// Creates a bucket that is full at the given time, allowing one connection right away
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: 1, last: now}
+}
+
+// Takes a token and returns how long the caller has to wait until it is available.
+// The bucket holds at most one token, so connections are spread evenly instead of sent in bursts.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.tokens = math.Min(1, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Reports whether the bucket is full again, so dropping it does not change the limit
+func (b *tokenBucket) idle(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= 1
+}
+
+// Blocks until a connection to the given IP address is allowed.
+// The destination limit is waited for first, so waiting for a busy destination does not hold up the global rate.
+// It returns the context's error if the context is cancelled while waiting.
+func (l *RateLimiter) wait(ctx context.Context, ip net.IP) error {
+	return l.waitDestination(ctx, l.destinationKey(ip))
+}
+
+// Blocks until a connection to a host whose address is unknown is allowed, see -proxyDNS.
+// The host is limited on its own, as its subnet is unknown.
+func (l *RateLimiter) waitHost(ctx context.Context, host string) error {
+	return l.waitDestination(ctx, host)
+}
+
+// Blocks until a connection to the destination with the given key is allowed
+func (l *RateLimiter) waitDestination(ctx context.Context, key string) error {
+	if l.HostRate > 0 {
+		if err := sleep(ctx, l.reserveDestination(key)); err != nil {
+			return err
+		}
+	}
+	if l.global != nil {
+		l.mutex.Lock()
+		delay := l.global.reserve(time.Now())
+		l.mutex.Unlock()
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+	if l.Jitter > 0 {
+		return sleep(ctx, time.Duration(rand.Int63n(int64(l.Jitter))))
+	}
+	return nil
+}
+
+// Takes a token from the bucket of the destination and returns the time to wait for it
+func (l *RateLimiter) reserveDestination(key string) time.Duration {
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, ok := l.destinations[key]
+	if !ok {
+		if len(l.destinations) >= maxIdleDestinations {
+			for k, b := range l.destinations {
+				if b.idle(now) {
+					delete(l.destinations, k)
+				}
+			}
+		}
+		bucket = newTokenBucket(l.HostRate, now)
+		l.destinations[key] = bucket
+	}
+	return bucket.reserve(now)
+}
+
+// Returns the subnet an IP address is grouped into
+func (l *RateLimiter) destinationKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%s/%d", ip4.Mask(net.CIDRMask(l.IPv4Prefix, 32)), l.IPv4Prefix)
+	}
+	return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(l.IPv6Prefix, 128)), l.IPv6Prefix)
+}
+
+// Describes the configured limits for the run summary
+func (l *RateLimiter) String() string {
+	var limits []string
+	if l.Rate > 0 {
+		limits = append(limits, fmt.Sprintf("%g connections/s overall", l.Rate))
+	}
+	if l.HostRate > 0 {
+		limits = append(limits, fmt.Sprintf("%g connections/s per /%d IPv4 and /%d IPv6 subnet",
+			l.HostRate, l.IPv4Prefix, l.IPv6Prefix))
+	}
+	if l.Jitter > 0 {
+		limits = append(limits, fmt.Sprintf("up to %v jitter", l.Jitter))
+	}
+	if len(limits) == 0 {
+		return "none"
+	}
+	return strings.Join(limits, ", ")
+}
+
+// Waits for the given duration or until the context is cancelled
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
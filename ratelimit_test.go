@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	bucket := newTokenBucket(10, start) // one token every 100ms
+
+	tests := []struct {
+		after time.Duration
+		wait  time.Duration
+	}{
+		{0, 0},                      // the full bucket allows one connection right away
+		{0, 100 * time.Millisecond}, // the next ones queue up behind it
+		{0, 200 * time.Millisecond},
+		{250 * time.Millisecond, 50 * time.Millisecond},
+		{2 * time.Second, 0}, // the bucket holds one token at most, so a pause allows no burst
+		{2 * time.Second, 100 * time.Millisecond},
+	}
+	for i, test := range tests {
+		wait := bucket.reserve(start.Add(test.after))
+		if diff := wait - test.wait; diff < -time.Microsecond || diff > time.Microsecond {
+			t.Errorf("reservation %d after %v: wait %v, want %v", i+1, test.after, wait, test.wait)
+		}
+	}
+	if bucket.idle(start.Add(2 * time.Second)) {
+		t.Error("bucket with a reserved token is idle")
+	}
+	if !bucket.idle(start.Add(2*time.Second + 200*time.Millisecond)) {
+		t.Error("refilled bucket is not idle")
+	}
+}
+
+func TestDestinationKey(t *testing.T) {
+	l := newRateLimiter(&Options{IPv4Prefix: 24, IPv6Prefix: 64})
+	tests := []struct {
+		ip, key string
+	}{
+		{"192.0.2.1", "192.0.2.0/24"},
+		{"192.0.2.254", "192.0.2.0/24"},
+		{"192.0.3.1", "192.0.3.0/24"},
+		{"::ffff:192.0.2.7", "192.0.2.0/24"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", "2001:db8:1:3::/64"},
+	}
+	for _, test := range tests {
+		if key := l.destinationKey(net.ParseIP(test.ip)); key != test.key {
+			t.Errorf("destinationKey(%s) = %s, want %s", test.ip, key, test.key)
+		}
+	}
+
+	// Every address is a destination of its own with the default prefixes
+	l = newRateLimiter(&Options{IPv4Prefix: 32, IPv6Prefix: 128})
+	if l.destinationKey(net.ParseIP("192.0.2.1")) == l.destinationKey(net.ParseIP("192.0.2.2")) {
+		t.Error("addresses share a destination with -ipv4Prefix=32")
+	}
+}
+
+func TestHostRateSharedBySubnet(t *testing.T) {
+	// One connection per minute and subnet, so a second connection to a subnet has to wait
+	l := newRateLimiter(&Options{HostRate: 1.0 / 60, IPv4Prefix: 24, IPv6Prefix: 64})
+	reserve := func(ip string) time.Duration {
+		return l.reserveDestination(l.destinationKey(net.ParseIP(ip)))
+	}
+
+	if wait := reserve("192.0.2.1"); wait != 0 {
+		t.Errorf("first connection waits %v", wait)
+	}
+	if wait := reserve("192.0.2.200"); wait < 59*time.Second {
+		t.Errorf("connection to the same /24 waits %v, want about a minute", wait)
+	}
+	if wait := reserve("192.0.3.1"); wait != 0 {
+		t.Errorf("connection to another /24 waits %v, want none", wait)
+	}
+	if wait := reserve("2001:db8::1"); wait != 0 {
+		t.Errorf("connection to an IPv6 subnet waits %v, want none", wait)
+	}
+	if len(l.destinations) != 3 {
+		t.Errorf("%d destination buckets, want 3", len(l.destinations))
+	}
+
+	// Waiting for the busy subnet ends when the context is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, net.ParseIP("192.0.2.3")); err != context.DeadlineExceeded {
+		t.Errorf("waiting for a busy subnet returned %v, want the context's error", err)
+	}
+}
+
+func TestGlobalRate(t *testing.T) {
+	l := newRateLimiter(&Options{Rate: 20, IPv4Prefix: 32, IPv6Prefix: 128}) // one connection every 50ms
+	start := time.Now()
+	for _, ip := range []string{"192.0.2.1", "198.51.100.1", "203.0.113.1"} {
+		if err := l.wait(context.Background(), net.ParseIP(ip)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The global limit applies across destinations: the first connection is free, the two others wait 50ms each
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("three connections took %v, want at least 100ms", elapsed)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of resolving a domain
+const (
+	resolveOK       = "NOERROR"
+	resolveNXDomain = "NXDOMAIN" // the name does not exist or has no addresses
+	resolveServFail = "SERVFAIL"
+	resolveTimeout  = "TIMEOUT"
+	resolveError    = "ERROR"
+	resolveProxy    = "PROXY" // passed to the proxy to resolve, see -proxyDNS
+)
+
+// Number of cached hosts above which resolved entries are dropped
+const maxCachedHosts = 10000
+
+// Contains the addresses a domain resolved to before probing
+type ResolveResult struct {
+	Addresses  []net.IP
+	Status     string
+	ReverseDNS []string // names of targets given as IP addresses
+	Duration   time.Duration
+	Error      string
+}
+
+// Caches the addresses of resolved hosts, so a domain is resolved once for all of its probes.
+// Concurrent lookups of the same host wait for the first one instead of querying again.
+// Failures are cached as well, so they are reported once per domain.
+type dnsCache struct {
+	mutex   sync.Mutex
+	entries map[string]*dnsCacheEntry
+}
+
+// A cached lookup; ips and err are set once ready is closed
+type dnsCacheEntry struct {
+	ready chan struct{}
+	ips   []net.IP
+	err   error
+}
+
+// Creates an empty cache
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: make(map[string]*dnsCacheEntry)}
+}
+
+// Stores the addresses of a host, replacing a cached lookup
+func (c *dnsCache) set(host string, ips []net.IP) {
+	entry := &dnsCacheEntry{ready: make(chan struct{}), ips: ips}
+	close(entry.ready)
+	c.mutex.Lock()
+	c.entries[host] = entry
+	c.mutex.Unlock()
+}
+
+// Removes a host from the cache once it is no longer needed
+func (c *dnsCache) forget(host string) {
+	c.mutex.Lock()
+	delete(c.entries, host)
+	c.mutex.Unlock()
+}
+
+// Resolves a target before its probes are run and records the outcome.
+// A target with an IP address from the input is not resolved; its address is cached for the domain instead.
+// It returns nil if the scan was stopped while waiting for the lookup, which is no outcome of the target.
+func (s *Scanner) resolveDomain(ctx context.Context, target Target) *ResolveResult {
+	if target.IP != nil {
+		s.dnsCache.set(target.Domain, []net.IP{target.IP})
+		return &ResolveResult{Addresses: []net.IP{target.IP}, Status: resolveOK}
+	}
+
+	ips, err := s.lookupHost(ctx, target.Domain)
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return nil
+	}
+	if err != nil {
+		return &ResolveResult{Status: resolveStatus(err), Error: err.Error()}
+	}
+	if len(ips) == 0 {
+		return &ResolveResult{Status: resolveProxy}
+	}
+	return &ResolveResult{Addresses: ips, Status: resolveOK}
+}
+
+// Returns the addresses of a host from the cache, resolving it on a miss.
+// IP addresses are returned as they are. The lookup is bounded by the timeout but not cancelled
+// when the scan is stopped, so the cache never holds a cancelled lookup.
+func (s *Scanner) lookupHost(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	s.dnsCache.mutex.Lock()
+	entry, ok := s.dnsCache.entries[host]
+	if !ok {
+		if len(s.dnsCache.entries) >= maxCachedHosts {
+			for h, e := range s.dnsCache.entries {
+				select {
+				case <-e.ready:
+					delete(s.dnsCache.entries, h)
+				default: // still being resolved
+				}
+			}
+		}
+		entry = &dnsCacheEntry{ready: make(chan struct{})}
+		s.dnsCache.entries[host] = entry
+	}
+	s.dnsCache.mutex.Unlock()
+
+	if !ok {
+		entry.ips, entry.err = s.resolveHost(ctx, host)
+		close(entry.ready)
+		return entry.ips, entry.err
+	}
+
+	select {
+	case <-entry.ready:
+		return entry.ips, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Queries the addresses of a host, using the configured resolver if -resolver is set
+// and the system resolver otherwise. With -proxyDNS no addresses are returned, the proxy resolves the host.
+func (s *Scanner) resolveHost(ctx context.Context, host string) ([]net.IP, error) {
+	if s.opts.ProxyDNS {
+		return nil, nil
+	}
+	if s.opts.Resolver != "" {
+		return s.Resolver.LookupIP(host)
+	}
+
+	lookupCtx, cancel := s.probeContext(ctx)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(lookupCtx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// Classifies a lookup error as NXDOMAIN, SERVFAIL or timeout
+func resolveStatus(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsNotFound:
+			return resolveNXDomain
+		case dnsErr.IsTimeout:
+			return resolveTimeout
+		case strings.Contains(dnsErr.Err, "server misbehaving"):
+			return resolveServFail
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return resolveTimeout
+	}
+	return resolveError
+}
+
+// Header of the resolution result file
+var resolveHeader = []string{"Domain", "Status", "Addresses", "ReverseDNS", "Error"}
+
+// Converts the resolution result of a domain to a row of the resolution result file.
+// It returns nil if the domain was not resolved.
+func resolveRecord(result *DomainResult) []string {
+	if result.Resolve == nil {
+		return nil
+	}
+	addresses := make([]string, len(result.Resolve.Addresses))
+	for i, ip := range result.Resolve.Addresses {
+		addresses[i] = ip.String()
+	}
+	return []string{result.Domain, result.Resolve.Status, strings.Join(addresses, ";"),
+		strings.Join(result.Resolve.ReverseDNS, ";"), result.Resolve.Error}
+}
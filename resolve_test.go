@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResolveDomainCancelledWhileWaiting(t *testing.T) {
+	s := newTestScanner(&Options{})
+	s.results = make(chan *DomainResult, 1)
+
+	// Another worker is still resolving the host
+	s.dnsCache.entries["example.com"] = &dnsCacheEntry{ready: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if resolve := s.resolveDomain(ctx, Target{Domain: "example.com"}); resolve != nil {
+		t.Fatalf("resolveDomain = %+v, want nil for a stopped scan", resolve)
+	}
+
+	// The domain was not scanned, so it gets no result and is not checkpointed
+	s.scanDomain(ctx, Target{Domain: "example.com"}, nil)
+	select {
+	case result := <-s.results:
+		t.Errorf("result %+v for a domain whose lookup was cancelled", result)
+	default:
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Error classes that can be retried, by the names used on the command line
+var retryClasses = map[string]string{
+	"timeout":     errTimeout,
+	"reset":       errConnectionReset,
+	"refused":     errConnectionRefused,
+	"misbehaving": errServerMisbehaving,
+}
+
+// Contains the outcome of probing a single cipher suite
+type ProbeResult struct {
+	Cipher   string
+	Family   string // address family probed, empty unless -family is set
+	Attempts int
+	Duration time.Duration // all attempts and the backoff between them
+	Version  string        // negotiated TLS version if the cipher suite is supported
+	Error    string        // error of the last attempt, empty if the cipher suite is supported
+}
+
+// Parses the comma-separated list of error classes to retry into a set of error categories
+func parseRetryClasses(list string) (map[string]bool, error) {
+	retryOn := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		category, ok := retryClasses[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown error class %q, expected timeout, reset, refused or misbehaving", name)
+		}
+		retryOn[category] = true
+	}
+	return retryOn, nil
+}
+
+// Probes a cipher suite, retrying errors of the retryable classes up to the configured number of attempts.
+// The delay between attempts starts at the backoff and doubles after every attempt.
+// It returns the connection state, the number of attempts made and the error of the last attempt.
+func (s *Scanner) probeCipherWithRetry(ctx context.Context, target Target, ips []net.IP, cipher *tls.CipherSuite) (*tls.ConnectionState, int, error) {
+	for attempt := 1; ; attempt++ {
+		state, err := s.probeCipher(ctx, target, ips, cipher)
+		if err == nil || attempt >= s.opts.Attempts || !s.retryable(err) {
+			return state, attempt, err
+		}
+		if err := sleep(ctx, retryDelay(s.opts.Backoff, attempt)); err != nil {
+			return nil, attempt, err
+		}
+	}
+}
+
+// Returns the delay after the given failed attempt, counted from 1: the backoff, doubled after every attempt
+func retryDelay(backoff time.Duration, attempt int) time.Duration {
+	return backoff << (attempt - 1)
+}
+
+// Reports whether the error belongs to one of the error classes to retry
+func (s *Scanner) retryable(err error) bool {
+	category, _ := classifyError(err.Error())
+	return s.retryOn[category]
+}
+
+// Header of the probe attempts result file
+var attemptsHeader = []string{"Domain", "Probes", "Retried", "Attempts"}
+
+// Converts the probes of a domain to a row of the probe attempts result file.
+// The attempts are listed per cipher suite in scan order, prefixed by the address family if -family is set. It returns nil if no probe was run.
+func attemptsRecord(result *DomainResult) []string {
+	if len(result.Probes) == 0 {
+		return nil
+	}
+	retried := 0
+	attempts := make([]string, len(result.Probes))
+	for i, probe := range result.Probes {
+		if probe.Attempts > 1 {
+			retried++
+		}
+		if probe.Family != "" {
+			attempts[i] = fmt.Sprintf("%s/%s:%d", probe.Family, probe.Cipher, probe.Attempts)
+		} else {
+			attempts[i] = fmt.Sprintf("%s:%d", probe.Cipher, probe.Attempts)
+		}
+	}
+	return []string{
+		result.Domain,
+		fmt.Sprintf("%d", len(result.Probes)),
+		fmt.Sprintf("%d", retried),
+		strings.Join(attempts, ";"),
+	}
+}
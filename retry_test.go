@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseRetryClasses(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    []string
+		invalid bool
+	}{
+		{"timeout,reset", []string{errTimeout, errConnectionReset}, false},
+		{" refused , misbehaving,", []string{errConnectionRefused, errServerMisbehaving}, false},
+		{"timeout,timeout", []string{errTimeout}, false},
+		{"", nil, false},
+		{"timeout,dns", nil, true},
+		{"Timeout", nil, true},
+	}
+	for _, test := range tests {
+		retryOn, err := parseRetryClasses(test.list)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parseRetryClasses(%q) accepted an unknown class", test.list)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRetryClasses(%q): %v", test.list, err)
+			continue
+		}
+		if len(retryOn) != len(test.want) {
+			t.Errorf("parseRetryClasses(%q) = %v, want %v", test.list, retryOn, test.want)
+		}
+		for _, category := range test.want {
+			if !retryOn[category] {
+				t.Errorf("parseRetryClasses(%q) = %v, lacks %s", test.list, retryOn, category)
+			}
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	retryOn, err := parseRetryClasses("timeout,reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestScanner(&Options{})
+	s.retryOn = retryOn
+
+	tests := []struct {
+		err  string
+		want bool
+	}{
+		{"dial tcp 192.0.2.1:443: i/o timeout", true},
+		{"context deadline exceeded", true},
+		{"read tcp 192.0.2.1:443: connection reset by peer", true},
+		{"dial tcp 192.0.2.1:443: connect: connection refused", false},
+		{"remote error: tls: handshake failure", false},
+		{"tls: failed to verify certificate: x509: certificate has expired", false},
+	}
+	for _, test := range tests {
+		if got := s.retryable(errors.New(test.err)); got != test.want {
+			t.Errorf("retryable(%q) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond}
+	for i, delay := range want {
+		if got := retryDelay(100*time.Millisecond, i+1); got != delay {
+			t.Errorf("delay after attempt %d = %v, want %v", i+1, got, delay)
+		}
+	}
+	if got := retryDelay(0, 3); got != 0 {
+		t.Errorf("delay without backoff = %v, want 0", got)
+	}
+}
+
+func TestProbeCipherWithRetry(t *testing.T) {
+	// A port nobody listens on refuses every connection at once
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	target := Target{Domain: "127.0.0.1", Port: port, IP: net.ParseIP("127.0.0.1")}
+	cipher := tls.CipherSuites()[0]
+	tests := []struct {
+		retryOn  string
+		attempts int
+	}{
+		{"refused", 3},
+		{"timeout", 1}, // refused connections are not retried
+	}
+	for _, test := range tests {
+		s := newTestScanner(&Options{Attempts: 3, Backoff: 10 * time.Millisecond})
+		if s.retryOn, err = parseRetryClasses(test.retryOn); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		_, attempts, err := s.probeCipherWithRetry(context.Background(), target, []net.IP{target.IP}, cipher)
+		if err == nil || attempts != test.attempts {
+			t.Errorf("retrying %s: %d attempts, error %v; want %d attempts and an error", test.retryOn, attempts, err, test.attempts)
+		}
+		// Two retries wait 10 and 20 ms
+		if elapsed := time.Since(start); test.attempts == 3 && elapsed < 30*time.Millisecond {
+			t.Errorf("retrying %s took %v, want at least the backoff of 30ms", test.retryOn, elapsed)
+		}
+	}
+}
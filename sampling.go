@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// Parses the -ranks option, an inclusive range of ranks such as 1-1000, 1000- or a single rank.
+// The last rank is 0 for an open range. An empty option selects all ranks and returns 0, 0.
+func parseRankRange(s string) (first, last int, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, 0, nil
+	}
+	from, to, found := strings.Cut(s, "-")
+	if !found {
+		to = from
+	}
+	if first, err = strconv.Atoi(strings.TrimSpace(from)); err != nil || first < 1 {
+		return 0, 0, fmt.Errorf("invalid first rank %q", from)
+	}
+	if strings.TrimSpace(to) != "" {
+		if last, err = strconv.Atoi(strings.TrimSpace(to)); err != nil || last < first {
+			return 0, 0, fmt.Errorf("invalid last rank %q", to)
+		}
+	}
+	return first, last, nil
+}
+
+// Parses the -shard option i/n, selecting the i-th of n shards, numbered from 1.
+// An empty option returns 0, 0, which selects all targets.
+func parseShard(s string) (index, count int, err error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, 0, nil
+	}
+	i, n, found := strings.Cut(s, "/")
+	if !found {
+		return 0, 0, fmt.Errorf("expected i/n, such as 1/4")
+	}
+	if count, err = strconv.Atoi(n); err != nil || count < 1 {
+		return 0, 0, fmt.Errorf("invalid number of shards %q", n)
+	}
+	if index, err = strconv.Atoi(i); err != nil || index < 1 || index > count {
+		return 0, 0, fmt.Errorf("invalid shard %q, shards are numbered from 1 to %d", i, count)
+	}
+	return index, count, nil
+}
+
+// Wraps a source so that it produces a window of the input: the targets whose rank is within first and last,
+// if a rank range is set, of which the first offset targets are skipped and at most entries targets are produced
+// unless entries is -1. Reading stops once the window is complete.
+// The window is taken from the raw input, before ranges are expanded and invalid or duplicate entries are rejected.
+func selectEntries(source domainSource, first, last, offset, entries int) domainSource {
+	return func(emit func(target Target) bool) error {
+		skipped, produced := 0, 0
+		return source(func(target Target) bool {
+			if first > 0 && (target.Rank < first || (last > 0 && target.Rank > last)) {
+				return true // targets without a rank are left out as well
+			}
+			if skipped < offset {
+				skipped++
+				return true
+			}
+			if entries >= 0 && produced >= entries {
+				return false
+			}
+			produced++
+			return emit(target)
+		})
+	}
+}
+
+// Wraps a source so that it produces a random sample of the given fraction of the targets, if below 1,
+// and only the targets of one shard, if shards is above 0.
+// Both only depend on the target's name and the seed, not on the order of the input, so the same options
+// always select the same targets and the shards of a list are disjoint and together cover the whole list.
+func sampleTargets(source domainSource, fraction float64, seed int64, shard, shards int) domainSource {
+	return func(emit func(target Target) bool) error {
+		return source(func(target Target) bool {
+			label := target.Label()
+			if fraction < 1 && sampleValue(label, seed) >= fraction {
+				return true
+			}
+			if shards > 0 && int(targetHash(label, nil)%uint64(shards)) != shard-1 {
+				return true
+			}
+			return emit(target)
+		})
+	}
+}
+
+// Maps a target name and a seed to a pseudo-random number in [0, 1)
+func sampleValue(label string, seed int64) float64 {
+	return float64(targetHash(label, binary.BigEndian.AppendUint64(nil, uint64(seed)))>>11) / (1 << 53)
+}
+
+// Returns the FNV-1a hash of a target name, preceded by a prefix
+func targetHash(label string, prefix []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(prefix)
+	hash.Write([]byte(label))
+	return hash.Sum64()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestParseRankRange(t *testing.T) {
+	tests := []struct {
+		s           string
+		first, last int
+		invalid     bool
+	}{
+		{"", 0, 0, false},
+		{"1-1000", 1, 1000, false},
+		{"1000-", 1000, 0, false},
+		{" 5 - 10 ", 5, 10, false},
+		{"42", 42, 42, false},
+		{"0-10", 0, 0, true},
+		{"10-5", 0, 0, true},
+		{"-10", 0, 0, true},
+		{"a-b", 0, 0, true},
+		{"1-x", 0, 0, true},
+	}
+	for _, test := range tests {
+		first, last, err := parseRankRange(test.s)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parseRankRange(%q) accepted an invalid range", test.s)
+			}
+			continue
+		}
+		if err != nil || first != test.first || last != test.last {
+			t.Errorf("parseRankRange(%q) = %d, %d, %v; want %d, %d", test.s, first, last, err, test.first, test.last)
+		}
+	}
+}
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		s            string
+		index, count int
+		invalid      bool
+	}{
+		{"", 0, 0, false},
+		{"1/4", 1, 4, false},
+		{"4/4", 4, 4, false},
+		{"1/1", 1, 1, false},
+		{"0/4", 0, 0, true},
+		{"5/4", 0, 0, true},
+		{"1/0", 0, 0, true},
+		{"-1/4", 0, 0, true},
+		{"2", 0, 0, true},
+		{"a/b", 0, 0, true},
+	}
+	for _, test := range tests {
+		index, count, err := parseShard(test.s)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parseShard(%q) accepted an invalid shard", test.s)
+			}
+			continue
+		}
+		if err != nil || index != test.index || count != test.count {
+			t.Errorf("parseShard(%q) = %d, %d, %v; want %d, %d", test.s, index, count, err, test.index, test.count)
+		}
+	}
+}
+
+// Returns a source of the targets target1 to targetN, ranked by their number
+func rankedTestSource(n int) domainSource {
+	return func(emit func(target Target) bool) error {
+		for i := 1; i <= n; i++ {
+			if !emit(Target{Domain: fmt.Sprintf("target%d.example", i), Rank: i}) {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+// Collects the ranks of the targets a source produces
+func collectRanks(t *testing.T, source domainSource) []int {
+	t.Helper()
+	var ranks []int
+	if err := source(func(target Target) bool {
+		ranks = append(ranks, target.Rank)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ranks
+}
+
+func TestSelectEntries(t *testing.T) {
+	tests := []struct {
+		name                         string
+		first, last, offset, entries int
+		want                         []int
+	}{
+		{"all", 0, 0, 0, -1, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"entries", 0, 0, 0, 3, []int{1, 2, 3}},
+		{"offset and entries", 0, 0, 2, 3, []int{3, 4, 5}},
+		{"open rank range", 8, 0, 0, -1, []int{8, 9, 10}},
+		{"rank range with offset", 3, 7, 1, 2, []int{4, 5}},
+		{"offset beyond the input", 0, 0, 20, -1, nil},
+		{"no entries", 0, 0, 0, 0, nil},
+	}
+	for _, test := range tests {
+		ranks := collectRanks(t, selectEntries(rankedTestSource(10), test.first, test.last, test.offset, test.entries))
+		if !slices.Equal(ranks, test.want) {
+			t.Errorf("%s: ranks = %v, want %v", test.name, ranks, test.want)
+		}
+	}
+
+	// Targets without a rank are left out once a rank range is set
+	source := selectEntries(listSource([]string{"example.com"}), 1, 0, 0, -1)
+	if ranks := collectRanks(t, source); len(ranks) != 0 {
+		t.Errorf("target without a rank selected by a rank range")
+	}
+
+	// Entries are counted as read, so a range is a single entry
+	var domains []string
+	source = expandRanges(selectEntries(listSource([]string{"10.0.0.0/30", "example.com"}), 0, 0, 0, 1))
+	if err := source(func(target Target) bool {
+		domains = append(domains, target.Domain)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"}; !slices.Equal(domains, want) {
+		t.Errorf("-entries=1 selected %v, want %v", domains, want)
+	}
+}
+
+func TestSampleTargets(t *testing.T) {
+	const n = 2000
+
+	// Shards are disjoint and together cover the whole input
+	seen := make(map[int]int)
+	for shard := 1; shard <= 4; shard++ {
+		ranks := collectRanks(t, sampleTargets(rankedTestSource(n), 1, 0, shard, 4))
+		if len(ranks) < n/4*8/10 || len(ranks) > n/4*12/10 {
+			t.Errorf("shard %d of 4 holds %d of %d targets", shard, len(ranks), n)
+		}
+		for _, rank := range ranks {
+			seen[rank]++
+		}
+	}
+	if len(seen) != n {
+		t.Errorf("the shards cover %d of %d targets", len(seen), n)
+	}
+	for rank, count := range seen {
+		if count != 1 {
+			t.Errorf("target %d is in %d shards", rank, count)
+		}
+	}
+
+	// The same seed selects the same sample, whatever the order of the input
+	sample := collectRanks(t, sampleTargets(rankedTestSource(n), 0.1, 42, 0, 0))
+	if len(sample) < n/10*7/10 || len(sample) > n/10*13/10 {
+		t.Errorf("sample of 10%% holds %d of %d targets", len(sample), n)
+	}
+	if again := collectRanks(t, sampleTargets(rankedTestSource(n), 0.1, 42, 0, 0)); !slices.Equal(again, sample) {
+		t.Error("the same seed selected another sample")
+	}
+	reversed := func(emit func(target Target) bool) error {
+		for i := n; i >= 1; i-- {
+			if !emit(Target{Domain: fmt.Sprintf("target%d.example", i), Rank: i}) {
+				return nil
+			}
+		}
+		return nil
+	}
+	fromReversed := collectRanks(t, sampleTargets(reversed, 0.1, 42, 0, 0))
+	slices.Sort(fromReversed)
+	if !slices.Equal(fromReversed, sample) {
+		t.Error("the sample depends on the order of the input")
+	}
+	if other := collectRanks(t, sampleTargets(rankedTestSource(n), 0.1, 43, 0, 0)); slices.Equal(other, sample) {
+		t.Error("another seed selected the same sample")
+	}
+
+	// Sampling within a shard keeps to the shard
+	shard := collectRanks(t, sampleTargets(rankedTestSource(n), 1, 0, 2, 4))
+	for _, rank := range collectRanks(t, sampleTargets(rankedTestSource(n), 0.5, 42, 2, 4)) {
+		if !slices.Contains(shard, rank) {
+			t.Errorf("sampled target %d is not in shard 2", rank)
+		}
+	}
+}
@@ -1,22 +1,70 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/csv"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Scanner struct {
-	Domains        []string
-	ScannedCiphers []string
-	opts           *Options
-	Mutex          *sync.Mutex
-	ErrorCounts    ErrorCounter
+	source       domainSource
+	opts         *Options
+	Mutex        *sync.Mutex
+	ErrorCounts  ErrorCounter
+	HTTPClient   *http.Client       // used for OCSP, CRL and HTTP security queries
+	CTLogs       *CTLogList         // logs used to verify SCTs, nil if not configured
+	Resolver     *DNSResolver       // used for CAA and TLSA lookups
+	RateLimiter  *RateLimiter       // paces every connection opened by the scan
+	Dialer       Dialer             // opens every connection of the scan, directly or through a proxy
+	dnsCache     *dnsCache          // addresses of the hosts being scanned
+	results      chan *DomainResult // domain results on their way to the result writer
+	done         map[string]bool    // domains finished by a previous run when resuming, nil otherwise
+	retryOn      map[string]bool    // error categories retried by the cipher suite probes
+	inputColumns []string           // names of the input columns kept in the result files
+	closed       int                // targets skipped by the TCP pre-check, guarded by Mutex
+	shard        int                // shard of the targets to scan, numbered from 1, see -shard
+	shards       int                // number of shards, 0 to scan all targets
+	store        *resultStore       // database the results are also written to, nil unless -db is set
+}
+
+// Contains everything collected about a single domain during the scan
+type DomainResult struct {
+	Domain    string   // the target's label, host:port for targets on another port than 443
+	Extra     []string // input columns kept in the result files
+	Completed bool     // false if the scan was aborted by a domain-wide error
+	Closed    bool     // the port was closed in the TCP pre-check, the target was not probed
+	Error     string   // domain-wide error that aborted the scan, empty if it completed
+	Started   time.Time
+	Duration  time.Duration // from the start of the scan until the results were complete
+	Errors    []ScanError   // errors written to the error log, in the order they occurred
+	Resolve   *ResolveResult
+	Ciphers   []string
+	Probes    []ProbeResult  // probes that were run, in scan order
+	Families  []FamilyResult // results per address family, if -family is set
+	OCSP      *OCSPResult
+	CT        *CTResult
+	HTTP      *HTTPResult
+	DNS       *DNSResult
+
+	Fingerprint  *FingerprintResult
+	Certificates []CertificateInfo // chain of the first successful handshake, leaf first
+}
+
+// An error of a domain as written to the error log and counted in the error report
+type ScanError struct {
+	Cipher   string // cipher suite of the failed probe, empty for domain-wide errors
+	Message  string
+	Category string // category of the error report, see classifyError
 }
 
 type ErrorCounter struct {
@@ -25,31 +73,113 @@ type ErrorCounter struct {
 	OtherErrors       map[string]int
 }
 
-// Creates a new instance of the Scanner struct with the provided domains and options.
-// It initializes the ScannedCiphers slice, sets the options, and initializes the ErrorCounts map.
+// Categories of the error report.
+// Errors that do not fall into a category are counted by their message.
+const (
+	errHandshakeFailure   = "handshake failure"
+	errNoSuchHost         = "no such host"
+	errCertificate        = "certificate related"
+	errTimeout            = "timeout related"
+	errConnectionRefused  = "connection refused"
+	errConnectionReset    = "connection reset by peer"
+	errPermissionDenied   = "connect permission denied"
+	errServerMisbehaving  = "server misbehaving"
+	errMissingOCSPStaple  = "missing OCSP staple"
+	missingOCSPStapleText = "Must-Staple is set but no OCSP response was stapled"
+)
+
+// Classifies an error message into a category of the error report.
+// It also reports whether the error affects the whole domain, in which case trying other cipher suites is pointless.
+func classifyError(errMsg string) (category string, domainWide bool) {
+	switch {
+	// Specific to the cipher suite, the next cipher may work
+	case strings.Contains(errMsg, "handshake failure"):
+		return errHandshakeFailure, false
+
+	case strings.Contains(errMsg, "no such host"):
+		return errNoSuchHost, true
+
+	// Fundamental issue that is unlikely to be resolved by trying different cipher suites
+	case strings.Contains(errMsg, "certificate"):
+		return errCertificate, true
+
+	// Handshakes bounded by a context report an expired deadline instead of a timeout
+	case strings.Contains(errMsg, "timeout"), strings.Contains(errMsg, "deadline exceeded"):
+		return errTimeout, true
+
+	// Not specific to the cipher suite but rather indicates a broader connectivity issue
+	case strings.Contains(errMsg, "connection refused"):
+		return errConnectionRefused, true
+
+	// Remote server forcibly closes the TCP connection. Attempting other connections
+	// with different ciphers, is unlikely to resolve the issue.
+	case strings.Contains(errMsg, "connection reset"):
+		return errConnectionReset, true
+
+	// Fundamental issue on client-side.
+	case strings.Contains(errMsg, "permission denied"):
+		return errPermissionDenied, true
+
+	// Fundamental issue that indicates broader configuration problem
+	case strings.Contains(errMsg, "server misbehaving"):
+		return errServerMisbehaving, true
+
+	case strings.Contains(errMsg, missingOCSPStapleText):
+		return errMissingOCSPStaple, false
+	}
+	return errMsg, false
+}
+
+// Adds an error of the given category to the counts
+func (c *ErrorCounter) add(category string) {
+	switch category {
+	case errHandshakeFailure:
+		c.HandshakeFailures++
+	case errNoSuchHost:
+		c.NoHostFound++
+	default:
+		c.OtherErrors[category]++
+	}
+}
+
+// Creates a new instance of the Scanner struct with the provided domain source and options.
+// It sets the options and initializes the ErrorCounts map.
 // The Scanner struct is used to perform TLS scanning on the specified domains.
-func newScanner(domains []string, opts *Options) *Scanner {
-	return &Scanner{
-		Domains:        domains,
-		ScannedCiphers: make([]string, 0),
-		opts:           opts,
-		Mutex:          &sync.Mutex{},
+func newScanner(source domainSource, opts *Options) *Scanner {
+	s := &Scanner{
+		source: source,
+		opts:   opts,
+		Mutex:  &sync.Mutex{},
 		ErrorCounts: ErrorCounter{
 			OtherErrors: make(map[string]int),
 		},
+		RateLimiter: newRateLimiter(opts),
+		Dialer:      &net.Dialer{},
+		dnsCache:    newDNSCache(),
 	}
+
+	// HTTP requests open their connections through the scanner as well, so they are rate limited too
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = s.dial
+	s.HTTPClient = &http.Client{Timeout: opts.Timeout, Transport: transport}
+	return s
 }
 
 // Starts the TLS scanner.
 // It creates an output folder to save the results, creates a file to save the error log,
 // and scans the specified domains for TLS support.
-// The scan results are saved to a CSV file.
-func (s *Scanner) startScanner() {
+// The scan results are streamed to the result files while the scan is running.
+// Cancelling the context stops the scan: no new domains are started, running domains are abandoned
+// after their running probes, and the results of all finished domains are kept.
+func (s *Scanner) startScanner(ctx context.Context) {
 
 	/* Create an output folder to save the results */
 	if s.opts.SaveDir != "" {
 		// Create a folder called output to save the results if it doesn't exist
 		os.Chdir(s.opts.SaveDir)
+	} else if s.opts.Resume {
+		// Keep the results of the previous run
+		os.Mkdir("output", 0755)
 	} else {
 		// Create a folder called output to save the results if it doesn't exist
 		if _, err := os.Stat("output"); err == nil {
@@ -67,65 +197,148 @@ func (s *Scanner) startScanner() {
 		logFileName = "./output/errorLog.txt"
 	}
 
-	file, err := os.OpenFile(logFileName, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+	logFlags := os.O_TRUNC | os.O_CREATE | os.O_WRONLY
+	if s.opts.Resume {
+		if !s.loadPreviousRun(logFileName) {
+			return
+		}
+		logFlags = os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	}
+
+	file, err := os.OpenFile(logFileName, logFlags, 0644)
 	if err != nil {
 		fmt.Printf("Error opening or creating the log file: %v\n", err)
 		return
 	}
 	defer file.Close()
 
-	var wg sync.WaitGroup
+	/* Start the writer that appends the domain results to the result files */
+	writer, err := newResultWriter(s)
+	if err != nil {
+		fmt.Printf("Error creating the result files: %v\n", err)
+		return
+	}
+	defer writer.close()
 
-	/* Create a buffered channel with a capacity of s.Concurrency
-	limit the number of goroutines that can run at the same time
-	channel defined as empty struct cos it takes no memory */
-	if !s.opts.Naive { // default
-		sem := make(chan struct{}, s.opts.Concurrency) // limiting the number of goroutines that can actively perform work at the same time
-
-		for _, domain := range s.Domains {
-			wg.Add(1)                // new goroutine
-			sem <- struct{}{}        // will block if the channel is full, routine sends struct to take slot in the channel
-			go func(domain string) { // closure function
-				defer wg.Done() // decrease the counter when the goroutine completes
-				s.scanDomain(domain, file)
-				<-sem // release a slot in the channel
-			}(domain)
-		}
+	/* Normalize the targets, skipping invalid and duplicate ones */
+	normalizer, err := newTargetNormalizer(s.resultPath("rejects.csv"), s.opts.KeepWWW)
+	if err != nil {
+		fmt.Printf("Error creating the rejects file: %v\n", err)
+		return
+	}
+	defer normalizer.close()
+	source := sampleTargets(normalizer.wrap(s.source), s.opts.Sample, s.opts.Seed, s.shard, s.shards)
+
+	/* Scan the domains with a fixed pool of workers.
+	A producer reads the domains from the source and hands them to the workers,
+	which send their results to the writer. With a single worker the domains are scanned sequentially */
+	workers := s.opts.Concurrency
+	if s.opts.Naive || workers < 1 {
+		workers = 1
+	}
 
-		wg.Wait() // wait for all goroutines to complete
-		close(sem) // close the channel
-		fmt.Println("\033[38;5;208mUsing concurrent scanner\033[0m")
-		fmt.Println("\033[38;5;208mScanning complete\033[0m")
-	} else {
-		
-		/* Naive scanner scans sequentially */
-		for _, domain := range s.Domains {
-			s.scanDomain(domain, file)
+	s.results = make(chan *DomainResult, workers)
+	writerDone := make(chan struct{})
+	go func() {
+		writer.run(s.results)
+		close(writerDone)
+	}()
+
+	jobs := make(chan Target)
+	go func() {
+		defer close(jobs) // no more domains, workers finish once the channel is drained
+		err := source(func(target Target) bool {
+			if s.done[target.Label()] {
+				return true // finished by a previous run
+			}
+			select {
+			case jobs <- target:
+				return true
+			case <-ctx.Done():
+				return false // scan stopped, don't start new domains
+			}
+		})
+		if err != nil {
+			fmt.Printf("Error reading the domains: %v\n", err)
 		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for target := range jobs {
+				s.scanDomain(ctx, target, file)
+			}
+		}()
+	}
+	wg.Wait() // wait for all workers to complete
+
+	if workers == 1 {
 		fmt.Println("\033[38;5;208mUsing naive scanner\033[0m")
-		fmt.Println("\033[38;5;208mScanning complete\033[0m")
+	} else {
+		fmt.Printf("\033[38;5;208mUsing concurrent scanner with %d workers\033[0m\n", workers)
+	}
+	fmt.Printf("\033[38;5;208mRate limit: %s\033[0m\n", s.RateLimiter)
+	if s.opts.Attempts > 1 {
+		fmt.Printf("\033[38;5;208mRetry policy: up to %d attempts per probe, backoff from %v, retrying %s\033[0m\n",
+			s.opts.Attempts, s.opts.Backoff, s.opts.RetryClasses)
+	}
+	if normalizer.invalid > 0 || normalizer.duplicates > 0 {
+		fmt.Printf("\033[38;5;208mSkipped %d invalid and %d duplicate targets, see %s\033[0m\n",
+			normalizer.invalid, normalizer.duplicates, s.resultPath("rejects.csv"))
 	}
+	if s.opts.PreCheck {
+		fmt.Printf("\033[38;5;208mTCP pre-check: %d closed targets skipped\033[0m\n", s.closed)
+	}
+	fmt.Println("\033[38;5;208mScanning complete\033[0m")
 
-	/* Save the cipher scan results to a CSV file*/
-	fileName := strings.TrimSuffix(strings.TrimPrefix(s.opts.CSVFilePath, "./"), ".csv")
+	close(s.results) // all workers are done, let the writer drain the channel
+	<-writerDone
 
-	if s.opts.CSVFilePath != "" { // Result file takes the name of the input file
-		if s.opts.SaveDir != "" {
-			s.saveResultsToCSV(s.opts.SaveDir + "/" + fileName + "_cipherScan.csv")
-		} else {
-			s.saveResultsToCSV("./output/" + fileName + "_cipherScan.csv")
+	if s.store != nil {
+		if err := s.store.finishRun(ctx.Err() != nil); err != nil {
+			fmt.Printf("Error writing to the database: %v\n", err)
 		}
 	}
-	if s.opts.DomainsList != "" {
-		if s.opts.SaveDir != "" {
-			s.saveResultsToCSV(s.opts.SaveDir + "/cipherScan.csv")
-		} else {
-			s.saveResultsToCSV("./output/cipherScan.csv")
-		}
+
+	if ctx.Err() != nil {
+		fmt.Println("\033[38;5;208mScan stopped early, results of the finished domains were saved\033[0m")
 	}
+
 	s.sortErrorFile(logFileName)
 }
 
+// Loads the state of a previous run for resuming it.
+// It reads the finished domains from the checkpoint file, removes the errors of unfinished domains
+// from the error log and rebuilds the error counts from it.
+// It reports whether the scan can continue.
+func (s *Scanner) loadPreviousRun(logFileName string) bool {
+	done, err := loadCheckpoint(s.resultPath("checkpoint.txt"))
+	if err != nil {
+		fmt.Printf("Error reading the checkpoint file: %v\n", err)
+		return false
+	}
+	if err := pruneErrorLog(logFileName, done); err != nil {
+		fmt.Printf("Error reading the log file: %v\n", err)
+		return false
+	}
+	if err := s.ErrorCounts.loadErrorLog(logFileName); err != nil {
+		fmt.Printf("Error reading the log file: %v\n", err)
+		return false
+	}
+
+	s.done = done
+	fmt.Printf("\033[38;5;208mResuming scan: %d domains already scanned\033[0m\n", len(done))
+	return true
+}
+
+// Returns the path of a result file in the output directory
+func (s *Scanner) resultPath(name string) string {
+	return resultFilePath(s.opts.SaveDir, s.opts.CSVFilePath, name)
+}
+
 // Analyzes the results of the scan.
 func (s *Scanner) analyzeResults() {
 	analyzer := newAnalyzer(*s)
@@ -136,121 +349,435 @@ func (s *Scanner) analyzeResults() {
 // It establishes a connection to the domain and checks if each cipher suite is supported.
 // If a cipher suite is supported, it adds it to the list of supported ciphers for the domain.
 // If an error occurs during the scan, it logs the error and updates the error counts.
-func (s *Scanner) scanDomain(domain string, file *os.File) {
+// Cipher suites are probed concurrently, bounded by the per-host limit.
+// If the context is cancelled, the domain is abandoned once the running probes are done and no result is recorded,
+// so a resumed scan will scan it again.
+func (s *Scanner) scanDomain(ctx context.Context, target Target, file *os.File) {
+	domain := target.Label() // names the target in the results and the error log
 	var supportedCiphers []string
+	var state *tls.ConnectionState // state of the first successful handshake
 
 	fmt.Printf("Scanning domain: %s \n", domain)
 
-	for _, cipher := range tls.CipherSuites() {
-		config := &tls.Config{
-			CipherSuites: []uint16{cipher.ID},
-			MinVersion:   tls.VersionTLS12,
-			MaxVersion:   tls.VersionTLS13,
+	// Every domain gets a result, even if the scan is aborted early by an error
+	result := &DomainResult{Domain: domain, Extra: target.Extra, Started: time.Now()}
+	interrupted := false
+	defer func() {
+		if !interrupted {
+			result.Duration = time.Since(result.Started)
+			s.results <- result
 		}
+	}()
+
+	// Resolve the domain once before probing, the probes dial the cached addresses
+	defer s.dnsCache.forget(target.Domain)
+	result.Resolve = s.resolveDomain(ctx, target)
+	if result.Resolve == nil {
+		interrupted = true // not scanned, so neither written nor checkpointed
+		fmt.Printf("\033[3m%s\033[0m: scan stopped\n", domain)
+		return
+	}
+	result.Resolve.Duration = time.Since(result.Started)
+	if result.Resolve.Error != "" {
+		result.Error = result.Resolve.Error
+		category, _ := classifyError(result.Resolve.Error)
+		result.Errors = append(result.Errors, ScanError{Message: result.Resolve.Error, Category: category})
+
+		s.Mutex.Lock()
+		s.ErrorCounts.add(category)
+		s.logError(domain, result.Resolve.Error, "", file)
+		s.Mutex.Unlock()
+
+		fmt.Printf("\033[3m%s\033[0m: \033[1;31m %s \033[0m  \n", domain, result.Resolve.Error)
+		return // the domain cannot be reached, go to the next domain
+	}
 
-		// establish a connection to the domain
-		dialer := net.Dialer{Timeout: s.opts.Timeout}
+	// Targets given as IP addresses are named by reverse DNS for the report
+	if ip := net.ParseIP(target.Domain); ip != nil {
+		result.Resolve.ReverseDNS = s.reverseLookup(ctx, ip)
+	}
 
-		// 443 is the default port for HTTPS
-		conn, err := tls.DialWithDialer(&dialer, "tcp", domain+":443", config)
-		if err == nil {
-			supportedCiphers = append(supportedCiphers, cipher.Name) // lock not put here due to performance overhead(release mutex for every cipher)
-			conn.Close()
-		} else {
+	// Skip closed ports before running the probes, which matters when scanning address ranges
+	if s.opts.PreCheck && !s.portOpen(ctx, target, result.Resolve.Addresses) {
+		if ctx.Err() != nil {
+			interrupted = true
+			return
+		}
+		s.Mutex.Lock()
+		s.closed++
+		s.Mutex.Unlock()
 
-			errMsg := err.Error()
+		result.Closed = true
+		fmt.Printf("\033[3m%s\033[0m: port %s closed, skipped\n", domain, target.port())
+		return
+	}
 
-			s.Mutex.Lock()
-			// Error checking logic
-			switch {
-			case strings.Contains(err.Error(), "handshake failure"):
-				s.ErrorCounts.HandshakeFailures++
-				fmt.Printf("\033[3m%s\033[0m: \033[1;31m %s for %s \033[0m  \n", domain, err, cipher.Name)
-				s.logError(domain, errMsg, cipher.Name, file)
-				s.Mutex.Unlock() // unlock and
-				continue         // skip to next cipher (next iteration)
-
-			case strings.Contains(err.Error(), "no such host"):
-				s.ErrorCounts.NoHostFound++
-				fmt.Printf("\033[3m%s\033[0m: \033[1;31m %s \033[0m  \n", domain, err)
-				s.logError(domain, errMsg, cipher.Name, file)
-				s.Mutex.Unlock()
-				return // return to main function and go to next domain
+	// The fingerprint probe runs first so that hosts failing certificate validation are still fingerprinted
+	if s.opts.Fingerprint {
+		result.Fingerprint = s.fingerprintServer(ctx, target)
+		if result.Fingerprint.Error == "" {
+			fmt.Printf("%s: JA3S %s, JA4S %s\n", domain, result.Fingerprint.JA3S, result.Fingerprint.JA4S)
+		}
+	}
 
-			// Fundamental issue that is unlikely to be resolved by trying different cipher suites
-			case strings.Contains(err.Error(), "certificate"):
-				s.ErrorCounts.OtherErrors["certificate related"]++
-				s.logError(domain, errMsg, cipher.Name, file)
-				s.Mutex.Unlock()
-				return
+	/* Probe the cipher suites, separately per address family if requested.
+	The domain's results combine the families: its ciphers are those offered over any family,
+	and the remaining checks use the first successful handshake */
+	families, err := s.familyTargets(result.Resolve.Addresses)
+	if err != nil {
+		result.Error = err.Error()
+		result.Errors = append(result.Errors, ScanError{Message: err.Error(), Category: err.Error()})
+		s.Mutex.Lock()
+		s.ErrorCounts.add(err.Error())
+		s.logError(domain, err.Error(), "", file)
+		s.Mutex.Unlock()
+
+		fmt.Printf("\033[3m%s\033[0m: \033[1;31m %s \033[0m  \n", domain, err)
+		return // go to the next domain
+	}
 
-			// Skip cipher suite causing timeout and move to next cipher
-			case strings.Contains(err.Error(), "timeout"):
-				s.ErrorCounts.OtherErrors["timeout related"]++
-				s.logError(domain, errMsg, cipher.Name, file)
-				s.Mutex.Unlock()
-				return
+	offered := make(map[string]bool)
+	completed := false
+	for _, family := range families {
+		outcome := s.probeCiphers(ctx, target, family, file)
+		if outcome.cancelled {
+			interrupted = true
+			fmt.Printf("\033[3m%s\033[0m: scan stopped\n", domain)
+			return
+		}
 
-			// Not specific to the cipher suite but rather indicates a broader connectivity issue
-			case strings.Contains(err.Error(), "connection refused"):
-				s.ErrorCounts.OtherErrors["connection refused"]++
-				s.logError(domain, errMsg, cipher.Name, file)
-				s.Mutex.Unlock()
-				return
+		result.Probes = append(result.Probes, outcome.probes...)
+		result.Errors = append(result.Errors, outcome.errors...)
+		if family.Family != "" {
+			result.Families = append(result.Families, outcome.familyResult(family))
+		}
+		if outcome.aborted {
+			if result.Error == "" {
+				result.Error = outcome.err
+			}
+			continue
+		}
 
-			// Remote server forcibly closes the TCP connection. Attempting other connections
-			// with different ciphers, is unlikely to resolve the issue.
-			case strings.Contains(err.Error(), "connection reset"):
-				s.ErrorCounts.OtherErrors["connection reset by peer"]++
-				s.logError(domain, errMsg, cipher.Name, file)
-				s.Mutex.Unlock()
-				return
+		completed = true
+		for _, cipher := range outcome.ciphers {
+			offered[cipher] = true
+		}
+		if state == nil {
+			state = outcome.state
+		}
+	}
+	if !completed {
+		return // go to the next domain
+	}
+	result.Error = "" // another family completed
 
-			// Fundamental issue on client-side.
-			case strings.Contains(err.Error(), "permission denied"):
-				s.ErrorCounts.OtherErrors["connect permission denied"]++
-				s.logError(domain, errMsg, cipher.Name, file)
-				s.Mutex.Unlock()
-				return
+	// collect the supported ciphers in scan order
+	for _, cipher := range tls.CipherSuites() {
+		if offered[cipher.Name] {
+			supportedCiphers = append(supportedCiphers, cipher.Name)
+		}
+	}
 
-			// Fundamental issue that indicates broader configuration problem
-			case strings.Contains(err.Error(), "server misbehaving"):
-				s.ErrorCounts.OtherErrors["server misbehaving"]++
-				s.logError(domain, errMsg, cipher.Name, file)
+	fmt.Printf("%s: \n %s\n", domain, strings.Join(supportedCiphers, ";"))
+
+	result.Completed = true
+	result.Ciphers = supportedCiphers
+	if state != nil {
+		result.Certificates = certificateChain(state.PeerCertificates)
+		if net.ParseIP(target.Domain) != nil {
+			if err := verifyPeerCertificates(*state, target.Domain); err != nil {
+				category, _ := classifyError(err.Error())
+				result.Errors = append(result.Errors, ScanError{Message: err.Error(), Category: category})
+				s.Mutex.Lock()
+				s.ErrorCounts.add(category)
+				s.logError(domain, err.Error(), "", file)
 				s.Mutex.Unlock()
-				return
 
-			default:
-				errMsg := err.Error()
-				if _, exists := s.ErrorCounts.OtherErrors[errMsg]; !exists {
-					s.ErrorCounts.OtherErrors[errMsg] = 0 // if error message does not exist
+				fmt.Printf("\033[3m%s\033[0m: \033[1;31m %s \033[0m  \n", domain, err)
+			}
+		}
+		result.OCSP = s.checkOCSP(*state)
+		if result.OCSP.MissingStaple {
+			fmt.Printf("\033[3m%s\033[0m: \033[1;31m Must-Staple is set but no OCSP response was stapled \033[0m\n", domain)
+		}
+		result.CT = s.checkCT(*state)
+		fmt.Printf("%s: %d of %d SCTs valid from %d operators, CT policy satisfied: %t\n",
+			domain, result.CT.ValidSCTs, len(result.CT.SCTs), result.CT.Operators, result.CT.PolicySatisfied)
+
+		if s.opts.HTTPChecks {
+			result.HTTP = s.checkHTTP(target)
+			fmt.Printf("%s: HSTS: %t (max-age=%d), HTTP->HTTPS redirect: %t\n",
+				domain, result.HTTP.HSTS, result.HTTP.MaxAge, result.HTTP.RedirectsToHTTPS)
+		}
+
+		// IP addresses have no CAA or TLSA records
+		if s.opts.DNSChecks && net.ParseIP(target.Domain) == nil {
+			result.DNS = s.checkDNS(target, *state)
+			fmt.Printf("%s: CAA: %s, TLSA records: %d, TLSA match: %t\n",
+				domain, result.DNS.CAAStatus, len(result.DNS.TLSA), result.DNS.TLSAMatch)
+		}
+	}
+
+	if result.OCSP != nil && result.OCSP.MissingStaple {
+		result.Errors = append(result.Errors, ScanError{Message: missingOCSPStapleText, Category: errMissingOCSPStaple})
+		s.Mutex.Lock()
+		s.ErrorCounts.add(errMissingOCSPStaple)
+		s.logError(domain, missingOCSPStapleText, "", file)
+		s.Mutex.Unlock()
+	}
+}
+
+// The outcome of probing the cipher suites of a domain over one address family
+type probeOutcome struct {
+	ciphers   []string // supported cipher suites in scan order
+	probes    []ProbeResult
+	state     *tls.ConnectionState // state of the first successful handshake in scan order
+	aborted   bool                 // a domain-wide error stopped the probes
+	cancelled bool                 // the scan was stopped while probing
+	err       string               // the domain-wide error
+	errors    []ScanError          // errors written to the error log
+}
+
+// Probes the cipher suites of a target at the addresses of one address family.
+// Probes run concurrently, at most HostConcurrency connections to the host at a time.
+// A domain-wide error stops the remaining probes and their retries; errors of probes still running at that point
+// are ignored, so the domain is counted once, as if the probes had run one after another.
+// When both address families are scanned, the errors are labelled with the family.
+func (s *Scanner) probeCiphers(ctx context.Context, target Target, family familyTarget, file *os.File) *probeOutcome {
+	domain := target.Label()
+	outcome := &probeOutcome{}
+	if len(family.IPs) == 0 && !s.opts.ProxyDNS {
+		outcome.aborted = true
+		outcome.err = "no " + family.Family + " address"
+		return outcome
+	}
+
+	label := ""
+	if s.opts.Family == familyBoth {
+		label = family.Family + ": "
+	}
+
+	limit := s.probeConcurrency()
+	ciphers := tls.CipherSuites()
+	supported := make([]bool, len(ciphers))
+	probes := make([]*ProbeResult, len(ciphers))
+	stateIndex := len(ciphers)
+
+	domainCtx, abort := context.WithCancel(ctx)
+	defer abort()
+
+	var probeMutex sync.Mutex // guards supported, probes, stateIndex and the outcome
+	isAborted := func() bool {
+		probeMutex.Lock()
+		defer probeMutex.Unlock()
+		return outcome.aborted
+	}
+
+	slots := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, cipher := range ciphers {
+		if ctx.Err() != nil {
+			outcome.cancelled = true
+			break
+		}
+		slots <- struct{}{}
+		if isAborted() {
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, cipher *tls.CipherSuite) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			started := time.Now()
+			connState, attempts, err := s.probeCipherWithRetry(domainCtx, target, family.IPs, cipher)
+
+			probeMutex.Lock()
+			defer probeMutex.Unlock()
+			probes[i] = &ProbeResult{Cipher: cipher.Name, Family: family.Family, Attempts: attempts, Duration: time.Since(started)}
+			if err != nil {
+				probes[i].Error = err.Error()
+			}
+			if err == nil {
+				probes[i].Version = tls.VersionName(connState.Version)
+				supported[i] = true
+				// keep the state of the first cipher suite in scan order, independent of the probe timing
+				if i < stateIndex {
+					outcome.state, stateIndex = connState, i
 				}
-				s.ErrorCounts.OtherErrors[errMsg]++
-				s.logError(domain, errMsg, cipher.Name, file)
+				return
+			}
+			if outcome.aborted {
+				return
+			}
+			if ctx.Err() != nil {
+				outcome.cancelled = true // stopped while waiting for the rate limiter or a retry, not an error of the domain
+				return
+			}
+
+			errMsg := label + err.Error()
+			category, domainWide := classifyError(errMsg)
+			if domainWide {
+				outcome.aborted = true
+				outcome.err = err.Error()
+				abort()
 			}
+
+			outcome.errors = append(outcome.errors, ScanError{Cipher: cipher.Name, Message: errMsg, Category: category})
+			s.Mutex.Lock()
+			s.ErrorCounts.add(category)
+			s.logError(domain, errMsg, cipher.Name, file)
 			s.Mutex.Unlock()
-			fmt.Printf("\033[3m%s\033[0m: \033[1;31m %s \033[0m for %s\n", domain, err, cipher.Name)
+
+			switch {
+			case category == errHandshakeFailure:
+				fmt.Printf("\033[3m%s\033[0m: \033[1;31m %s for %s \033[0m  \n", domain, errMsg, cipher.Name)
+			case category == errNoSuchHost:
+				fmt.Printf("\033[3m%s\033[0m: \033[1;31m %s \033[0m  \n", domain, errMsg)
+			case !domainWide:
+				fmt.Printf("\033[3m%s\033[0m: \033[1;31m %s \033[0m for %s\n", domain, errMsg, cipher.Name)
+			}
+		}(i, cipher)
+	}
+	wg.Wait() // wait for the running probes
+
+	// keep the probes that were run and the supported ciphers, in scan order
+	for i, probe := range probes {
+		if probe != nil {
+			outcome.probes = append(outcome.probes, *probe)
+		}
+		if supported[i] {
+			outcome.ciphers = append(outcome.ciphers, ciphers[i].Name)
 		}
+	}
+	return outcome
+}
 
+// Returns the number of cipher suite probes run concurrently against a domain.
+// The naive scanner probes one cipher suite after another.
+func (s *Scanner) probeConcurrency() int {
+	if s.opts.Naive || s.opts.HostConcurrency < 1 {
+		return 1
 	}
-	fmt.Printf("%s: \n %s\n", domain, strings.Join(supportedCiphers, ";"))
-	// Outside of loop to prevent lock contention
-	s.Mutex.Lock()
-	s.ScannedCiphers = append(s.ScannedCiphers, domain+": "+strings.Join(supportedCiphers, ";"))
-	s.Mutex.Unlock()
+	return s.opts.HostConcurrency
 }
 
-// Logs an error message for a given domain
-func (s *Scanner) logError(domain, errMsg, cipherName string, file *os.File) {
-	var logMsg string
-	if strings.Contains(errMsg, "no such host") {
-		// Exclude the cipher name from the log message for "no such host" errors
-		logMsg = fmt.Sprintf("%s: %s\n", domain, errMsg)
+// Probes whether the target accepts a single cipher suite, connecting to the given addresses.
+// It returns the connection state of the successful handshake.
+func (s *Scanner) probeCipher(ctx context.Context, target Target, ips []net.IP, cipher *tls.CipherSuite) (*tls.ConnectionState, error) {
+	config := &tls.Config{
+		CipherSuites: []uint16{cipher.ID},
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS13,
+	}
+	// The cipher suites of TLS 1.3 cannot be configured, so a TLS 1.2 cipher suite is only tested if TLS 1.3 is ruled out
+	if !slices.Contains(cipher.SupportedVersions, tls.VersionTLS13) {
+		config.MaxVersion = tls.VersionTLS12
+	}
+
+	conn, err := s.dialAddresses(ctx, "tcp", target.Domain, ips, target.port())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	probeCtx, cancel := s.probeContext(ctx)
+	defer cancel()
+
+	// Certificates rarely name IP addresses, so IP targets are probed without verification
+	// and their certificate is verified once the probes are done, see verifyPeerCertificates
+	if net.ParseIP(target.Domain) != nil {
+		config.InsecureSkipVerify = true
 	} else {
-		// Include the cipher name in the log message for all other errors
-		logMsg = fmt.Sprintf("%s: %s for %s\n", domain, errMsg, cipherName)
+		config.ServerName = target.Domain
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(probeCtx); err != nil {
+		return nil, err
+	}
+
+	state := tlsConn.ConnectionState()
+	return &state, nil
+}
+
+// Verifies the certificate chain of a handshake made without verification against the system roots and the host.
+// The error reads like the one of a verifying handshake, so it is classified the same way.
+func verifyPeerCertificates(state tls.ConnectionState, host string) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("tls: no peer certificates")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+	if err != nil {
+		return fmt.Errorf("tls: failed to verify certificate: %w", err)
+	}
+	return nil
+}
+
+// Opens a connection to the address once the rate limiter allows it.
+// The host name is resolved through the DNS cache first, so the destination's IP address can be rate limited.
+// If the scan is restricted to one address family, only addresses of that family are used.
+func (s *Scanner) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
 	}
 
+	ips, err := s.lookupHost(ctx, host)
+	if err == nil {
+		ips, err = s.allowedAddresses(ips)
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return s.dialAddresses(ctx, network, host, ips, port)
+}
+
+// Opens a connection to the first reachable address of the host, trying the addresses in order like net.Dialer does.
+// Without addresses, which the DNS cache holds for hosts resolved by the proxy (-proxyDNS), the host is dialed by name.
+// The time spent waiting for the rate limiter does not count against the timeout.
+func (s *Scanner) dialAddresses(ctx context.Context, network, host string, ips []net.IP, port string) (net.Conn, error) {
+	if len(ips) == 0 && s.opts.ProxyDNS {
+		if err := s.RateLimiter.waitHost(ctx, host); err != nil {
+			return nil, err
+		}
+		probeCtx, cancel := s.probeContext(ctx)
+		defer cancel()
+		return s.Dialer.DialContext(probeCtx, network, net.JoinHostPort(host, port))
+	}
+
+	var err error
+	for _, ip := range ips {
+		if err = s.RateLimiter.wait(ctx, ip); err != nil {
+			return nil, err
+		}
+
+		probeCtx, cancel := s.probeContext(ctx)
+		var conn net.Conn
+		conn, err = s.Dialer.DialContext(probeCtx, network, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// Returns the context for a single probe, bounded by the timeout.
+// Probes are not cancelled when the scan is stopped, so probes in flight can finish or time out.
+func (s *Scanner) probeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), s.opts.Timeout)
+}
+
+// Logs an error message for a given domain
+func (s *Scanner) logError(domain, errMsg, cipherName string, file *os.File) {
+	logMsg := fmt.Sprintf("%s: %s\n", domain, errorLogMessage(errMsg, cipherName))
+
 	// Check if the file is not nil and write the log message to the file
 	if file != nil {
 		_, err := file.WriteString(logMsg)
@@ -260,6 +787,16 @@ func (s *Scanner) logError(domain, errMsg, cipherName string, file *os.File) {
 	}
 }
 
+// Returns the text of an error as written to the error log after the domain
+func errorLogMessage(errMsg, cipherName string) string {
+	if strings.Contains(errMsg, "no such host") || cipherName == "" {
+		// Exclude the cipher name from the log message for "no such host" and domain-wide errors
+		return errMsg
+	}
+	// Include the cipher name in the log message for all other errors
+	return fmt.Sprintf("%s for %s", errMsg, cipherName)
+}
+
 // Sorts the content of the file specified by the given filename.
 // It reads the file, sorts the lines in ascending order, and writes the sorted
 // content back to the file.
@@ -269,42 +806,22 @@ func (s *Scanner) sortErrorFile(filename string) {
 		fmt.Printf("Error reading the file: %v\n", err)
 		return
 	}
-	lines := strings.Split(string(content), "\n")
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" && line != errorLogSeparator { // separators of a previous sort when resuming
+			lines = append(lines, line)
+		}
+	}
 
 	sort.Strings(lines)
 	sortedContent := strings.Join(lines, "\n")
-	sortedContent = strings.ReplaceAll(sortedContent, "\n", "\n--------------------------------\n")
-	err = os.WriteFile(filename, []byte(sortedContent), 0644)
-	if err != nil {
-		fmt.Printf("Error writing the sorted content back to the file: %v\n", err)
-		return
+	sortedContent = strings.ReplaceAll(sortedContent, "\n", "\n"+errorLogSeparator+"\n")
+	if sortedContent != "" {
+		sortedContent += "\n" // a complete last line is kept when resuming
 	}
-}
-
-// Saves the scanned ciphers to a CSV file.
-// It takes a filename as a parameter and creates a new file with the given name.
-// If the file already exists, it overwrites the old content.
-// The function locks the mutex to ensure thread safety while writing to the file.
-func (s *Scanner) saveResultsToCSV(filename string) {
-
-	s.Mutex.Lock()
-	defer s.Mutex.Unlock()
-
-	// Open the file for writing
-	file, err := os.Create(filename)
-	file.Truncate(0) // Overwrite the old content of output.csv
-
+	err = replaceFile(filename, []byte(sortedContent))
 	if err != nil {
-		fmt.Println("Error creating CSV file:", err)
+		fmt.Printf("Error writing the sorted content back to the file: %v\n", err)
 		return
 	}
-	defer file.Close()
-
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
-
-	for _, cipher := range s.ScannedCiphers {
-		parts := strings.Split(cipher, ":")
-		writer.Write([]string{parts[0], parts[1]})
-	}
 }
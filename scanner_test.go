@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Starts a TLS server on a local port presenting the certificate, and returns its address
+func newTestTLSServer(t *testing.T, cert *testCert) (host, port string) {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.cert.Raw}, PrivateKey: cert.key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	host, port, err = net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port
+}
+
+func TestProbeCipherIPTarget(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := newTestLeaf(t, ca, nil, "example.com")
+	host, port := newTestTLSServer(t, leaf)
+
+	s := newTestScanner(&Options{})
+	cipher := tls.CipherSuites()[0]
+	ips := []net.IP{net.ParseIP(host)}
+
+	// The certificate names neither the IP address nor is it trusted, yet the IP target can be probed
+	state, err := s.probeCipher(context.Background(), Target{Domain: host, Port: port}, ips, cipher)
+	if err != nil {
+		t.Fatalf("probing the IP target: %v", err)
+	}
+	if category, _ := classifyError(verifyPeerCertificates(*state, host).Error()); category != errCertificate {
+		t.Errorf("verification error classified as %q, want %q", category, errCertificate)
+	}
+
+	// Domain targets are still verified during the handshake
+	_, err = s.probeCipher(context.Background(), Target{Domain: "example.com", Port: port}, ips, cipher)
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("probing the domain target: error %v, want a certificate error", err)
+	}
+}
+
+func TestVerifyPeerCertificatesIPAddress(t *testing.T) {
+	ca := newTestCA(t)
+	leaf := newTestLeaf(t, ca, nil, "example.com", "192.0.2.1")
+
+	state := tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf.cert, ca.cert}}
+	err := verifyPeerCertificates(state, "192.0.2.2")
+	if err == nil || !strings.Contains(err.Error(), "not 192.0.2.2") {
+		t.Errorf("verifying against another address: %v, want a name mismatch", err)
+	}
+	if err := verifyPeerCertificates(tls.ConnectionState{}, "192.0.2.1"); err == nil {
+		t.Error("verifying without certificates succeeded")
+	}
+}
+
+func TestProbeConcurrency(t *testing.T) {
+	tests := []struct {
+		naive           bool
+		hostConcurrency int
+		want            int
+	}{
+		{false, 4, 4},
+		{false, 0, 1},
+		{true, 4, 1}, // the naive scanner probes one cipher suite after another
+	}
+	for _, test := range tests {
+		s := newTestScanner(&Options{Naive: test.naive, HostConcurrency: test.hostConcurrency})
+		if got := s.probeConcurrency(); got != test.want {
+			t.Errorf("naive %t, hostConcurrency %d: %d concurrent probes, want %d", test.naive, test.hostConcurrency, got, test.want)
+		}
+	}
+}
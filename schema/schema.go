@@ -0,0 +1,176 @@
+// Package schema defines the JSON format of the per-domain results written by the TLS scanner with -json.
+//
+// With -json=jsonl, every line of results.jsonl holds one Result; with -json=json, results.json holds an array of them.
+// Result files of a CSV scan take the name of the input file as prefix, like the CSV result files.
+//
+// The format is versioned by Version, which every Result carries in its schema_version field.
+// Fields may be added within a version, so readers should ignore unknown fields. Removing, renaming or changing
+// the meaning of a field increases the version.
+//
+// Durations are given in milliseconds, times in RFC 3339 format. Optional sections are omitted
+// if the check did not run, either because it was not enabled or because the scan of the domain failed earlier.
+package schema
+
+import "time"
+
+// Version of the format described by this package
+const Version = 1
+
+// Values of Result.Status
+const (
+	StatusCompleted = "completed" // the cipher suites were probed
+	StatusFailed    = "failed"    // the scan was aborted by a domain-wide error, see Result.Error
+	StatusClosed    = "closed"    // the port was closed in the TCP pre-check (-precheck), the target was not probed
+)
+
+// The results of a single target
+type Result struct {
+	SchemaVersion int               `json:"schema_version"`
+	Domain        string            `json:"domain"` // name of the target in all result files: the host, or host:port for ports other than 443
+	Host          string            `json:"host"`
+	Port          int               `json:"port"`
+	Input         map[string]string `json:"input,omitempty"` // input columns of the target by name, such as rank
+	Status        string            `json:"status"`
+	Error         string            `json:"error,omitempty"`  // domain-wide error if the status is failed
+	Errors        []Error           `json:"errors,omitempty"` // all errors of the target, as written to the error log
+	Timings       Timings           `json:"timings"`
+
+	Resolve          *Resolve            `json:"resolve,omitempty"`
+	Ciphers          []string            `json:"ciphers"`                      // supported cipher suites in Go's preference order
+	CiphersByVersion map[string][]string `json:"ciphers_by_version,omitempty"` // supported cipher suites by the negotiated version, e.g. "TLS 1.3"
+	Probes           []Probe             `json:"probes,omitempty"`             // cipher suite probes that were run, in scan order
+	Families         []Family            `json:"families,omitempty"`           // results per address family, with -family 4, 6 or both
+	Certificates     []Certificate       `json:"certificates,omitempty"`       // chain of the first successful handshake, leaf first
+
+	OCSP        *OCSP        `json:"ocsp,omitempty"`
+	CT          *CT          `json:"ct,omitempty"`
+	HTTP        *HTTP        `json:"http,omitempty"`        // with -http
+	DNS         *DNS         `json:"dns,omitempty"`         // with -dns
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"` // with -fingerprint
+}
+
+// When the target was scanned and how long the scan took
+type Timings struct {
+	Started   time.Time `json:"started"`
+	TotalMS   float64   `json:"total_ms"`   // from the start of the scan of the target until its results were complete
+	ResolveMS float64   `json:"resolve_ms"` // DNS resolution, including time spent waiting for a concurrent lookup of the same host
+}
+
+// An error of the target as written to the error log
+type Error struct {
+	Cipher   string `json:"cipher,omitempty"` // cipher suite of the failed probe, empty for domain-wide errors
+	Message  string `json:"message"`
+	Category string `json:"category"` // category of the error report, such as "handshake failure" or "timeout related"
+}
+
+// The outcome of resolving the target
+type Resolve struct {
+	Status     string   `json:"status"` // NOERROR, NXDOMAIN, SERVFAIL, TIMEOUT, ERROR or PROXY (resolved by the proxy)
+	Addresses  []string `json:"addresses,omitempty"`
+	ReverseDNS []string `json:"reverse_dns,omitempty"` // names of targets given as IP addresses
+	Error      string   `json:"error,omitempty"`
+}
+
+// A single cipher suite probe, including its retries
+type Probe struct {
+	Cipher     string  `json:"cipher"`
+	Family     string  `json:"family,omitempty"`  // IPv4 or IPv6 with -family, empty otherwise
+	Version    string  `json:"version,omitempty"` // negotiated TLS version if the cipher suite is supported
+	Attempts   int     `json:"attempts"`
+	DurationMS float64 `json:"duration_ms"` // all attempts and the backoff between them
+	Error      string  `json:"error,omitempty"`
+}
+
+// The results of one address family
+type Family struct {
+	Family    string   `json:"family"` // IPv4 or IPv6
+	Addresses []string `json:"addresses,omitempty"`
+	TLS       bool     `json:"tls"` // whether a TLS handshake succeeded over the family
+	Ciphers   []string `json:"ciphers,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// A certificate presented by the server
+type Certificate struct {
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	Serial             string    `json:"serial"` // hexadecimal
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	DNSNames           []string  `json:"dns_names,omitempty"`
+	KeyAlgorithm       string    `json:"key_algorithm"`
+	SignatureAlgorithm string    `json:"signature_algorithm"`
+	SHA256             string    `json:"sha256"` // hexadecimal fingerprint of the DER encoding
+}
+
+// OCSP stapling and revocation status of the leaf certificate
+type OCSP struct {
+	Stapled         bool       `json:"stapled"`
+	Status          string     `json:"status,omitempty"` // status of the stapled response
+	ProducedAt      *time.Time `json:"produced_at,omitempty"`
+	NextUpdate      *time.Time `json:"next_update,omitempty"`
+	Responder       string     `json:"responder,omitempty"`
+	MustStaple      bool       `json:"must_staple"`
+	MissingStaple   bool       `json:"missing_staple"`             // Must-Staple is set but no response was stapled
+	ResponderStatus string     `json:"responder_status,omitempty"` // with -revocation
+	CRLStatus       string     `json:"crl_status,omitempty"`       // with -revocation
+	Error           string     `json:"error,omitempty"`
+}
+
+// Certificate Transparency SCTs and the browser CT policy
+type CT struct {
+	SCTs            []SCT  `json:"scts,omitempty"`
+	ValidSCTs       int    `json:"valid_scts"`
+	Operators       int    `json:"operators"` // distinct operators of the logs that issued valid SCTs
+	PolicySatisfied bool   `json:"policy_satisfied"`
+	Error           string `json:"error,omitempty"`
+}
+
+// A single SCT and the outcome of its verification
+type SCT struct {
+	Source    string    `json:"source"` // tls (TLS extension), ocsp (stapled OCSP response) or embedded (certificate)
+	LogID     string    `json:"log_id"`
+	Log       string    `json:"log,omitempty"` // description of the log, with -ctLogList
+	Operator  string    `json:"operator,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Valid     bool      `json:"valid"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// HSTS, the HTTP to HTTPS redirect and Alt-Svc
+type HTTP struct {
+	StatusCode        int    `json:"status_code"`
+	HSTS              bool   `json:"hsts"`
+	MaxAge            int64  `json:"max_age"`
+	IncludeSubDomains bool   `json:"include_subdomains"`
+	Preload           bool   `json:"preload"`
+	RedirectsToHTTPS  bool   `json:"redirects_to_https"`
+	RedirectLocation  string `json:"redirect_location,omitempty"`
+	AltSvc            string `json:"alt_svc,omitempty"`
+	Error             string `json:"error,omitempty"`
+}
+
+// CAA and DANE/TLSA records
+type DNS struct {
+	CAA       []string `json:"caa,omitempty"`        // in presentation format
+	CAADomain string   `json:"caa_domain,omitempty"` // domain at which the relevant CAA record set was found
+	Issuer    string   `json:"issuer,omitempty"`
+	CAAStatus string   `json:"caa_status"` // no CAA, allowed, not allowed or unknown issuer
+	TLSA      []string `json:"tlsa,omitempty"`
+	TLSAMatch bool     `json:"tlsa_match"`
+	DNSSEC    bool     `json:"dnssec"` // whether the resolver validated the TLSA response
+	Error     string   `json:"error,omitempty"`
+}
+
+// JA3S and JA4S fingerprints of the ServerHello
+type Fingerprint struct {
+	JA3S       string `json:"ja3s,omitempty"`
+	JA3SString string `json:"ja3s_string,omitempty"`
+	JA4S       string `json:"ja4s,omitempty"`
+	Version    string `json:"version,omitempty"`
+	Cipher     string `json:"cipher,omitempty"`
+	ALPN       string `json:"alpn,omitempty"`
+	// Whether the fingerprints are those of a HelloRetryRequest, sent instead of the ServerHello
+	HelloRetryRequest bool   `json:"hello_retry_request,omitempty"`
+	Error             string `json:"error,omitempty"`
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Formats of the -input option
+const (
+	inputAuto  = "auto"
+	inputText  = "text"
+	inputJSON  = "json"
+	inputJSONL = "jsonl"
+	inputNmap  = "nmap"
+)
+
+// Checks the value of the -inputFormat option
+func validInputFormat(format string) bool {
+	switch format {
+	case inputAuto, inputText, inputJSON, inputJSONL, inputNmap:
+		return true
+	}
+	return false
+}
+
+// Returns a source reading the targets of a file, or of stdin if the path is "-", lazily.
+// With the auto format, the format is chosen by the file extension or, for stdin and unknown extensions,
+// by the first character of the input.
+func inputSource(path, format string) domainSource {
+	return func(emit func(target Target) bool) error {
+		var input io.Reader = os.Stdin
+		if path != "-" {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			input = file
+		}
+		reader := bufio.NewReader(input)
+
+		if format == inputAuto {
+			format = detectInputFormat(path, reader)
+		}
+
+		switch format {
+		case inputJSON:
+			return readJSONTargets(reader, emit)
+		case inputJSONL:
+			return readJSONLTargets(reader, emit)
+		case inputNmap:
+			return readNmapTargets(reader, emit)
+		}
+		return readTextTargets(reader, emit)
+	}
+}
+
+// Guesses the format of an input from the file extension, or else from its first non-blank character
+func detectInputFormat(path string, reader *bufio.Reader) string {
+	switch {
+	case strings.HasSuffix(path, ".jsonl"), strings.HasSuffix(path, ".ndjson"):
+		return inputJSONL
+	case strings.HasSuffix(path, ".json"):
+		return inputJSON
+	case strings.HasSuffix(path, ".xml"):
+		return inputNmap
+	}
+
+	// Peek further until the first non-blank character is found
+	for size := 64; ; size *= 4 {
+		head, err := reader.Peek(size)
+		trimmed := bytes.TrimLeft(head, " \t\r\n\xef\xbb\xbf")
+		if len(trimmed) > 0 {
+			switch trimmed[0] {
+			case '[':
+				return inputJSON
+			case '{':
+				return inputJSONL
+			case '<':
+				return inputNmap
+			}
+			return inputText
+		}
+		if err != nil || size >= reader.Size() {
+			return inputText
+		}
+	}
+}
+
+// Reads newline-separated targets. Blank lines and lines starting with # are skipped.
+func readTextTargets(r io.Reader, emit func(target Target) bool) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if target, ok := parseTarget(line); ok && !emit(target) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// A target of a JSON input, given either as a string or as an object
+type jsonTarget struct {
+	Domain   string          `json:"domain"`
+	Host     string          `json:"host"`
+	Hostname string          `json:"hostname"`
+	IP       string          `json:"ip"`
+	Port     json.RawMessage `json:"port"` // number or string
+	Rank     json.RawMessage `json:"rank"` // number or string
+}
+
+// Reads a JSON array of targets without holding the whole array in memory
+func readJSONTargets(r io.Reader, emit func(target Target) bool) error {
+	decoder := json.NewDecoder(r)
+	if token, err := decoder.Token(); err != nil {
+		return err
+	} else if token != json.Delim('[') {
+		return fmt.Errorf("expected a JSON array of targets")
+	}
+	for decoder.More() {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			return err
+		}
+		if target, ok := parseJSONTarget(raw); ok && !emit(target) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Reads one JSON target per line. Blank lines are skipped.
+func readJSONLTargets(r io.Reader, emit func(target Target) bool) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		if !json.Valid(text) {
+			return fmt.Errorf("line %d: invalid JSON", line)
+		}
+		if target, ok := parseJSONTarget(text); ok && !emit(target) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// Converts a JSON target, a string or an object with domain/host/hostname, ip, port and rank fields
+func parseJSONTarget(raw json.RawMessage) (Target, bool) {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		return parseTarget(name)
+	}
+
+	var object jsonTarget
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return Target{}, false
+	}
+	for _, candidate := range []string{object.Domain, object.Host, object.Hostname, object.IP} {
+		if candidate != "" {
+			name = candidate
+			break
+		}
+	}
+	target, ok := parseTarget(name)
+	if !ok {
+		return target, false
+	}
+
+	if object.IP != "" {
+		if target.IP = net.ParseIP(object.IP); target.IP == nil {
+			return target, false
+		}
+	}
+	target.Port = jsonScalar(object.Port) // checked by normalizeTarget
+	target.Rank, _ = strconv.Atoi(jsonScalar(object.Rank))
+	return target, true
+}
+
+// Returns a JSON number or string as a string, or "" if it is missing
+func jsonScalar(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String()
+	}
+	return ""
+}
+
+// A host of an nmap XML report (-oX), reduced to the fields needed to build targets
+type nmapHost struct {
+	Addresses []struct {
+		Addr     string `xml:"addr,attr"`
+		AddrType string `xml:"addrtype,attr"`
+	} `xml:"address"`
+	Hostnames []struct {
+		Name string `xml:"name,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"hostnames>hostname"`
+	Ports []struct {
+		Protocol string `xml:"protocol,attr"`
+		PortID   string `xml:"portid,attr"`
+		State    struct {
+			State string `xml:"state,attr"`
+		} `xml:"state"`
+		Service struct {
+			Name   string `xml:"name,attr"`
+			Tunnel string `xml:"tunnel,attr"`
+		} `xml:"service"`
+	} `xml:"ports>port"`
+}
+
+// Reads the hosts of an nmap XML report one by one and produces a target for every open TLS port:
+// 443/tcp and any port nmap identified as SSL/TLS. The host name is the one given to nmap or else the
+// reverse DNS name; the scanned address is kept so the target is not resolved again.
+func readNmapTargets(r io.Reader, emit func(target Target) bool) error {
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "host" {
+			continue
+		}
+
+		var host nmapHost
+		if err := decoder.DecodeElement(&host, &start); err != nil {
+			return err
+		}
+
+		var ip net.IP
+		for _, address := range host.Addresses {
+			if address.AddrType == "ipv4" || address.AddrType == "ipv6" {
+				ip = net.ParseIP(address.Addr)
+				break
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		name := ip.String()
+		for _, hostname := range host.Hostnames {
+			if hostname.Type == "user" || name == ip.String() {
+				name = hostname.Name
+			}
+		}
+
+		for _, port := range host.Ports {
+			if port.Protocol != "tcp" || port.State.State != "open" {
+				continue
+			}
+			if port.PortID != "443" && port.Service.Tunnel != "ssl" && port.Service.Name != "https" && port.Service.Name != "ssl" {
+				continue
+			}
+			target := Target{Domain: name, IP: ip}
+			if port.PortID != "443" {
+				target.Port = port.PortID
+			}
+			if !emit(target) {
+				return nil
+			}
+		}
+	}
+}
+
+// Converts a target string to a target. The string may be a domain or IP address with a scheme, a port and a path,
+// such as https://example.com:8443/index.html or [2001:db8::1]:443, a CIDR block or an IP range.
+// Ranges are expanded by expandRanges and all other targets are normalized by normalizeTarget before scanning.
+func parseTarget(s string) (Target, bool) {
+	target := Target{Domain: strings.TrimSpace(s)}
+	return target, target.Domain != ""
+}
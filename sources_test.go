@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// An nmap XML report with a web server, a host with TLS on another port only, a host without open ports
+// and a host whose HTTPS port is closed
+const testNmapReport = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE nmaprun>
+<nmaprun scanner="nmap" args="nmap -sV -oX scan.xml example.com 192.0.2.0/29">
+<host><status state="up"/>
+<address addr="192.0.2.1" addrtype="ipv4"/>
+<address addr="00:11:22:33:44:55" addrtype="mac"/>
+<hostnames><hostname name="ptr.example.net" type="PTR"/><hostname name="example.com" type="user"/></hostnames>
+<ports>
+<port protocol="tcp" portid="80"><state state="open"/><service name="http"/></port>
+<port protocol="tcp" portid="443"><state state="open"/><service name="http" tunnel="ssl"/></port>
+<port protocol="udp" portid="443"><state state="open"/><service name="quic"/></port>
+</ports></host>
+<host><status state="up"/>
+<address addr="192.0.2.2" addrtype="ipv4"/>
+<hostnames><hostname name="mail.example.com" type="PTR"/></hostnames>
+<ports>
+<port protocol="tcp" portid="993"><state state="open"/><service name="imaps"  tunnel="ssl"/></port>
+<port protocol="tcp" portid="8443"><state state="open"/><service name="https"/></port>
+</ports></host>
+<host><status state="up"/>
+<address addr="192.0.2.3" addrtype="ipv4"/>
+<ports><extraports state="filtered" count="1000"/></ports>
+</host>
+<host><status state="up"/>
+<address addr="2001:db8::4" addrtype="ipv6"/>
+<ports><port protocol="tcp" portid="443"><state state="closed"/><service name="https"/></port></ports>
+</host>
+</nmaprun>
+`
+
+// Reads all targets of an input file in the given format
+func readTestInput(t *testing.T, name, content, format string) ([]string, error) {
+	t.Helper()
+	path := writeTestFile(t, t.TempDir(), name, content)
+	var targets []string
+	err := inputSource(path, format)(func(target Target) bool {
+		targets = append(targets, formatTestTarget(target))
+		return true
+	})
+	return targets, err
+}
+
+func TestInputSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		format  string
+		targets []string
+	}{
+		{"text", "targets.txt", "\ufeffexample.com\n\n# comment\n  https://example.org:8443/  \n", inputText,
+			[]string{"example.com|||", "https://example.org:8443/|||"}},
+		{"JSON", "targets.json", `["example.com", {"domain": "example.org", "port": 8443, "rank": "2"},
+			{"host": "h.example", "ip": "192.0.2.1"}, {"hostname": "n.example", "port": "993", "rank": 7},
+			{"ip": "192.0.2.5"}, {"domain": "bad.example", "ip": "not an ip"}, {}, 42]`, inputJSON,
+			[]string{"example.com|||", "example.org|2|8443|", "h.example|||192.0.2.1", "n.example|7|993|", "192.0.2.5|||192.0.2.5"}},
+		{"JSON Lines", "targets.jsonl", "\"example.com\"\n\n{\"domain\": \"example.org\", \"rank\": 3}\n", inputJSONL,
+			[]string{"example.com|||", "example.org|3||"}},
+		{"nmap", "scan.xml", testNmapReport, inputNmap,
+			[]string{"example.com|||192.0.2.1", "mail.example.com||993|192.0.2.2", "mail.example.com||8443|192.0.2.2"}},
+		// The auto format takes the extension first
+		{"auto JSON Lines", "targets.ndjson", "{\"domain\": \"example.com\"}\n", inputAuto, []string{"example.com|||"}},
+		{"auto nmap", "scan.xml", testNmapReport, inputAuto,
+			[]string{"example.com|||192.0.2.1", "mail.example.com||993|192.0.2.2", "mail.example.com||8443|192.0.2.2"}},
+		{"auto by content", "targets", "  \n[\"example.com\"]", inputAuto, []string{"example.com|||"}},
+	}
+	for _, test := range tests {
+		targets, err := readTestInput(t, test.file, test.content, test.format)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !slices.Equal(targets, test.targets) {
+			t.Errorf("%s: targets = %q, want %q", test.name, targets, test.targets)
+		}
+	}
+}
+
+func TestInputSourceErrors(t *testing.T) {
+	tests := []struct {
+		name, file, content, format string
+	}{
+		{"JSON object instead of array", "targets.json", `{"domain": "example.com"}`, inputJSON},
+		{"truncated JSON", "targets.json", `["example.com", "exa`, inputJSON},
+		{"invalid JSON line", "targets.jsonl", "\"example.com\"\n{\"domain\": \n", inputJSONL},
+		{"broken XML", "scan.xml", "<nmaprun><host><address addr=\"192.0.2.1\" addrtype=\"ipv4\"></host>", inputNmap},
+	}
+	for _, test := range tests {
+		if _, err := readTestInput(t, test.file, test.content, test.format); err == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+}
+
+func TestDetectInputFormat(t *testing.T) {
+	tests := []struct {
+		path, content, format string
+	}{
+		{"list.jsonl", "example.com", inputJSONL},
+		{"list.ndjson", "", inputJSONL},
+		{"list.json", "", inputJSON},
+		{"scan.xml", "", inputNmap},
+		{"-", "\xef\xbb\xbf\n  [\"example.com\"]", inputJSON},
+		{"-", "{\"domain\": \"example.com\"}", inputJSONL},
+		{"-", "<?xml version=\"1.0\"?>", inputNmap},
+		{"list.txt", "example.com\n", inputText},
+		{"-", "", inputText},
+		{"-", strings.Repeat(" ", 200) + "<nmaprun>", inputNmap}, // beyond the first peek
+	}
+	for _, test := range tests {
+		if format := detectInputFormat(test.path, bufio.NewReader(strings.NewReader(test.content))); format != test.format {
+			t.Errorf("detectInputFormat(%s, %.20q) = %s, want %s", test.path, test.content, format, test.format)
+		}
+	}
+}
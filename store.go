@@ -0,0 +1,436 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/TeoLj/TLSscanner_FP.git/schema"
+	_ "modernc.org/sqlite" // pure Go SQLite driver, no cgo needed
+)
+
+// Migrations of the database schema, applied in order. The version of a database is the number of applied migrations,
+// recorded in schema_migrations. Existing migrations must never change; changes to the schema are new migrations.
+var migrations = []string{
+	// 1: runs, domains and the probes, certificates and errors of every domain
+	`CREATE TABLE runs (
+		id          INTEGER PRIMARY KEY,
+		started_at  TEXT NOT NULL,
+		finished_at TEXT,
+		status      TEXT NOT NULL, -- running, completed or interrupted
+		input       TEXT NOT NULL, -- -csv, -input or -domains of the run
+		options     TEXT NOT NULL  -- all options as JSON
+	);
+	CREATE TABLE domains (
+		id             INTEGER PRIMARY KEY,
+		run_id         INTEGER NOT NULL REFERENCES runs(id) ON DELETE CASCADE,
+		domain         TEXT NOT NULL, -- host, or host:port for ports other than 443
+		host           TEXT NOT NULL,
+		port           INTEGER NOT NULL,
+		status         TEXT NOT NULL, -- completed, failed or closed
+		error          TEXT,
+		started_at     TEXT NOT NULL,
+		duration_ms    REAL NOT NULL,
+		resolve_status TEXT,
+		addresses      TEXT,          -- separated by ;
+		ciphers        TEXT NOT NULL, -- supported cipher suites separated by ;
+		result         TEXT NOT NULL, -- the complete result in the JSON format of the schema package
+		UNIQUE (run_id, domain)
+	);
+	CREATE INDEX domains_domain ON domains(domain);
+	CREATE TABLE probes (
+		domain_id   INTEGER NOT NULL REFERENCES domains(id) ON DELETE CASCADE,
+		cipher      TEXT NOT NULL,
+		family      TEXT,
+		version     TEXT, -- negotiated TLS version if the cipher suite is supported
+		attempts    INTEGER NOT NULL,
+		duration_ms REAL NOT NULL,
+		error       TEXT
+	);
+	CREATE INDEX probes_domain ON probes(domain_id);
+	CREATE TABLE certificates (
+		domain_id           INTEGER NOT NULL REFERENCES domains(id) ON DELETE CASCADE,
+		position            INTEGER NOT NULL, -- 0 for the leaf
+		subject             TEXT NOT NULL,
+		issuer              TEXT NOT NULL,
+		serial              TEXT NOT NULL,
+		not_before          TEXT NOT NULL,
+		not_after           TEXT NOT NULL,
+		dns_names           TEXT, -- separated by ;
+		key_algorithm       TEXT NOT NULL,
+		signature_algorithm TEXT NOT NULL,
+		sha256              TEXT NOT NULL
+	);
+	CREATE INDEX certificates_domain ON certificates(domain_id);
+	CREATE INDEX certificates_sha256 ON certificates(sha256);
+	CREATE TABLE errors (
+		domain_id INTEGER NOT NULL REFERENCES domains(id) ON DELETE CASCADE,
+		cipher    TEXT, -- empty for domain-wide errors
+		message   TEXT NOT NULL,
+		category  TEXT NOT NULL
+	);
+	CREATE INDEX errors_domain ON errors(domain_id);`,
+}
+
+// Stores the results of a scan in a SQLite database, next to the result files.
+// Every scan is a run; the results of earlier runs are kept, so the history of a domain can be queried.
+// Like the result files, the database is written by the result writer only.
+type resultStore struct {
+	db    *sql.DB
+	runID int64
+}
+
+// Opens or creates the database and applies the pending migrations
+func openResultStore(path string) (*resultStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	st := &resultStore{db: db}
+	if err := st.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s: %v", path, err)
+	}
+	return st, nil
+}
+
+// Applies the migrations that are missing in the database, each in its own transaction
+func (st *resultStore) migrate() error {
+	if _, err := st.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, applied_at TEXT NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	if err := st.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("database schema version %d is newer than this scanner (%d)", version, len(migrations))
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := st.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", version+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version+1, storeTime()); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Starts the run the results are written to. When resuming, the most recent run that wrote the same checkpoint file
+// is continued instead and its domains that are not in the checkpoint file are removed, as they are scanned again.
+// Runs of other scans sharing the database are left alone; if there is no such run, a new one is started.
+func (st *resultStore) beginRun(opts *Options, done map[string]bool) error {
+	if done != nil {
+		runID, err := st.latestRunWriting(resultFilePath(opts.SaveDir, opts.CSVFilePath, "checkpoint.txt"), "checkpoint.txt")
+		if err != nil {
+			return err
+		}
+		if runID != 0 {
+			st.runID = runID
+			return st.resumeRun(done)
+		}
+	}
+
+	options, err := json.Marshal(storedOptions(opts))
+	if err != nil {
+		return err
+	}
+	input := opts.CSVFilePath
+	if input == "" {
+		input = opts.Input
+	}
+	if input == "" {
+		input = opts.DomainsList
+	}
+	res, err := st.db.Exec(`INSERT INTO runs (started_at, status, input, options) VALUES (?, 'running', ?, ?)`, storeTime(), input, string(options))
+	if err != nil {
+		return err
+	}
+	st.runID, err = res.LastInsertId()
+	return err
+}
+
+// Returns a copy of the options as recorded in the runs table, without the credentials of the URLs
+func storedOptions(opts *Options) *Options {
+	stored := *opts
+	stored.Proxy = withoutUserinfo(opts.Proxy)
+	stored.Resolver = withoutUserinfo(opts.Resolver)
+	return &stored
+}
+
+// Removes the user name and password from a URL. Other values are returned unchanged.
+func withoutUserinfo(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		// A password with characters that need escaping makes the URL invalid, cut everything up to the host
+		if scheme, rest, found := strings.Cut(value, "://"); found {
+			if i := strings.LastIndex(rest, "@"); i >= 0 {
+				return scheme + "://" + rest[i+1:]
+			}
+		}
+		return value
+	}
+	if u.User == nil {
+		return value
+	}
+	u.User = nil
+	return u.String()
+}
+
+// Removes the domains of the current run that are not finished according to the checkpoint file
+func (st *resultStore) resumeRun(done map[string]bool) error {
+	rows, err := st.db.Query(`SELECT id, domain FROM domains WHERE run_id = ?`, st.runID)
+	if err != nil {
+		return err
+	}
+	var unfinished []int64
+	for rows.Next() {
+		var id int64
+		var domain string
+		if err := rows.Scan(&id, &domain); err != nil {
+			rows.Close()
+			return err
+		}
+		if !done[domain] {
+			unfinished = append(unfinished, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range unfinished {
+		if _, err := st.db.Exec(`DELETE FROM domains WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	_, err = st.db.Exec(`UPDATE runs SET status = 'running', finished_at = NULL WHERE id = ?`, st.runID)
+	return err
+}
+
+// Records the end of the current run
+func (st *resultStore) finishRun(interrupted bool) error {
+	status := "completed"
+	if interrupted {
+		status = "interrupted"
+	}
+	_, err := st.db.Exec(`UPDATE runs SET status = ?, finished_at = ? WHERE id = ?`, status, storeTime(), st.runID)
+	return err
+}
+
+// Writes the results of a domain in a single transaction, so a domain is either stored completely or not at all
+func (st *resultStore) write(result *DomainResult, inputNames []string) error {
+	r := schemaResult(result, inputNames)
+	encoded, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // no effect after a commit
+
+	var resolveStatus string
+	var addresses []string
+	if r.Resolve != nil {
+		resolveStatus, addresses = r.Resolve.Status, r.Resolve.Addresses
+	}
+	res, err := tx.Exec(`INSERT INTO domains (run_id, domain, host, port, status, error, started_at, duration_ms, resolve_status, addresses, ciphers, result)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		st.runID, r.Domain, r.Host, r.Port, r.Status, r.Error, r.Timings.Started.UTC().Format(time.RFC3339Nano), r.Timings.TotalMS,
+		resolveStatus, strings.Join(addresses, ";"), strings.Join(r.Ciphers, ";"), string(encoded))
+	if err != nil {
+		return err
+	}
+	domainID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for _, probe := range r.Probes {
+		_, err := tx.Exec(`INSERT INTO probes (domain_id, cipher, family, version, attempts, duration_ms, error) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			domainID, probe.Cipher, probe.Family, probe.Version, probe.Attempts, probe.DurationMS, probe.Error)
+		if err != nil {
+			return err
+		}
+	}
+	for i, cert := range r.Certificates {
+		_, err := tx.Exec(`INSERT INTO certificates (domain_id, position, subject, issuer, serial, not_before, not_after, dns_names, key_algorithm, signature_algorithm, sha256)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			domainID, i, cert.Subject, cert.Issuer, cert.Serial, cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339),
+			strings.Join(cert.DNSNames, ";"), cert.KeyAlgorithm, cert.SignatureAlgorithm, cert.SHA256)
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range r.Errors {
+		_, err := tx.Exec(`INSERT INTO errors (domain_id, cipher, message, category) VALUES (?, ?, ?, ?)`, domainID, e.Cipher, e.Message, e.Category)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Counts the supported cipher suites of the completed domains of the current run
+func (st *resultStore) cipherCounts() (map[string]int, error) {
+	rows, err := st.db.Query(`SELECT ciphers FROM domains WHERE run_id = ? AND status = ?`, st.runID, schema.StatusCompleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var ciphers string
+		if err := rows.Scan(&ciphers); err != nil {
+			return nil, err
+		}
+		for _, cipher := range strings.Split(ciphers, ";") {
+			if cipher != "" {
+				counts[cipher]++
+			}
+		}
+	}
+	return counts, rows.Err()
+}
+
+// Counts the errors of the current run by category, like the error report of the scan
+func (st *resultStore) errorCounts() (ErrorCounter, error) {
+	counts := ErrorCounter{OtherErrors: make(map[string]int)}
+	rows, err := st.db.Query(`SELECT e.category, COUNT(*) FROM errors e JOIN domains d ON d.id = e.domain_id WHERE d.run_id = ? GROUP BY e.category`, st.runID)
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var category string
+		var n int
+		if err := rows.Scan(&category, &n); err != nil {
+			return counts, err
+		}
+		for i := 0; i < n; i++ {
+			counts.add(category)
+		}
+	}
+	return counts, rows.Err()
+}
+
+// Returns the rows the analyzer reads from a result file, built from the results stored for the current run,
+// and reports whether the run has any such results. Only the files the analyzer reads are supported.
+func (st *resultStore) records(name string) (recordSource, bool) {
+	section, ok := schemaSections[name]
+	if !ok {
+		return nil, false
+	}
+
+	var found bool
+	err := st.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM domains WHERE run_id = ? AND json_extract(result, ?) IS NOT NULL)`, st.runID, "$."+section).Scan(&found)
+	if err != nil || !found {
+		return nil, false
+	}
+
+	return func(fn func(row map[string]string)) error {
+		rows, err := st.db.Query(`SELECT result FROM domains WHERE run_id = ? AND json_extract(result, ?) IS NOT NULL ORDER BY id`, st.runID, "$."+section)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var encoded string
+			if err := rows.Scan(&encoded); err != nil {
+				return err
+			}
+			var r schema.Result
+			if err := json.Unmarshal([]byte(encoded), &r); err != nil {
+				return err
+			}
+			fn(schemaRecord(name, &r))
+		}
+		return rows.Err()
+	}, true
+}
+
+// Returns the ID of the most recent run whose options satisfy match, or 0 if there is none
+func (st *resultStore) latestRun(match func(opts *Options) bool) (int64, error) {
+	rows, err := st.db.Query(`SELECT id, options FROM runs ORDER BY id DESC`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var encoded string
+		if err := rows.Scan(&id, &encoded); err != nil {
+			return 0, err
+		}
+		var opts Options
+		if json.Unmarshal([]byte(encoded), &opts) == nil && match(&opts) {
+			return id, nil
+		}
+	}
+	return 0, rows.Err()
+}
+
+// Returns the ID of the most recent run that wrote the result file name at path, or 0 if there is none.
+// Runs are matched by the output directory and input file of their options, which determine the result file paths.
+func (st *resultStore) latestRunWriting(path, name string) (int64, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return 0, err
+	}
+	return st.latestRun(func(opts *Options) bool {
+		written, err := filepath.Abs(resultFilePath(opts.SaveDir, opts.CSVFilePath, name))
+		return err == nil && written == path
+	})
+}
+
+// Returns the SHA-256 fingerprints of the leaf certificates of a run by domain
+func (st *resultStore) leafCertificates(runID int64) (map[string]string, error) {
+	rows, err := st.db.Query(`SELECT d.domain, c.sha256 FROM domains d JOIN certificates c ON c.domain_id = d.id
+		WHERE d.run_id = ? AND c.position = 0`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	certificates := make(map[string]string)
+	for rows.Next() {
+		var domain, sha256 string
+		if err := rows.Scan(&domain, &sha256); err != nil {
+			return nil, err
+		}
+		certificates[domain] = sha256
+	}
+	return certificates, rows.Err()
+}
+
+// Closes the database
+func (st *resultStore) close() {
+	st.db.Close()
+}
+
+// Returns the current time in the format stored in the database
+func storeTime() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A result file and the function converting a domain result to one of its rows
+type resultFile struct {
+	file   *os.File
+	writer *csv.Writer
+	record func(result *DomainResult) []string
+}
+
+// Appends domain results to the result files as they arrive from the workers.
+// Every result is flushed to disk right away, so a crash only loses the domains still being scanned.
+// Once a domain's rows are written, the domain is recorded in the checkpoint file.
+type resultWriter struct {
+	files      []*resultFile
+	checkpoint *checkpoint
+	done       map[string]bool // finished domains of a resumed scan, nil otherwise
+	extra      []string        // header of the input columns appended to the rows, nil if there are none
+	json       *jsonResultFile // JSON result file, nil unless -json is set
+	store      *resultStore    // database, nil unless -db is set
+	inputNames []string        // names of the input columns in the JSON results and the database
+}
+
+// Creates the result files of the enabled checks and writes their headers.
+// When resuming, the existing result files are pruned to the finished domains and appended to instead.
+func newResultWriter(s *Scanner) (*resultWriter, error) {
+	w := &resultWriter{done: s.done, inputNames: s.inputColumns}
+	for _, name := range s.inputColumns {
+		w.extra = append(w.extra, "input_"+name)
+	}
+
+	cp, err := openCheckpoint(s.resultPath("checkpoint.txt"), s.done != nil)
+	if err != nil {
+		return nil, err
+	}
+	w.checkpoint = cp
+
+	// The cipher scan file has no header and lists the domains whose scan completed
+	if err := w.add(s.resultPath("cipherScan.csv"), nil, cipherScanRecord); err != nil {
+		return nil, err
+	}
+	if err := w.add(s.resultPath("resolve.csv"), resolveHeader, resolveRecord); err != nil {
+		return nil, err
+	}
+	if err := w.add(s.resultPath("ocsp.csv"), ocspHeader, ocspRecord); err != nil {
+		return nil, err
+	}
+	if err := w.add(s.resultPath("ct.csv"), ctHeader, ctRecord); err != nil {
+		return nil, err
+	}
+	if s.opts.Family != familyAny {
+		if err := w.add(s.resultPath("families.csv"), familyHeader, familyRecord); err != nil {
+			return nil, err
+		}
+	}
+	if s.opts.Attempts > 1 {
+		if err := w.add(s.resultPath("attempts.csv"), attemptsHeader, attemptsRecord); err != nil {
+			return nil, err
+		}
+	}
+	if s.opts.HTTPChecks {
+		if err := w.add(s.resultPath("http.csv"), httpHeader, httpRecord); err != nil {
+			return nil, err
+		}
+	}
+	if s.opts.JSONOutput != jsonNone {
+		f, err := openJSONResultFile(s.resultPath(jsonResultName(s.opts.JSONOutput)), s.opts.JSONOutput, s.done, s.inputColumns)
+		if err != nil {
+			w.close()
+			return nil, err
+		}
+		w.json = f
+	}
+	if s.store != nil {
+		if err := s.store.beginRun(s.opts, s.done); err != nil {
+			w.close()
+			return nil, fmt.Errorf("database: %v", err)
+		}
+		w.store = s.store
+	}
+	if s.opts.DNSChecks {
+		if err := w.add(s.resultPath("dns.csv"), dnsHeader, dnsRecord); err != nil {
+			return nil, err
+		}
+	}
+	if s.opts.Fingerprint {
+		if err := w.add(s.resultPath("fingerprints.csv"), fingerprintHeader, fingerprintRecord); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Creates a result file, overwriting old content, and writes the header if there is one.
+// Files with a header get the input columns of the domains appended to their rows.
+// When resuming, rows of unfinished domains are removed from an existing file and new rows are appended.
+func (w *resultWriter) add(filename string, header []string, record func(result *DomainResult) []string) error {
+	if header != nil && w.extra != nil {
+		header = append(append([]string{}, header...), w.extra...)
+		record = withInputColumns(record, len(w.extra))
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	writeHeader := header != nil
+	if w.done != nil {
+		if err := pruneResultFile(filename, w.done, header != nil); err != nil {
+			w.close()
+			return err
+		}
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		if info, err := os.Stat(filename); err == nil && info.Size() > 0 {
+			writeHeader = false
+		}
+	}
+
+	file, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		w.close()
+		return err
+	}
+
+	f := &resultFile{file: file, writer: csv.NewWriter(file), record: record}
+	w.files = append(w.files, f)
+
+	if writeHeader {
+		f.writer.Write(header)
+		f.writer.Flush()
+	}
+	return f.writer.Error()
+}
+
+// Receives domain results from the channel and appends them to the result files
+// until the channel is closed.
+func (w *resultWriter) run(results <-chan *DomainResult) {
+	for result := range results {
+		w.write(result)
+	}
+}
+
+// Appends the rows of a domain result to the result files and flushes them.
+// Targets skipped by the TCP pre-check are only recorded in the JSON result file, the database and the checkpoint file.
+func (w *resultWriter) write(result *DomainResult) {
+	for _, f := range w.files {
+		if result.Closed {
+			break
+		}
+		row := f.record(result)
+		if row == nil {
+			continue
+		}
+		f.writer.Write(row)
+		f.writer.Flush()
+		if err := f.writer.Error(); err != nil {
+			fmt.Printf("Error writing to %s: %v\n", f.file.Name(), err)
+			return // not checkpointed, so the domain is scanned again on resume
+		}
+	}
+	if w.json != nil {
+		if err := w.json.write(result); err != nil {
+			fmt.Printf("Error writing to %s: %v\n", w.json.file.Name(), err)
+			return
+		}
+	}
+	if w.store != nil {
+		if err := w.store.write(result, w.inputNames); err != nil {
+			fmt.Printf("Error writing %s to the database: %v\n", result.Domain, err)
+			return
+		}
+	}
+
+	if err := w.checkpoint.markDone(result.Domain); err != nil {
+		fmt.Printf("Error writing to the checkpoint file: %v\n", err)
+	}
+}
+
+// Closes all result files and the checkpoint file
+func (w *resultWriter) close() {
+	for _, f := range w.files {
+		f.writer.Flush()
+		f.file.Close()
+	}
+	if w.json != nil {
+		w.json.close()
+	}
+	w.checkpoint.close()
+}
+
+// Wraps a record function so that the input columns of the domain are appended to its rows.
+// Missing input columns are left empty, so all rows have the same number of fields.
+func withInputColumns(record func(result *DomainResult) []string, columns int) func(result *DomainResult) []string {
+	return func(result *DomainResult) []string {
+		row := record(result)
+		if row == nil {
+			return nil
+		}
+		extra := make([]string, columns)
+		copy(extra, result.Extra)
+		return append(row, extra...)
+	}
+}
+
+// Converts a domain result to a row of the cipher scan file.
+// It returns nil if the scan of the domain was aborted.
+func cipherScanRecord(result *DomainResult) []string {
+	if !result.Completed {
+		return nil
+	}
+	return []string{result.Domain, strings.Join(result.Ciphers, ";")}
+}
+
+// Returns the path of a result file in the output directory, which is ./output unless saveDir is set.
+// Results of a CSV scan take the name of the input file as prefix.
+func resultFilePath(saveDir, csvFilePath, name string) string {
+	outputDir := "./output"
+	if saveDir != "" {
+		outputDir = saveDir
+	}
+	if csvFilePath != "" {
+		fileName := strings.TrimSuffix(strings.TrimPrefix(csvFilePath, "./"), ".csv")
+		return outputDir + "/" + fileName + "_" + name
+	}
+	return outputDir + "/" + name
+}